@@ -0,0 +1,401 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nickgarlis/flowmon/nft"
+	"github.com/nickgarlis/flowmon/types"
+	"go.yaml.in/yaml/v3"
+)
+
+func loadConfig(path string) (*types.Config, error) {
+	yamlFile, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &types.Config{
+		Version: version,
+		Log: types.Log{
+			Level:  types.LogLevelInfo,
+			Format: types.LogFormatText,
+		},
+		Exporter: types.Exporter{
+			Interval:          types.Duration(10 * time.Second),
+			AttributeKeyStyle: types.AttributeKeyStyleSnake,
+			MetricKind:        types.MetricKindGauge,
+		},
+		NFTables: types.NFTables{
+			Family:        types.TableFamilyIPv4,
+			TableName:     nft.DefaultTableName,
+			ChainPriority: nft.DefaultChainPriority,
+		},
+		Counters: types.Counters{
+			Input:  []types.Counter{},
+			Output: []types.Counter{},
+		},
+	}
+
+	if err := yaml.Unmarshal(yamlFile, &cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.Exporter.Interval <= 0 {
+		return nil, fmt.Errorf("exporter.interval must be positive, got %s", cfg.Exporter.Interval)
+	}
+	if cfg.Exporter.JSON != nil && cfg.Exporter.JSON.Interval < 0 {
+		return nil, fmt.Errorf("exporter.json.interval must not be negative, got %s", cfg.Exporter.JSON.Interval)
+	}
+
+	if len(cfg.Exporter.OTLP) == 0 {
+		cfg.Exporter.OTLP = types.OTLPEndpoints{{}}
+	}
+	for i := range cfg.Exporter.OTLP {
+		otlp := &cfg.Exporter.OTLP[i]
+		if otlp.Protocol == "" {
+			otlp.Protocol = types.OTLPProtocolGRPC
+			if otlpEnv("PROTOCOL") == "http/protobuf" {
+				otlp.Protocol = types.OTLPProtocolHTTP
+			}
+		}
+		// An endpoint from the standard variables is picked up by the
+		// OTLP exporter itself, along with its TLS settings.
+		if otlp.Endpoint == "" && otlpEnv("ENDPOINT") == "" {
+			otlp.Endpoint = "localhost:4317"
+			if otlp.Protocol == types.OTLPProtocolHTTP {
+				otlp.Endpoint = "localhost:4318"
+			}
+		}
+	}
+	if err := cfg.Exporter.OTLP.Validate(); err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0, len(cfg.CountersFiles))
+	for _, file := range cfg.CountersFiles {
+		file, err := resolveInclude(path, file)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	if cfg.CountersDir != "" {
+		dirFiles, err := countersDirFiles(path, cfg.CountersDir)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, dirFiles...)
+	}
+	sources := labelSources{}
+	if err := sources.add("", &cfg.Counters, path); err != nil {
+		return nil, err
+	}
+	for i := range cfg.Tables {
+		if err := sources.add(fmt.Sprintf("tables[%d]", i), &cfg.Tables[i].Counters, path); err != nil {
+			return nil, err
+		}
+	}
+	for _, file := range files {
+		if err := mergeCounters(cfg, file, sources); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range cfg.Tables {
+		t := &cfg.Tables[i]
+		if t.Family == 0 {
+			t.Family = types.TableFamilyIPv4
+		}
+		if t.ChainPriority == 0 {
+			t.ChainPriority = nft.DefaultChainPriority
+		}
+	}
+	if err := cfg.ValidateTables(); err != nil {
+		return nil, err
+	}
+
+	if err := resolveTemplates(cfg); err != nil {
+		return nil, err
+	}
+	if err := resolveHosts(cfg); err != nil {
+		return nil, err
+	}
+
+	for _, t := range cfg.CounterTables() {
+		for _, counter := range t.Counters.All() {
+			if err := counter.Validate(); err != nil {
+				return nil, fmt.Errorf("counter %q: %w", counter.Label, err)
+			}
+			if err := counter.ValidateFamily(t.Family); err != nil {
+				return nil, fmt.Errorf("counter %q: %w", counter.Label, err)
+			}
+			if counter.Label == "" {
+				slog.Warn("A counter has no label, it can only be told apart by its match fields")
+			}
+		}
+		if err := t.Counters.ValidateLabels(); err != nil {
+			return nil, err
+		}
+	}
+
+	return cfg, nil
+}
+
+// envRe matches ${VAR} and ${VAR:-default}.
+var envRe = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// otlpEnv returns the OpenTelemetry exporter variable for metrics, falling
+// back to the one for all signals, e.g. OTEL_EXPORTER_OTLP_METRICS_ENDPOINT
+// and OTEL_EXPORTER_OTLP_ENDPOINT.
+func otlpEnv(name string) string {
+	if v := os.Getenv("OTEL_EXPORTER_OTLP_METRICS_" + name); v != "" {
+		return v
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_" + name)
+}
+
+// maxConfigSize caps configuration read from stdin or a URL, which unlike a
+// file could be of any size.
+const maxConfigSize = 1 << 20
+
+// configFetchTimeout bounds fetching a configuration from a URL.
+const configFetchTimeout = 10 * time.Second
+
+// isURL reports whether path is an http or https URL rather than a file.
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// resolveInclude resolves file, as referenced by the configuration at path,
+// relative to the directory or URL of that configuration.
+func resolveInclude(path, file string) (string, error) {
+	if isURL(file) || filepath.IsAbs(file) {
+		return file, nil
+	}
+	if isURL(path) {
+		base, err := url.Parse(path)
+		if err != nil {
+			return "", fmt.Errorf("invalid config URL %s: %v", path, err)
+		}
+		ref, err := url.Parse(file)
+		if err != nil {
+			return "", fmt.Errorf("invalid counters file %s: %v", file, err)
+		}
+		return base.ResolveReference(ref).String(), nil
+	}
+	// The directory of stdin ("-") is the working directory.
+	return filepath.Join(filepath.Dir(path), file), nil
+}
+
+// readSource reads the configuration at path: a file, stdin if path is "-",
+// or the body of an http or https URL.
+func readSource(path string) ([]byte, error) {
+	switch {
+	case path == "-":
+		return readLimited(os.Stdin, "stdin")
+	case isURL(path):
+		return fetchConfig(path)
+	default:
+		return os.ReadFile(path)
+	}
+}
+
+func readLimited(r io.Reader, name string) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxConfigSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %v", name, err)
+	}
+	if len(data) > maxConfigSize {
+		return nil, fmt.Errorf("%s is larger than %d bytes", name, maxConfigSize)
+	}
+	return data, nil
+}
+
+// fetchConfig downloads the configuration at rawURL. Anything but a 200
+// response with a text, YAML or JSON body is an error, so an error page is
+// not mistaken for an empty configuration.
+func fetchConfig(rawURL string) ([]byte, error) {
+	client := &http.Client{Timeout: configFetchTimeout}
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("fetch config: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch config %s: %s", rawURL, resp.Status)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || !configMediaType(mediaType) {
+			return nil, fmt.Errorf("fetch config %s: unexpected content type %q", rawURL, contentType)
+		}
+	}
+	return readLimited(resp.Body, rawURL)
+}
+
+func configMediaType(mediaType string) bool {
+	switch mediaType {
+	case "application/yaml", "application/x-yaml", "application/json", "application/octet-stream":
+		return true
+	case "text/html":
+		return false
+	default:
+		return strings.HasPrefix(mediaType, "text/")
+	}
+}
+
+// readConfigFile reads a configuration file and expands the environment
+// variables referenced in it. Unset variables without a default are an error.
+func readConfigFile(path string) ([]byte, error) {
+	data, err := readSource(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	data = envRe.ReplaceAllFunc(data, func(ref []byte) []byte {
+		m := envRe.FindSubmatch(ref)
+		if value, ok := os.LookupEnv(string(m[1])); ok {
+			return []byte(value)
+		}
+		if m[2] != nil {
+			return m[3]
+		}
+		missing = append(missing, string(m[1]))
+		return ref
+	})
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%s: environment variables not set: %s", path, strings.Join(missing, ", "))
+	}
+
+	return data, nil
+}
+
+// countersDirFiles returns the *.yaml files in dir, as referenced by the
+// configuration at path, in lexical order.
+func countersDirFiles(path, dir string) ([]string, error) {
+	dir, err := resolveInclude(path, dir)
+	if err != nil {
+		return nil, err
+	}
+	if isURL(dir) {
+		return nil, fmt.Errorf("counters_dir %s cannot be listed, use counters_files", dir)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("counters_dir: %w", err)
+	}
+	// Glob returns the matches sorted.
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, fmt.Errorf("counters_dir %s: %v", dir, err)
+	}
+	return files, nil
+}
+
+// labelSources records the file defining each label per table and
+// direction, to name both files when one repeats a label of another. The
+// top-level counters, which the counters files are merged into, are the
+// table "".
+type labelSources map[string]string
+
+// add records the labels of counters of table as defined in file. It returns
+// an error for the first label already defined in another file.
+func (s labelSources) add(table string, counters *types.Counters, file string) error {
+	for _, d := range []struct {
+		dir      string
+		counters []types.Counter
+	}{
+		{"input", counters.Input},
+		{"output", counters.Output},
+		{"forward", counters.Forward},
+	} {
+		for _, counter := range d.counters {
+			if counter.Label == "" {
+				continue
+			}
+			key := table + "/" + d.dir + "/" + counter.Label
+			if other, ok := s[key]; ok && other != file {
+				return fmt.Errorf("%s: %s label %q is already defined in %s", file, d.dir, counter.Label, other)
+			}
+			s[key] = file
+		}
+	}
+	return nil
+}
+
+// mergeCounters appends the counters defined in file to the ones of cfg.
+func mergeCounters(cfg *types.Config, file string, sources labelSources) error {
+	data, err := readConfigFile(file)
+	if err != nil {
+		return err
+	}
+
+	var counters types.Counters
+	if err := yaml.Unmarshal(data, &counters); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	if err := sources.add("", &counters, file); err != nil {
+		return err
+	}
+
+	cfg.Counters.Input = append(cfg.Counters.Input, counters.Input...)
+	cfg.Counters.Output = append(cfg.Counters.Output, counters.Output...)
+	cfg.Counters.Forward = append(cfg.Counters.Forward, counters.Forward...)
+	return nil
+}
+
+// resolveTemplates expands counters referencing a template into full
+// counters. Fields set on the counter override the ones of the template.
+func resolveTemplates(cfg *types.Config) error {
+	for name, tmpl := range cfg.Templates {
+		if tmpl.Template != "" {
+			return fmt.Errorf("template %q: templates cannot reference other templates", name)
+		}
+	}
+
+	lists := [][]types.Counter{cfg.Counters.Input, cfg.Counters.Output, cfg.Counters.Forward}
+	for _, t := range cfg.Tables {
+		lists = append(lists, t.Counters.Input, t.Counters.Output, t.Counters.Forward)
+	}
+	for _, counters := range lists {
+		for i, counter := range counters {
+			if counter.Template == "" {
+				continue
+			}
+			tmpl, ok := cfg.Templates[counter.Template]
+			if !ok {
+				return fmt.Errorf("counter %q: unknown template %q", counter.Label, counter.Template)
+			}
+			counters[i] = applyTemplate(tmpl, counter)
+		}
+	}
+
+	return nil
+}
+
+// applyTemplate returns tmpl with every non-zero field of counter copied
+// over it.
+func applyTemplate(tmpl, counter types.Counter) types.Counter {
+	merged := tmpl
+	src := reflect.ValueOf(counter)
+	dst := reflect.ValueOf(&merged).Elem()
+	for i := 0; i < src.NumField(); i++ {
+		if !src.Field(i).IsZero() {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+	merged.Template = ""
+	return merged
+}
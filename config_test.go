@@ -0,0 +1,668 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nickgarlis/flowmon/nft"
+	"github.com/nickgarlis/flowmon/types"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfigTemplates(t *testing.T) {
+	path := writeConfig(t, `
+templates:
+  web:
+    protocol: tcp
+    dst_port: 443
+counters:
+  input:
+    - label: "web_a"
+      template: web
+      src_addr: 10.0.0.1
+    - label: "web_alt"
+      template: web
+      dst_port: 8443
+`)
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+
+	want := []types.Counter{
+		{Label: "web_a", Protocol: types.ProtocolTCP, DstPort: 443, SrcAddr: netip.MustParseAddr("10.0.0.1")},
+		{Label: "web_alt", Protocol: types.ProtocolTCP, DstPort: 8443},
+	}
+	if len(cfg.Counters.Input) != len(want) {
+		t.Fatalf("expected %d counters, got %d", len(want), len(cfg.Counters.Input))
+	}
+	for i := range want {
+		got := cfg.Counters.Input[i]
+		if got.Label != want[i].Label || got.Protocol != want[i].Protocol || got.DstPort != want[i].DstPort || got.SrcAddr != want[i].SrcAddr || got.Template != "" {
+			t.Errorf("counter %d: expected %+v, got %+v", i, want[i], got)
+		}
+	}
+}
+
+func TestLoadConfigTables(t *testing.T) {
+	path := writeConfig(t, `
+templates:
+  web:
+    protocol: tcp
+    dst_port: 443
+tables:
+  - table_name: web
+    counters:
+      input:
+        - label: "https"
+          template: web
+  - table_name: vpn
+    family: ip6
+    counters:
+      input:
+        - label: "wireguard"
+          protocol: udp
+          dst_port: 51820
+`)
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+
+	// The top-level table has no counters and is left out.
+	tables := cfg.CounterTables()
+	if len(tables) != 2 {
+		t.Fatalf("expected 2 tables, got %d", len(tables))
+	}
+	web, vpn := tables[0], tables[1]
+	if web.TableName != "web" || web.Family != types.TableFamilyIPv4 || web.Counters.Input[0].DstPort != 443 {
+		t.Errorf("unexpected web table %+v", web)
+	}
+	if vpn.TableName != "vpn" || vpn.Family != types.TableFamilyIPv6 || vpn.Counters.Input[0].Label != "wireguard" {
+		t.Errorf("unexpected vpn table %+v", vpn)
+	}
+}
+
+func TestLoadConfigDuplicateTable(t *testing.T) {
+	path := writeConfig(t, `
+counters:
+  input:
+    - label: "all"
+tables:
+  - table_name: flowmon
+`)
+
+	_, err := loadConfig(path)
+	if err == nil || !strings.Contains(err.Error(), "table ip flowmon is configured more than once") {
+		t.Errorf("expected a duplicate table error, got %v", err)
+	}
+}
+
+func TestLoadConfigUnknownTemplate(t *testing.T) {
+	path := writeConfig(t, `
+counters:
+  input:
+    - label: "web"
+      template: missing
+`)
+
+	if _, err := loadConfig(path); err == nil {
+		t.Errorf("expected an error for an unknown template")
+	}
+}
+
+func TestLoadConfigPortWithoutProtocol(t *testing.T) {
+	path := writeConfig(t, `
+counters:
+  input:
+    - label: "https"
+      dst_port: 443
+`)
+
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "ports require protocol tcp, udp, udplite or sctp") {
+		t.Errorf("expected a protocol error, got %v", err)
+	}
+}
+
+func TestLoadConfigSCTP(t *testing.T) {
+	path := writeConfig(t, `
+counters:
+  input:
+    - label: "diameter"
+      protocol: sctp
+      dst_port: 3868
+`)
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if got := cfg.Counters.Input[0].Protocol; got != types.ProtocolSCTP {
+		t.Errorf("expected protocol sctp, got %s", got)
+	}
+}
+
+func TestLoadConfigDuplicateLabel(t *testing.T) {
+	path := writeConfig(t, `
+counters:
+  input:
+    - label: "web"
+      protocol: tcp
+      dst_port: 80
+    - label: "web"
+      protocol: tcp
+      dst_port: 443
+`)
+
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), `input label "web"`) {
+		t.Errorf("expected a duplicate label error, got %v", err)
+	}
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	t.Setenv("FLOWMON_ENDPOINT", "collector:4317")
+	path := writeConfig(t, `
+exporter:
+  otlp:
+    endpoint: "${FLOWMON_ENDPOINT}"
+    headers:
+      X-Tenant: "${FLOWMON_TENANT:-default}"
+`)
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if got := cfg.Exporter.OTLP[0].Endpoint; got != "collector:4317" {
+		t.Errorf("expected endpoint collector:4317, got %q", got)
+	}
+	if got := cfg.Exporter.OTLP[0].Headers["X-Tenant"]; got != "default" {
+		t.Errorf("expected the default tenant, got %q", got)
+	}
+}
+
+func TestLoadConfigEnvMissing(t *testing.T) {
+	path := writeConfig(t, `
+exporter:
+  otlp:
+    endpoint: "${FLOWMON_UNSET_ENDPOINT}"
+`)
+
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "FLOWMON_UNSET_ENDPOINT") {
+		t.Errorf("expected an error naming the variable, got %v", err)
+	}
+}
+
+func TestLoadConfigCountersFiles(t *testing.T) {
+	path := writeConfig(t, `
+counters_files: ["web.yaml"]
+counters:
+  input:
+    - label: "ssh"
+      protocol: tcp
+      dst_port: 22
+`)
+	web := filepath.Join(filepath.Dir(path), "web.yaml")
+	if err := os.WriteFile(web, []byte(`
+input:
+  - label: "https"
+    protocol: tcp
+    dst_port: 443
+output:
+  - label: "dns"
+    protocol: udp
+    dst_port: 53
+`), 0o600); err != nil {
+		t.Fatalf("failed to write counters: %v", err)
+	}
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if len(cfg.Counters.Input) != 2 || cfg.Counters.Input[1].Label != "https" {
+		t.Errorf("expected ssh and https input counters, got %+v", cfg.Counters.Input)
+	}
+	if len(cfg.Counters.Output) != 1 || cfg.Counters.Output[0].Label != "dns" {
+		t.Errorf("expected a dns output counter, got %+v", cfg.Counters.Output)
+	}
+}
+
+func TestLoadConfigCountersDir(t *testing.T) {
+	path := writeConfig(t, `
+counters_dir: "counters.d"
+counters:
+  input:
+    - label: "ssh"
+      protocol: tcp
+      dst_port: 22
+`)
+	dir := filepath.Join(filepath.Dir(path), "counters.d")
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatalf("failed to write counters: %v", err)
+		}
+	}
+	write("20-web.yaml", "input:\n  - label: \"https\"\n    protocol: tcp\n    dst_port: 443\n")
+	write("10-dns.yaml", "input:\n  - label: \"dns\"\n    protocol: udp\n    dst_port: 53\n")
+	write("README", "not counters")
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	var labels []string
+	for _, counter := range cfg.Counters.Input {
+		labels = append(labels, counter.Label)
+	}
+	if got := strings.Join(labels, ","); got != "ssh,dns,https" {
+		t.Errorf("expected ssh,dns,https, got %s", got)
+	}
+
+	write("30-ssh.yaml", "input:\n  - label: \"ssh\"\n    protocol: tcp\n    dst_port: 2222\n")
+	_, err = loadConfig(path)
+	if err == nil || !strings.Contains(err.Error(), `input label "ssh" is already defined in `+path) {
+		t.Errorf("expected a duplicate label error naming both files, got %v", err)
+	}
+}
+
+func TestLoadConfigTableLabels(t *testing.T) {
+	path := writeConfig(t, `
+counters_files:
+  - "web.yaml"
+tables:
+  - table_name: "other"
+    counters:
+      input:
+        - label: "https"
+          protocol: tcp
+          dst_port: 8443
+`)
+	// The counters of another table are counted apart.
+	web := "input:\n  - label: \"https\"\n    protocol: tcp\n    dst_port: 443\n"
+	if err := os.WriteFile(filepath.Join(filepath.Dir(path), "web.yaml"), []byte(web), 0o600); err != nil {
+		t.Fatalf("failed to write counters: %v", err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if len(cfg.Counters.Input) != 1 || len(cfg.Tables[0].Counters.Input) != 1 {
+		t.Errorf("expected one https counter in each table, got %+v and %+v", cfg.Counters.Input, cfg.Tables[0].Counters.Input)
+	}
+}
+
+func TestLoadConfigHosts(t *testing.T) {
+	hosts := map[string][]netip.Addr{
+		"api.example.com": {
+			netip.MustParseAddr("192.0.2.20"),
+			netip.MustParseAddr("2001:db8::20"),
+			netip.MustParseAddr("::ffff:192.0.2.10"),
+		},
+		"db.example.com": {netip.MustParseAddr("198.51.100.5")},
+		"v6.example.com": {netip.MustParseAddr("2001:db8::6")},
+	}
+	lookup := lookupHost
+	defer func() { lookupHost = lookup }()
+	lookupHost = func(_ context.Context, host string) ([]netip.Addr, error) {
+		if addrs, ok := hosts[host]; ok {
+			return addrs, nil
+		}
+		return nil, fmt.Errorf("no such host")
+	}
+
+	path := writeConfig(t, `
+counters:
+  output:
+    - label: "api"
+      dst_host: "api.example.com"
+      protocol: tcp
+      dst_port: 443
+    - label: "db"
+      src_addr: "10.0.0.1"
+      dst_host: "db.example.com"
+`)
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	var got []string
+	for _, c := range cfg.Counters.Output {
+		got = append(got, fmt.Sprintf("%s=%s>%s", c.Label, c.SrcAddr, c.DstAddr))
+		if c.DstHost != "" {
+			t.Errorf("counter %q: expected dst_host to be cleared", c.Label)
+		}
+	}
+	want := "api_192.0.2.10=invalid IP>192.0.2.10 api_192.0.2.20=invalid IP>192.0.2.20 db=10.0.0.1>198.51.100.5"
+	if strings.Join(got, " ") != want {
+		t.Errorf("expected %s, got %s", want, strings.Join(got, " "))
+	}
+
+	// An inet table takes the addresses of both families.
+	cfg, err = loadConfig(writeConfig(t, `
+tables:
+  - family: inet
+    table_name: "dual"
+    counters:
+      output:
+        - label: "api"
+          dst_host: "api.example.com"
+`))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	got = nil
+	for _, c := range cfg.Tables[0].Counters.Output {
+		got = append(got, fmt.Sprintf("%s>%s", c.Label, c.DstAddr))
+	}
+	want = "api_192.0.2.10>192.0.2.10 api_192.0.2.20>192.0.2.20 api_2001:db8::20>2001:db8::20"
+	if strings.Join(got, " ") != want {
+		t.Errorf("expected %s, got %s", want, strings.Join(got, " "))
+	}
+
+	for _, tt := range []struct {
+		counter string
+		wantErr string
+	}{
+		{`{label: "x", dst_host: "missing.example.com"}`, `resolve dst_host "missing.example.com"`},
+		{`{label: "x", dst_host: "v6.example.com"}`, `dst_host "v6.example.com" has no ip address`},
+		{`{label: "x", src_host: "db.example.com", src_net: "10.0.0.0/8"}`, "src_host cannot be combined"},
+		{`{label: "x", dst_host: "api.example.com", negate: [dst_addr]}`, "resolves to 2 addresses and cannot be negated"},
+	} {
+		_, err := loadConfig(writeConfig(t, "counters:\n  input:\n    - "+tt.counter+"\n"))
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: expected error %q, got %v", tt.counter, tt.wantErr, err)
+		}
+	}
+}
+
+func TestInetHostsReconcile(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	lookup := lookupHost
+	defer func() { lookupHost = lookup }()
+	lookupHost = func(context.Context, string) ([]netip.Addr, error) {
+		return []netip.Addr{netip.MustParseAddr("192.0.2.20"), netip.MustParseAddr("2001:db8::20")}, nil
+	}
+
+	cfg, err := loadConfig(writeConfig(t, `
+nftables:
+  family: inet
+  table_name: "test_table_inet_hosts"
+counters:
+  output:
+    - label: "api"
+      dst_host: "api.example.com"
+      protocol: tcp
+      dst_port: 443
+`))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+
+	conn, err := nft.New(nft.ConfigFrom(&cfg.NFTables))
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	defer conn.Cleanup()
+	if err := conn.Setup(&cfg.Counters); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	// A reload finds the rules of both families unchanged.
+	if err := conn.Reconcile(&cfg.Counters); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+
+	counters, err := conn.ListCounters()
+	if err != nil {
+		t.Fatalf("Failed to list counters: %v", err)
+	}
+	var got []string
+	for _, c := range counters.Output {
+		got = append(got, fmt.Sprintf("%s>%s", c.Label, c.DstAddr))
+	}
+	want := "api_192.0.2.20>192.0.2.20 api_2001:db8::20>2001:db8::20"
+	if strings.Join(got, " ") != want {
+		t.Errorf("expected %s, got %s", want, strings.Join(got, " "))
+	}
+}
+
+func TestLoadConfigInterval(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    time.Duration
+		wantErr string
+	}{
+		{"default", "counters: {}", 10 * time.Second, ""},
+		{"duration", "exporter:\n  interval: 1m30s", 90 * time.Second, ""},
+		{"bare number", "exporter:\n  interval: 30", 0, `duration "30" needs a unit`},
+		{"zero", "exporter:\n  interval: 0s", 0, "exporter.interval must be positive"},
+		{"negative", "exporter:\n  interval: -5s", 0, "exporter.interval must be positive"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadConfig(writeConfig(t, tt.content))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+			if got := time.Duration(cfg.Exporter.Interval); got != tt.want {
+				t.Errorf("expected interval %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestLoadConfigAddrRange(t *testing.T) {
+	path := writeConfig(t, `
+counters:
+  input:
+    - label: "acl"
+      src_addr_range: "10.0.5.10-10.0.5.50"
+`)
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	want := types.AddrRange{Min: netip.MustParseAddr("10.0.5.10"), Max: netip.MustParseAddr("10.0.5.50")}
+	if got := cfg.Counters.Input[0].SrcAddrRange; got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestLoadConfigUnknownProtocol(t *testing.T) {
+	path := writeConfig(t, `
+counters:
+  input:
+    - label: "https"
+      protocol: tpc
+      dst_port: 443
+`)
+
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), `invalid protocol "tpc"`) {
+		t.Errorf("expected an invalid protocol error, got %v", err)
+	}
+}
+
+func TestLoadConfigUnknownFamily(t *testing.T) {
+	path := writeConfig(t, `
+nftables:
+  family: bridge
+`)
+
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), `invalid family "bridge"`) {
+		t.Errorf("expected an invalid family error, got %v", err)
+	}
+}
+
+func TestLoadConfigLog(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, "log:\n  level: debug\n  format: json"))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.Log.Level != types.LogLevelDebug || cfg.Log.Format != types.LogFormatJSON {
+		t.Errorf("expected debug json logging, got %+v", cfg.Log)
+	}
+
+	_, err = loadConfig(writeConfig(t, "log:\n  level: verbose"))
+	if err == nil || !strings.Contains(err.Error(), `invalid log level "verbose"`) {
+		t.Errorf("expected an invalid log level error, got %v", err)
+	}
+}
+
+func TestLoadConfigOTLPList(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, `
+exporter:
+  otlp:
+    - endpoint: "primary:4317"
+    - protocol: "http"
+`))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+
+	want := []struct {
+		endpoint string
+		protocol types.OTLPProtocol
+	}{
+		{"primary:4317", types.OTLPProtocolGRPC},
+		{"localhost:4318", types.OTLPProtocolHTTP},
+	}
+	if len(cfg.Exporter.OTLP) != len(want) {
+		t.Fatalf("expected %d endpoints, got %+v", len(want), cfg.Exporter.OTLP)
+	}
+	for i, w := range want {
+		if got := cfg.Exporter.OTLP[i]; got.Endpoint != w.endpoint || got.Protocol != w.protocol {
+			t.Errorf("endpoint %d: expected %s over %s, got %s over %s", i, w.endpoint, w.protocol, got.Endpoint, got.Protocol)
+		}
+	}
+
+	_, err = loadConfig(writeConfig(t, "exporter:\n  otlp:\n    - protocol: \"smtp\""))
+	if err == nil || !strings.Contains(err.Error(), `invalid OTLP protocol "smtp"`) {
+		t.Errorf("expected an invalid protocol error, got %v", err)
+	}
+}
+
+func TestLoadConfigURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/config.yaml":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte("counters_files: [\"web.yaml\"]\n"))
+		case "/web.yaml":
+			w.Header().Set("Content-Type", "application/yaml")
+			w.Write([]byte("input:\n  - label: \"https\"\n    protocol: tcp\n    dst_port: 443\n"))
+		case "/index.html":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html></html>"))
+		case "/large.yaml":
+			w.Write([]byte(strings.Repeat("#", maxConfigSize+1)))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	cfg, err := loadConfig(srv.URL + "/config.yaml")
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if len(cfg.Counters.Input) != 1 || cfg.Counters.Input[0].Label != "https" {
+		t.Errorf("expected the https counter from web.yaml, got %+v", cfg.Counters.Input)
+	}
+
+	for _, path := range []string{"/index.html", "/large.yaml", "/missing.yaml"} {
+		if _, err := loadConfig(srv.URL + path); err == nil {
+			t.Errorf("expected an error fetching %s", path)
+		}
+	}
+}
+
+func TestLoadConfigStdin(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %v", err)
+	}
+	stdin := os.Stdin
+	os.Stdin = r
+	t.Cleanup(func() {
+		os.Stdin = stdin
+		r.Close()
+	})
+
+	go func() {
+		w.Write([]byte("counters:\n  input:\n    - label: \"ssh\"\n      protocol: tcp\n      dst_port: 22\n"))
+		w.Close()
+	}()
+
+	cfg, err := loadConfig("-")
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if len(cfg.Counters.Input) != 1 || cfg.Counters.Input[0].Label != "ssh" {
+		t.Errorf("expected an ssh counter, got %+v", cfg.Counters.Input)
+	}
+}
+
+func TestLoadConfigOTLPEnv(t *testing.T) {
+	path := writeConfig(t, `
+exporter:
+  otlp:
+    - headers:
+        X-Tenant: "a"
+    - endpoint: "collector:4317"
+`)
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if got := cfg.Exporter.OTLP[0].Endpoint; got != "localhost:4317" {
+		t.Errorf("expected the default endpoint without the variables, got %q", got)
+	}
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "https://collector.example.com:4318")
+	t.Setenv("OTEL_EXPORTER_OTLP_METRICS_PROTOCOL", "http/protobuf")
+	cfg, err = loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if got := cfg.Exporter.OTLP[0]; got.Endpoint != "" || got.Protocol != types.OTLPProtocolHTTP {
+		t.Errorf("expected the endpoint and protocol to be left to the variables, got %q over %s", got.Endpoint, got.Protocol)
+	}
+	if got := cfg.Exporter.OTLP[1].Endpoint; got != "collector:4317" {
+		t.Errorf("expected the configured endpoint to win, got %q", got)
+	}
+}
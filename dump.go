@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/nickgarlis/flowmon/nft"
+)
+
+// dump prints the rules installed in the tables as an nft script, which can be
+// loaded with nft -f or diffed against the output of start --dry-run.
+func dump(configPath string) {
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		os.Exit(1)
+	}
+
+	for _, t := range cfg.CounterTables() {
+		nftClient, err := nft.New(nft.ConfigFrom(&t.NFTables))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to connect to nftables: %v\n", err)
+			os.Exit(1)
+		}
+
+		script, err := nftClient.Dump()
+		if errors.Is(err, nft.ErrTableNotFound) {
+			fmt.Fprintf(os.Stderr, "Table %s not found, is flowmon running?\n", nftClient.TableName())
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to dump rules: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Print(script)
+	}
+}
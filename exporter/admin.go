@@ -0,0 +1,74 @@
+package exporter
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// scrapeStatus holds the result of the last read of the counters.
+type scrapeStatus struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (s *scrapeStatus) set(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+func (s *scrapeStatus) get() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// listenAdmin serves /healthz, which succeeds as long as the process is up,
+// and /readyz, which fails with 503 while ready returns an error. The
+// returned server is already serving and its Addr holds the address it
+// listens on.
+func listenAdmin(listen string, ready func() error) (*http.Server, error) {
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", listen, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	server := &http.Server{Addr: ln.Addr().String(), Handler: mux}
+
+	go func() {
+		if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Admin server failed", "err", err)
+		}
+	}()
+
+	return server, nil
+}
+
+// Ready reports whether the tables are in place and the counters could be
+// read the last time they were collected. It is what /readyz serves.
+func (e *Exporter) Ready() error {
+	for _, t := range e.tables {
+		if err := t.conn.Check(); err != nil {
+			return e.tableError(t, err)
+		}
+	}
+	if err := e.status.get(); err != nil {
+		return fmt.Errorf("last read of the counters failed: %w", err)
+	}
+	return nil
+}
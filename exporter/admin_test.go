@@ -0,0 +1,45 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestListenAdmin(t *testing.T) {
+	var status scrapeStatus
+	server, err := listenAdmin("127.0.0.1:0", status.get)
+	if err != nil {
+		t.Fatalf("listenAdmin: %v", err)
+	}
+	defer server.Shutdown(context.Background())
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get("http://" + server.Addr + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("read body: %v", err)
+		}
+		return resp.StatusCode, string(body)
+	}
+
+	if code, _ := get("/readyz"); code != http.StatusOK {
+		t.Errorf("expected /readyz to be ready, got %d", code)
+	}
+
+	status.set(errors.New("get table flowmon: table not found"))
+	if code, body := get("/readyz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "table not found") {
+		t.Errorf("expected /readyz to fail with the error, got %d %q", code, body)
+	}
+	if code, _ := get("/healthz"); code != http.StatusOK {
+		t.Errorf("expected /healthz to stay healthy, got %d", code)
+	}
+}
@@ -0,0 +1,310 @@
+package exporter
+
+import (
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/nickgarlis/flowmon/types"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// buildAttributes returns the attributes of counter, read from table, followed
+// by the defaults it does not set itself. The table and chain tell instances
+// using different tables apart.
+func buildAttributes(table string, counter types.Counter, defaults map[string]string) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.String("direction", counter.Dir),
+	}
+
+	if counter.Label != "" {
+		attrs = append(attrs, attribute.String("label", counter.Label))
+	}
+
+	attrs = append(attrs,
+		attribute.String("table", table),
+		attribute.String("chain", counter.Chain),
+	)
+
+	if counter.SrcAddr.IsValid() {
+		attrs = append(attrs, attribute.String("src_addr", counter.SrcAddr.String()))
+	}
+
+	if counter.DstAddr.IsValid() {
+		attrs = append(attrs, attribute.String("dst_addr", counter.DstAddr.String()))
+	}
+
+	if counter.SrcNet.IsValid() {
+		attrs = append(attrs, attribute.String("src_net", counter.SrcNet.String()))
+	}
+
+	if counter.DstNet.IsValid() {
+		attrs = append(attrs, attribute.String("dst_net", counter.DstNet.String()))
+	}
+
+	if counter.SrcAddrRange.IsValid() {
+		attrs = append(attrs,
+			attribute.String("src_addr_min", counter.SrcAddrRange.Min.String()),
+			attribute.String("src_addr_max", counter.SrcAddrRange.Max.String()),
+		)
+	}
+
+	if counter.DstAddrRange.IsValid() {
+		attrs = append(attrs,
+			attribute.String("dst_addr_min", counter.DstAddrRange.Min.String()),
+			attribute.String("dst_addr_max", counter.DstAddrRange.Max.String()),
+		)
+	}
+
+	if counter.SrcSet != "" {
+		attrs = append(attrs, attribute.String("src_set", counter.SrcSet))
+	}
+
+	if counter.DstSet != "" {
+		attrs = append(attrs, attribute.String("dst_set", counter.DstSet))
+	}
+
+	if counter.Protocol > 0 {
+		attrs = append(attrs, attribute.String("protocol", counter.Protocol.String()))
+	}
+
+	if counter.SrcPort > 0 && counter.Protocol.HasPorts() {
+		attrs = append(attrs, attribute.Int("src_port", int(counter.SrcPort)))
+	}
+
+	if counter.DstPort > 0 && counter.Protocol.HasPorts() {
+		attrs = append(attrs, attribute.Int("dst_port", int(counter.DstPort)))
+	}
+
+	// Input chains match on iif and output chains on oif, so a single
+	// attribute names the interface the counter is bound to. Forwarded
+	// traffic can match both.
+	switch {
+	case counter.Iif != "" && counter.Oif != "":
+		attrs = append(attrs,
+			attribute.String("interface", counter.Iif),
+			attribute.String("out_interface", counter.Oif),
+		)
+	case counter.Iif != "":
+		attrs = append(attrs, attribute.String("interface", counter.Iif))
+	case counter.Oif != "":
+		attrs = append(attrs, attribute.String("interface", counter.Oif))
+	}
+
+	if counter.CtHelper != "" {
+		attrs = append(attrs, attribute.String("ct_helper", counter.CtHelper))
+	}
+
+	if counter.CtDir != "" {
+		attrs = append(attrs, attribute.String("ct_dir", string(counter.CtDir)))
+	}
+
+	if counter.Mark != nil {
+		attrs = append(attrs, attribute.Int64("mark", int64(*counter.Mark)))
+	}
+
+	if counter.CtMark != nil {
+		attrs = append(attrs, attribute.Int64("ct_mark", int64(*counter.CtMark)))
+	}
+
+	if counter.SrcPortRange.IsValid() && counter.Protocol.HasPorts() {
+		attrs = append(attrs,
+			attribute.Int("src_port_min", int(counter.SrcPortRange.Min)),
+			attribute.Int("src_port_max", int(counter.SrcPortRange.Max)),
+		)
+	}
+
+	if counter.DstPortRange.IsValid() && counter.Protocol.HasPorts() {
+		attrs = append(attrs,
+			attribute.Int("dst_port_min", int(counter.DstPortRange.Min)),
+			attribute.Int("dst_port_max", int(counter.DstPortRange.Max)),
+		)
+	}
+
+	if counter.SrcMac.IsValid() {
+		attrs = append(attrs, attribute.String("src_mac", counter.SrcMac.String()))
+	}
+
+	if counter.DstMac.IsValid() {
+		attrs = append(attrs, attribute.String("dst_mac", counter.DstMac.String()))
+	}
+
+	if counter.TcpWindow != nil {
+		attrs = append(attrs, attribute.Int("tcp_window", int(*counter.TcpWindow)))
+	}
+
+	if counter.IcmpType != nil {
+		attrs = append(attrs, attribute.Int("icmp_type", int(*counter.IcmpType)))
+	}
+
+	if counter.IcmpCode != nil {
+		attrs = append(attrs, attribute.Int("icmp_code", int(*counter.IcmpCode)))
+	}
+
+	if counter.Dscp != nil {
+		attrs = append(attrs, attribute.Int("dscp", int(*counter.Dscp)))
+	}
+
+	if counter.Fragmented {
+		attrs = append(attrs, attribute.Bool("fragmented", true))
+	}
+
+	if counter.MinLen != 0 {
+		attrs = append(attrs, attribute.Int("min_len", int(counter.MinLen)))
+	}
+
+	if counter.MaxLen != 0 {
+		attrs = append(attrs, attribute.Int("max_len", int(counter.MaxLen)))
+	}
+
+	if len(counter.Negate) > 0 {
+		attrs = append(attrs, attribute.StringSlice("negate", counter.Negate))
+	}
+
+	if len(counter.Sets) > 0 {
+		attrs = append(attrs, attribute.StringSlice("sets", counter.Sets))
+	}
+
+	if counter.Verdict != "" {
+		attrs = append(attrs, attribute.String("verdict", string(counter.Verdict)))
+	}
+
+	if counter.Limit != nil {
+		attrs = append(attrs, attribute.String("limit", counter.Limit.String()))
+	}
+
+	if counter.Quota != 0 {
+		attrs = append(attrs, attribute.Int64("quota", int64(counter.Quota)))
+	}
+
+	if len(counter.CtState) > 0 {
+		states := make([]string, len(counter.CtState))
+		for i, state := range counter.CtState {
+			states[i] = state.String()
+		}
+		attrs = append(attrs, attribute.StringSlice("ct_state", states))
+	}
+
+	if len(counter.TcpFlags) > 0 {
+		flags := make([]string, len(counter.TcpFlags))
+		for i, flag := range counter.TcpFlags {
+			flags[i] = flag.String()
+		}
+		attrs = append(attrs, attribute.StringSlice("tcp_flags", flags))
+		if counter.TcpFlagsOp != "" && counter.TcpFlagsOp != types.TcpFlagsOpExact {
+			attrs = append(attrs, attribute.String("tcp_flags_op", string(counter.TcpFlagsOp)))
+		}
+	}
+
+	return withDefaults(attrs, defaults)
+}
+
+// withDefaults appends the defaults whose keys are not in attrs, sorted by
+// key so the attributes come out the same on every read.
+func withDefaults(attrs []attribute.KeyValue, defaults map[string]string) []attribute.KeyValue {
+	keys := make([]string, 0, len(defaults))
+	for key := range defaults {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		if slices.ContainsFunc(attrs, func(kv attribute.KeyValue) bool { return string(kv.Key) == key }) {
+			continue
+		}
+		attrs = append(attrs, attribute.String(key, defaults[key]))
+	}
+	return attrs
+}
+
+// transformKeys rewrites the snake_case keys produced by buildAttributes into
+// the configured naming style.
+func transformKeys(attrs []attribute.KeyValue, style types.AttributeKeyStyle) []attribute.KeyValue {
+	if style == "" || style == types.AttributeKeyStyleSnake {
+		return attrs
+	}
+	for i, kv := range attrs {
+		attrs[i] = attribute.KeyValue{Key: attribute.Key(transformKey(string(kv.Key), style)), Value: kv.Value}
+	}
+	return attrs
+}
+
+func transformKey(key string, style types.AttributeKeyStyle) string {
+	switch style {
+	case types.AttributeKeyStyleDot:
+		return strings.ReplaceAll(key, "_", ".")
+	case types.AttributeKeyStyleCamel:
+		parts := strings.Split(key, "_")
+		for i := 1; i < len(parts); i++ {
+			if parts[i] != "" {
+				parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+			}
+		}
+		return strings.Join(parts, "")
+	default:
+		return key
+	}
+}
+
+// truncationMarker is appended to keys and values cut by limitAttributes.
+const truncationMarker = "..."
+
+// limitAttributes enforces the configured attribute limits, truncating long
+// keys and values and dropping attributes past the maximum count. It reports
+// whether anything was truncated.
+func limitAttributes(attrs []attribute.KeyValue, limits types.AttributeLimits) ([]attribute.KeyValue, bool) {
+	truncated := false
+
+	if limits.MaxCount > 0 && len(attrs) > limits.MaxCount {
+		attrs = attrs[:limits.MaxCount]
+		truncated = true
+	}
+
+	for i, kv := range attrs {
+		if limits.MaxKeyLength > 0 && len(kv.Key) > limits.MaxKeyLength {
+			kv.Key = attribute.Key(truncate(string(kv.Key), limits.MaxKeyLength))
+			truncated = true
+		}
+		if limits.MaxValueLength > 0 {
+			switch kv.Value.Type() {
+			case attribute.STRING:
+				if v := kv.Value.AsString(); len(v) > limits.MaxValueLength {
+					kv.Value = attribute.StringValue(truncate(v, limits.MaxValueLength))
+					truncated = true
+				}
+			case attribute.STRINGSLICE:
+				values := kv.Value.AsStringSlice()
+				changed := false
+				for j, v := range values {
+					if len(v) > limits.MaxValueLength {
+						values[j] = truncate(v, limits.MaxValueLength)
+						changed = true
+					}
+				}
+				if changed {
+					kv.Value = attribute.StringSliceValue(values)
+					truncated = true
+				}
+			}
+		}
+		attrs[i] = kv
+	}
+
+	return attrs, truncated
+}
+
+// truncate shortens s to at most limit bytes, including the truncation
+// marker, without splitting a UTF-8 sequence.
+func truncate(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	if limit <= len(truncationMarker) {
+		return truncationMarker[:limit]
+	}
+	cut := limit - len(truncationMarker)
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + truncationMarker
+}
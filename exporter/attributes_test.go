@@ -0,0 +1,104 @@
+package exporter
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/nickgarlis/flowmon/types"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func TestTransformKey(t *testing.T) {
+	tests := []struct {
+		key   string
+		style types.AttributeKeyStyle
+		want  string
+	}{
+		{"src_addr", types.AttributeKeyStyleSnake, "src_addr"},
+		{"src_addr", types.AttributeKeyStyleDot, "src.addr"},
+		{"src_addr", types.AttributeKeyStyleCamel, "srcAddr"},
+		{"tcp_flags", types.AttributeKeyStyleCamel, "tcpFlags"},
+		{"direction", types.AttributeKeyStyleCamel, "direction"},
+		{"direction", types.AttributeKeyStyleDot, "direction"},
+	}
+
+	for _, tt := range tests {
+		if got := transformKey(tt.key, tt.style); got != tt.want {
+			t.Errorf("transformKey(%q, %q) = %q, want %q", tt.key, tt.style, got, tt.want)
+		}
+	}
+}
+
+func TestBuildAttributes(t *testing.T) {
+	got := buildAttributes("flowmon_a", types.Counter{Label: "dns", Dir: "input", Chain: "input", Protocol: types.ProtocolUDP, DstPort: 53}, nil)
+	want := []attribute.KeyValue{
+		attribute.String("direction", "input"),
+		attribute.String("label", "dns"),
+		attribute.String("table", "flowmon_a"),
+		attribute.String("chain", "input"),
+		attribute.String("protocol", "udp"),
+		attribute.Int("dst_port", 53),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("buildAttributes() = %v, want %v", got, want)
+	}
+}
+
+func TestBuildAttributesChain(t *testing.T) {
+	got := buildAttributes("flowmon", types.Counter{Label: "dns", Dir: "input", Chain: "count_in"}, nil)
+	want := []attribute.KeyValue{
+		attribute.String("direction", "input"),
+		attribute.String("label", "dns"),
+		attribute.String("table", "flowmon"),
+		attribute.String("chain", "count_in"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("buildAttributes() = %v, want %v", got, want)
+	}
+}
+
+func TestBuildAttributesDefaults(t *testing.T) {
+	defaults := map[string]string{"team": "net", "service": "edge", "label": "default"}
+	got := buildAttributes("flowmon", types.Counter{Label: "dns", Dir: "input", Chain: "input"}, defaults)
+	want := []attribute.KeyValue{
+		attribute.String("direction", "input"),
+		attribute.String("label", "dns"),
+		attribute.String("table", "flowmon"),
+		attribute.String("chain", "input"),
+		attribute.String("service", "edge"),
+		attribute.String("team", "net"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("buildAttributes() = %v, want %v", got, want)
+	}
+}
+
+func TestLimitAttributes(t *testing.T) {
+	attrs := []attribute.KeyValue{
+		attribute.String("direction", "input"),
+		attribute.String("label", "a_very_long_label"),
+		attribute.StringSlice("tcp_flags", []string{"syn", "ack"}),
+	}
+
+	got, truncated := limitAttributes(attrs, types.AttributeLimits{MaxValueLength: 8, MaxCount: 2})
+	if !truncated {
+		t.Errorf("expected attributes to be truncated")
+	}
+	want := []attribute.KeyValue{
+		attribute.String("direction", "input"),
+		attribute.String("label", "a_ver..."),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("limitAttributes() = %v, want %v", got, want)
+	}
+
+	if _, truncated := limitAttributes(want, types.AttributeLimits{MaxKeyLength: 16, MaxValueLength: 16}); truncated {
+		t.Errorf("expected attributes within limits to be left untouched")
+	}
+}
+
+func TestTruncateUTF8(t *testing.T) {
+	if got := truncate("ααααα", 6); got != "α..." {
+		t.Errorf("truncate() = %q, want %q", got, "α...")
+	}
+}
@@ -0,0 +1,60 @@
+package exporter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nickgarlis/flowmon/types"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// collection is one read of the counters together with everything derived
+// from it, observed by every reader of the same collection cycle.
+type collection struct {
+	at       time.Time
+	err      error
+	failures int64 // failed reads so far, this one included
+	read     []tableCounters
+	skipped  map[string]uint64
+	counters []collectedCounter
+}
+
+// collectedCounter is a counter with its attributes and the values derived
+// from the read.
+type collectedCounter struct {
+	set     attribute.Set
+	counter types.Counter
+	total   flowTotal // since startup
+	delta   flowTotal // since the previous read
+	rate    flowRate
+	hasRate bool
+}
+
+// collector shares a read of the counters between the readers of the meter
+// provider. The SDK runs the callback once per reader, and a read resets the
+// counters, so each reader reading on its own would only get part of the
+// traffic. A read is handed to up to readers callbacks made within window of
+// it, which covers the readers collecting on the same tick; after that the
+// counters are read again.
+type collector struct {
+	mu      sync.Mutex
+	readers int
+	window  time.Duration
+	last    *collection
+	served  int
+}
+
+// get returns the collection of the current cycle, calling read for a new
+// one when needed.
+func (c *collector) get(now time.Time, read func() *collection) *collection {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.last != nil && c.served < c.readers && now.Sub(c.last.at) < c.window {
+		c.served++
+		return c.last
+	}
+	c.last = read()
+	c.served = 1
+	return c.last
+}
@@ -0,0 +1,33 @@
+package exporter_test
+
+import (
+	"context"
+	"log"
+
+	"github.com/nickgarlis/flowmon/exporter"
+	"github.com/nickgarlis/flowmon/types"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+// The flow metrics can be added to the meter provider of another daemon,
+// which then decides where they are exported.
+func ExampleWithMeterProvider() {
+	ctx := context.Background()
+	provider := sdkmetric.NewMeterProvider()
+	defer provider.Shutdown(ctx)
+
+	cfg := &types.Config{
+		NFTables: types.NFTables{TableName: "myapp"},
+		Counters: types.Counters{
+			Input: []types.Counter{{Label: "https", Protocol: types.ProtocolTCP, DstPort: 443}},
+		},
+	}
+	e, err := exporter.New(cfg, exporter.WithMeterProvider(provider))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := e.Start(ctx); err != nil {
+		log.Fatal(err)
+	}
+	defer e.Shutdown(ctx)
+}
@@ -1,12 +1,20 @@
+// Package exporter exports the nftables counters of flowmon as OpenTelemetry
+// metrics. It can be embedded in another daemon through New and its options.
 package exporter
 
 import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/nickgarlis/flowmon/nft"
@@ -18,6 +26,7 @@ import (
 	"go.opentelemetry.io/otel/exporters/stdout/stdoutmetric"
 	"go.opentelemetry.io/otel/metric"
 	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
 	"go.opentelemetry.io/otel/sdk/resource"
 	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
 	"google.golang.org/grpc/credentials"
@@ -25,102 +34,599 @@ import (
 
 type Exporter struct {
 	cfg           *types.Config
-	nftClient     *nft.Conn
+	tables        []*table
 	meter         metric.Meter
-	meterProvider *sdkmetric.MeterProvider
+	meterProvider *sdkmetric.MeterProvider // owned by the exporter
+	provider      metric.MeterProvider     // given by WithMeterProvider
+	registration  metric.Registration
+	global        bool
+	exporters     []otlpExporter
+	server        *http.Server // serves /metrics when scraped by Prometheus
+	admin         *http.Server // serves /healthz and /readyz
+	status        scrapeStatus
+	stopJSON      context.CancelFunc
+	jsonDone      chan struct{}
+	clock         Clock
+	collector     collector
+	totals        *flowTotals
+	readMu        sync.Mutex // orders the reads that reset the counters and the JSON snapshots
 }
 
-func New(cfg *types.Config) (*Exporter, error) {
-	nftClient, err := nft.New(&nft.Config{
-		TableFamily:   cfg.NFTables.Family,
-		TableName:     cfg.NFTables.TableName,
-		ChainPriority: cfg.NFTables.ChainPriority,
-	})
+// table is one of the tables the counters are installed in.
+type table struct {
+	cfg  types.NFTables
+	conn *nft.Conn
+}
+
+// otlpExporter is the exporter of one OTLP endpoint together with its
+// settings, so it can be rebuilt when the certificates change.
+type otlpExporter struct {
+	cfg types.OTLP
+	exp *reloadableExporter
+}
+
+// Option configures an Exporter.
+type Option func(*Exporter)
+
+// WithMeterProvider registers the metrics with mp instead of a meter provider
+// of the exporter's own. The host application then decides where the metrics
+// go, so the OTLP and Prometheus settings are ignored, and mp is left running
+// on Shutdown.
+func WithMeterProvider(mp metric.MeterProvider) Option {
+	return func(e *Exporter) {
+		e.provider = mp
+	}
+}
+
+// WithReaders tells the exporter how many readers of the meter provider
+// given by WithMeterProvider collect its metrics together, every
+// exporter.interval. They then share each read of the counters, which would
+// otherwise be split between them as every read resets the counters.
+func WithReaders(n int) Option {
+	return func(e *Exporter) {
+		e.collector.readers = n
+	}
+}
+
+// WithGlobalMeterProvider also makes the meter provider of the exporter the
+// global one of otel, for code that reads it from there.
+func WithGlobalMeterProvider() Option {
+	return func(e *Exporter) {
+		e.global = true
+	}
+}
+
+// WithClock replaces the clock driving the rates and the JSON export.
+func WithClock(c Clock) Option {
+	return func(e *Exporter) {
+		e.clock = c
+	}
+}
+
+// New installs the counters of cfg, or checks that the table can be read if
+// flowmon does not manage it. With several tables each is set up in turn,
+// and the ones already installed are removed again if one fails. Nothing is
+// exported until Start.
+func New(cfg *types.Config, opts ...Option) (*Exporter, error) {
+	e := &Exporter{
+		cfg:    cfg,
+		clock:  realClock{},
+		totals: newFlowTotals(),
+		collector: collector{
+			readers: 1,
+			window:  time.Duration(cfg.Exporter.Interval) / 2,
+		},
+	}
+
+	configured := cfg.CounterTables()
+	for _, t := range configured {
+		table, err := openTable(t)
+		if err == nil {
+			e.tables = append(e.tables, table)
+			continue
+		}
+		for _, installed := range e.tables {
+			if err := installed.conn.Cleanup(); err != nil {
+				slog.Error("Failed to remove table", "table", installed.cfg.TableName, "err", err)
+			}
+		}
+		if len(configured) > 1 {
+			return nil, fmt.Errorf("table %s: %w", t.TableName, err)
+		}
+		return nil, err
+	}
+
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e, nil
+}
+
+func openTable(t types.Table) (*table, error) {
+	nftClient, err := nft.New(nft.ConfigFrom(&t.NFTables))
 	if err != nil {
 		return nil, fmt.Errorf("nft.New(): %w", err)
 	}
 
-	if err := nftClient.Setup(&cfg.Counters); err != nil {
-		return nil, fmt.Errorf("nftClient.Setup(): %w", err)
+	if t.Managed() {
+		if err := nftClient.Setup(&t.Counters); err != nil {
+			return nil, fmt.Errorf("nftClient.Setup(): %w", err)
+		}
+	} else if err := nftClient.Check(); err != nil {
+		return nil, fmt.Errorf("nftables.manage is false and the table cannot be read: %w", err)
 	}
+	return &table{cfg: t.NFTables, conn: nftClient}, nil
+}
 
-	return &Exporter{
-		cfg:       cfg,
-		nftClient: nftClient,
-	}, nil
+// tableCounters are the counters read from one table.
+type tableCounters struct {
+	table    string
+	counters *types.Counters
 }
 
-func (e *Exporter) Start(ctx context.Context) error {
-	exporter, err := getExporter(ctx, e.cfg)
-	if err != nil {
-		return fmt.Errorf("getExporter(): %w", err)
+// listCounters reads the counters of every table, resetting them as
+// configured. The counters of the tables that could be read are returned
+// along with the errors of the others.
+func (e *Exporter) listCounters() ([]tableCounters, error) {
+	var read []tableCounters
+	var errs []error
+	for _, t := range e.tables {
+		counters, err := t.conn.ListCounters()
+		if err != nil {
+			errs = append(errs, e.tableError(t, err))
+			continue
+		}
+		read = append(read, tableCounters{table: t.conn.TableName(), counters: counters})
 	}
+	return read, errors.Join(errs...)
+}
 
-	res, err := resource.Merge(
-		resource.Default(),
-		resource.NewWithAttributes(
-			semconv.SchemaURL,
-			semconv.ServiceName("flowmon"),
-			semconv.ServiceVersion(e.cfg.Version),
-		),
-	)
-	if err != nil {
-		return fmt.Errorf("failed to create resource: %w", err)
+// tableError names the table err is about, if there is more than one.
+func (e *Exporter) tableError(t *table, err error) error {
+	if len(e.tables) > 1 {
+		return fmt.Errorf("table %s: %w", t.conn.TableName(), err)
 	}
+	return err
+}
 
-	e.meterProvider = sdkmetric.NewMeterProvider(
-		sdkmetric.WithResource(res),
-		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(
-			exporter,
-			sdkmetric.WithInterval(e.cfg.Exporter.Interval),
-		)),
-	)
-	otel.SetMeterProvider(e.meterProvider)
+// counterSet returns the attribute set of counter, read from table, and
+// whether the attributes were truncated to the configured limits.
+func (e *Exporter) counterSet(table string, counter types.Counter) (attribute.Set, bool) {
+	attrs := transformKeys(buildAttributes(table, counter, e.cfg.Exporter.DefaultAttributes), e.cfg.Exporter.AttributeKeyStyle)
+	attrs, truncated := limitAttributes(attrs, e.cfg.Exporter.AttributeLimits)
+	return attribute.NewSet(attrs...), truncated
+}
 
-	e.meter = e.meterProvider.Meter("flowmon")
+// Start registers the metrics and starts exporting them, along with the JSON
+// export and the admin server if configured.
+func (e *Exporter) Start(ctx context.Context) error {
+	provider := e.provider
+	if provider == nil {
+		readers, err := e.newReaders(ctx)
+		if err != nil {
+			return err
+		}
+
+		res, err := newResource(e.cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create resource: %w", err)
+		}
+
+		opts := []sdkmetric.Option{sdkmetric.WithResource(res)}
+		for _, reader := range readers {
+			opts = append(opts, sdkmetric.WithReader(reader))
+		}
+		e.meterProvider = sdkmetric.NewMeterProvider(opts...)
+		provider = e.meterProvider
+	}
+
+	if e.global {
+		otel.SetMeterProvider(provider)
+	}
+
+	e.meter = newMeter(provider, &e.cfg.Exporter, e.cfg.Version)
 
 	if err := e.registerMetrics(); err != nil {
 		return fmt.Errorf("failed to register metrics: %w", err)
 	}
 
+	if e.cfg.Exporter.ProcessMetrics {
+		if err := e.registerProcessMetrics(); err != nil {
+			return fmt.Errorf("failed to register process metrics: %w", err)
+		}
+	}
+
+	if admin := e.cfg.Admin; admin != nil && admin.Listen != "" {
+		server, err := listenAdmin(admin.Listen, e.Ready)
+		if err != nil {
+			return fmt.Errorf("failed to start admin server: %w", err)
+		}
+		e.admin = server
+	}
+
+	if e.cfg.Exporter.JSON != nil {
+		jsonCtx, cancel := context.WithCancel(context.Background())
+		e.stopJSON = cancel
+		e.jsonDone = make(chan struct{})
+		go func() {
+			defer close(e.jsonDone)
+			e.runJSON(jsonCtx, *e.cfg.Exporter.JSON)
+		}()
+	}
+
 	return nil
 }
 
+// newResource describes the flowmon instance. The configured resource
+// attributes are added last, so they can also override the defaults, such as
+// host.name. Unless configured, service.instance.id is a UUID kept in the
+// instance id file.
+func newResource(cfg *types.Config) (*resource.Resource, error) {
+	name := cfg.Exporter.ServiceName
+	if name == "" {
+		name = "flowmon"
+	}
+
+	attrs := []attribute.KeyValue{
+		semconv.ServiceName(name),
+		semconv.ServiceVersion(cfg.Version),
+	}
+	if _, ok := cfg.Exporter.ResourceAttributes[string(semconv.ServiceInstanceIDKey)]; !ok {
+		attrs = append(attrs, semconv.ServiceInstanceID(instanceID(instanceIDFile(cfg.Exporter.InstanceIDFile))))
+	}
+	for key, value := range cfg.Exporter.ResourceAttributes {
+		attrs = append(attrs, attribute.String(key, value))
+	}
+
+	return resource.Merge(
+		resource.Default(),
+		resource.NewWithAttributes(semconv.SchemaURL, attrs...),
+	)
+}
+
+// newMeter returns the meter of the configured instrumentation scope.
+func newMeter(provider metric.MeterProvider, cfg *types.Exporter, version string) metric.Meter {
+	name := cfg.ScopeName
+	if name == "" {
+		name = "flowmon"
+	}
+	if cfg.ScopeVersion != "" {
+		version = cfg.ScopeVersion
+	}
+	return provider.Meter(name, metric.WithInstrumentationVersion(version))
+}
+
+// newReaders returns the readers collecting the metrics: one serving them to
+// Prometheus if configured, otherwise one per OTLP endpoint pushing them
+// every interval. In best effort mode endpoints that cannot be set up are
+// logged and skipped, as long as one remains.
+func (e *Exporter) newReaders(ctx context.Context) ([]sdkmetric.Reader, error) {
+	if prom := e.cfg.Exporter.Prometheus; prom != nil && prom.Listen != "" {
+		reader, server, err := listenPrometheus(prom.Listen)
+		if err != nil {
+			return nil, err
+		}
+		e.server = server
+		return []sdkmetric.Reader{reader}, nil
+	}
+
+	var readers []sdkmetric.Reader
+	for _, otlpCfg := range e.cfg.Exporter.OTLP {
+		exporter, err := getExporter(ctx, otlpCfg)
+		if err != nil {
+			if !e.cfg.Exporter.OTLPBestEffort {
+				return nil, fmt.Errorf("getExporter(%s): %w", otlpCfg.Endpoint, err)
+			}
+			slog.Error("Failed to set up OTLP endpoint, skipping it", "endpoint", otlpCfg.Endpoint, "err", err)
+			continue
+		}
+		exp := newReloadableExporter(exporter)
+		e.exporters = append(e.exporters, otlpExporter{cfg: otlpCfg, exp: exp})
+
+		opts := []sdkmetric.PeriodicReaderOption{
+			sdkmetric.WithInterval(time.Duration(e.cfg.Exporter.Interval)),
+		}
+		// The reader gives up on an export after its own timeout, which must
+		// not cut the configured one short.
+		if timeout := otlpCfg.Timeout; timeout != nil {
+			opts = append(opts, sdkmetric.WithTimeout(time.Duration(*timeout)))
+		}
+		readers = append(readers, sdkmetric.NewPeriodicReader(exp, opts...))
+	}
+	if len(readers) == 0 {
+		return nil, fmt.Errorf("none of the OTLP endpoints could be set up")
+	}
+	// The readers tick together, one read of the counters serves them all.
+	e.collector.readers = len(readers)
+	return readers, nil
+}
+
 func (e *Exporter) registerMetrics() error {
-	packetsGauge, err := e.meter.Int64ObservableGauge(
-		"flow.packets",
-		metric.WithDescription("Number of packets matched"),
-		metric.WithUnit("{packets}"),
+	kind := e.cfg.Exporter.MetricKind
+	useGauges := kind != types.MetricKindCounter
+	useCounters := kind == types.MetricKindCounter || kind == types.MetricKindBoth
+
+	var instruments []metric.Observable
+	var packetsGauge, bytesGauge metric.Int64ObservableGauge
+	var packetsCounter, bytesCounter metric.Int64ObservableCounter
+	var err error
+
+	if useGauges {
+		packetsGauge, err = e.meter.Int64ObservableGauge(
+			"flow.packets",
+			metric.WithDescription("Number of packets matched"),
+			metric.WithUnit("{packets}"),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to create packets gauge: %w", err)
+		}
+
+		bytesGauge, err = e.meter.Int64ObservableGauge(
+			"flow.bytes",
+			metric.WithDescription("Number of bytes processed by counter"),
+			metric.WithUnit("By"),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to create bytes gauge: %w", err)
+		}
+		instruments = append(instruments, packetsGauge, bytesGauge)
+	}
+
+	if useCounters {
+		packetsCounter, err = e.meter.Int64ObservableCounter(
+			"flow.packets.total",
+			metric.WithDescription("Total number of packets matched since startup"),
+			metric.WithUnit("{packets}"),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to create packets counter: %w", err)
+		}
+
+		bytesCounter, err = e.meter.Int64ObservableCounter(
+			"flow.bytes.total",
+			metric.WithDescription("Total number of bytes processed by counter since startup"),
+			metric.WithUnit("By"),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to create bytes counter: %w", err)
+		}
+		instruments = append(instruments, packetsCounter, bytesCounter)
+	}
+
+	packetsRate, err := e.meter.Float64ObservableGauge(
+		"flow.packets.rate",
+		metric.WithDescription("Packets matched per second since the previous collection"),
+		metric.WithUnit("{packets}/s"),
 	)
 	if err != nil {
-		return fmt.Errorf("failed to create packets gauge: %w", err)
+		return fmt.Errorf("failed to create packets rate gauge: %w", err)
 	}
 
-	bytesGauge, err := e.meter.Int64ObservableGauge(
-		"flow.bytes",
-		metric.WithDescription("Number of bytes processed by counter"),
+	bytesRate, err := e.meter.Float64ObservableGauge(
+		"flow.bytes.rate",
+		metric.WithDescription("Bytes processed per second since the previous collection"),
+		metric.WithUnit("By/s"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create bytes rate gauge: %w", err)
+	}
+	instruments = append(instruments, packetsRate, bytesRate)
+
+	packetSize, err := e.meter.Float64ObservableGauge(
+		"flow.packet.size.avg",
+		metric.WithDescription("Average size of the packets matched since the previous collection"),
 		metric.WithUnit("By"),
 	)
 	if err != nil {
-		return fmt.Errorf("failed to create bytes gauge: %w", err)
+		return fmt.Errorf("failed to create average packet size gauge: %w", err)
+	}
+	instruments = append(instruments, packetSize)
+
+	scrapeSuccess, err := e.meter.Int64ObservableGauge(
+		"flow.scrape.success",
+		metric.WithDescription("Whether the last read of the counters succeeded (1) or failed (0)"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create scrape success gauge: %w", err)
+	}
+
+	scrapeErrors, err := e.meter.Int64ObservableCounter(
+		"flow.scrape.errors.total",
+		metric.WithDescription("Number of failed reads of the counters since startup"),
+		metric.WithUnit("{errors}"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create scrape errors counter: %w", err)
+	}
+	instruments = append(instruments, scrapeSuccess, scrapeErrors)
+
+	activeGauge, err := e.meter.Int64ObservableGauge(
+		"flow.counters.active",
+		metric.WithDescription("Number of counters read from nftables"),
+		metric.WithUnit("{counters}"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create active counters gauge: %w", err)
+	}
+	instruments = append(instruments, activeGauge)
+
+	quotaConsumed, err := e.meter.Int64ObservableGauge(
+		"flow.quota.consumed",
+		metric.WithDescription("Bytes consumed of the quota of a counter"),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create quota consumed gauge: %w", err)
+	}
+
+	quotaExceeded, err := e.meter.Int64ObservableGauge(
+		"flow.quota.exceeded",
+		metric.WithDescription("Whether the quota of a counter is used up (1) or not (0)"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create quota exceeded gauge: %w", err)
+	}
+	instruments = append(instruments, quotaConsumed, quotaExceeded)
+
+	skippedCounter, err := e.meter.Int64ObservableCounter(
+		"flow.rules.skipped.total",
+		metric.WithDescription("Number of rules skipped while reading the counters since startup, by reason"),
+		metric.WithUnit("{rules}"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create skipped rules counter: %w", err)
 	}
+	instruments = append(instruments, skippedCounter)
 
-	_, err = e.meter.RegisterCallback(func(ctx context.Context, o metric.Observer) error {
-		counters, err := e.nftClient.ListCounters()
+	truncatedCounter, err := e.meter.Int64Counter(
+		"flowmon.attributes.truncated",
+		metric.WithDescription("Number of counters whose attributes were truncated to fit the configured limits"),
+		metric.WithUnit("{counters}"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create truncated attributes counter: %w", err)
+	}
+
+	info, err := e.meter.Int64ObservableGauge(
+		"flow.info",
+		metric.WithDescription("Always 1, with the flowmon version and the tables it reads as attributes"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create info gauge: %w", err)
+	}
+	instruments = append(instruments, info)
+
+	rates := newFlowRates()
+	var failures int64
+
+	// read reads the counters and derives the totals and rates from them,
+	// once per collection cycle however many readers observe it.
+	read := func(ctx context.Context, now time.Time) *collection {
+		e.readMu.Lock()
+		defer e.readMu.Unlock()
+
+		tables, err := e.listCounters()
+		e.status.set(err)
+		c := &collection{at: now, err: err, read: tables, skipped: map[string]uint64{}}
 		if err != nil {
-			return fmt.Errorf("failed to list counters: %v", err)
+			slog.Error("Failed to list counters", "err", err)
+			failures++
+		}
+		c.failures = failures
+
+		for _, t := range e.tables {
+			for reason, count := range t.conn.Skipped() {
+				c.skipped[reason] += count
+			}
 		}
 
-		all := append(counters.Input, counters.Output...)
-		for _, counter := range all {
-			counterAttrs := buildAttributes(counter)
+		for _, r := range tables {
+			slog.Debug("Read counters", "table", r.table, "input", len(r.counters.Input), "output", len(r.counters.Output), "forward", len(r.counters.Forward))
+			for _, counter := range r.counters.All() {
+				set, truncated := e.counterSet(r.table, counter)
+				if truncated {
+					truncatedCounter.Add(ctx, 1)
+				}
+
+				// Counters that are not reset are read as totals, and the
+				// traffic since the previous read is derived from them.
+				total := flowTotal{packets: counter.Packets, bytes: counter.Bytes}
+				delta := total
+				if counter.Cumulative {
+					delta = e.totals.replace(set, counter.Packets, counter.Bytes)
+				} else {
+					total = e.totals.add(set, counter.Packets, counter.Bytes)
+				}
+
+				rate, ok := rates.observe(set, delta.packets, delta.bytes, now)
+				c.counters = append(c.counters, collectedCounter{
+					set:     set,
+					counter: counter,
+					total:   total,
+					delta:   delta,
+					rate:    rate,
+					hasRate: ok,
+				})
+			}
+		}
+		return c
+	}
 
-			o.ObserveInt64(packetsGauge, int64(counter.Packets), metric.WithAttributes(counterAttrs...))
-			o.ObserveInt64(bytesGauge, int64(counter.Bytes), metric.WithAttributes(counterAttrs...))
+	e.registration, err = e.meter.RegisterCallback(func(ctx context.Context, o metric.Observer) error {
+		// Static, so it is reported even when the tables cannot be read.
+		for _, t := range e.tables {
+			o.ObserveInt64(info, 1, metric.WithAttributes(
+				attribute.String("version", e.cfg.Version),
+				attribute.String("table", t.cfg.TableName),
+				attribute.String("family", t.cfg.Family.String()),
+				attribute.Bool("managed", t.cfg.Managed()),
+			))
+		}
+
+		now := e.clock.Now()
+		c := e.collector.get(now, func() *collection { return read(ctx, now) })
+
+		// Returning the error would drop the scrape metrics as well,
+		// leaving the collector unable to tell a failure from silence.
+		success := int64(1)
+		if c.err != nil {
+			success = 0
+		}
+		o.ObserveInt64(scrapeSuccess, success)
+		o.ObserveInt64(scrapeErrors, c.failures)
+		// The tables that could be read are still reported.
+		if len(c.read) == 0 {
+			return nil
+		}
+
+		for reason, count := range c.skipped {
+			o.ObserveInt64(skippedCounter, int64(count), metric.WithAttributes(attribute.String("reason", reason)))
+		}
+
+		active := map[string]int{}
+		for _, r := range c.read {
+			active["input"] += len(r.counters.Input)
+			active["output"] += len(r.counters.Output)
+			active["forward"] += len(r.counters.Forward)
+		}
+		for _, dir := range []string{"input", "output", "forward"} {
+			o.ObserveInt64(activeGauge, int64(active[dir]), metric.WithAttributes(attribute.String("direction", dir)))
+		}
+
+		for _, cc := range c.counters {
+			counter, set := cc.counter, cc.set
+			if useGauges {
+				o.ObserveInt64(packetsGauge, int64(counter.Packets), metric.WithAttributeSet(set))
+				o.ObserveInt64(bytesGauge, int64(counter.Bytes), metric.WithAttributeSet(set))
+			}
+
+			if useCounters {
+				o.ObserveInt64(packetsCounter, int64(cc.total.packets), metric.WithAttributeSet(set))
+				o.ObserveInt64(bytesCounter, int64(cc.total.bytes), metric.WithAttributeSet(set))
+			}
+
+			if counter.Quota != 0 {
+				exceeded := int64(0)
+				if counter.QuotaUsed >= counter.Quota {
+					exceeded = 1
+				}
+				o.ObserveInt64(quotaConsumed, int64(counter.QuotaUsed), metric.WithAttributeSet(set))
+				o.ObserveInt64(quotaExceeded, exceeded, metric.WithAttributeSet(set))
+			}
+
+			// Without packets there is no size to average.
+			if cc.delta.packets > 0 {
+				o.ObserveFloat64(packetSize, float64(cc.delta.bytes)/float64(cc.delta.packets), metric.WithAttributeSet(set))
+			}
+
+			if cc.hasRate {
+				o.ObserveFloat64(packetsRate, cc.rate.packets, metric.WithAttributeSet(set))
+				o.ObserveFloat64(bytesRate, cc.rate.bytes, metric.WithAttributeSet(set))
+			}
 		}
 
 		return nil
-	}, packetsGauge, bytesGauge)
+	}, instruments...)
 	if err != nil {
 		return fmt.Errorf("failed to register callback: %w", err)
 	}
@@ -128,54 +634,191 @@ func (e *Exporter) registerMetrics() error {
 	return nil
 }
 
+// ReloadCounters replaces the counters of the table, for a configuration
+// with a single table. See ReloadTables.
+func (e *Exporter) ReloadCounters(counters *types.Counters) error {
+	if len(e.tables) != 1 {
+		return fmt.Errorf("flowmon has %d tables, use ReloadTables", len(e.tables))
+	}
+	return e.ReloadTables([]types.Table{{NFTables: e.tables[0].cfg, Counters: *counters}})
+}
+
+// ReloadTables replaces the counters of every table. Counters that did not
+// change keep their rules and counts. Tables flowmon does not manage are
+// left untouched. The tables must be the ones flowmon started with, adding
+// or removing one takes a restart.
+func (e *Exporter) ReloadTables(tables []types.Table) error {
+	if len(tables) != len(e.tables) {
+		return fmt.Errorf("tables cannot be added or removed by a reload")
+	}
+	for i, t := range tables {
+		if t.TableName != e.tables[i].cfg.TableName || t.Family != e.tables[i].cfg.Family {
+			return fmt.Errorf("tables cannot be added or removed by a reload")
+		}
+	}
+
+	var errs []error
+	for i, t := range tables {
+		table := e.tables[i]
+		if !table.cfg.Managed() {
+			continue
+		}
+		if err := table.conn.Reconcile(&t.Counters); err != nil {
+			errs = append(errs, e.tableError(table, fmt.Errorf("nftClient.Reconcile(): %w", err)))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ReloadTLS re-reads the configured certificate, key and CA files and
+// replaces the OTLP exporters with ones using the new credentials. On error
+// the current exporter of that endpoint is kept.
+func (e *Exporter) ReloadTLS(ctx context.Context) error {
+	var errs []error
+	for _, otlp := range e.exporters {
+		if otlp.cfg.TLS == nil {
+			continue
+		}
+
+		exporter, err := getExporter(ctx, otlp.cfg)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("getExporter(%s): %w", otlp.cfg.Endpoint, err))
+			continue
+		}
+
+		if err := otlp.exp.swap(ctx, exporter); err != nil {
+			errs = append(errs, fmt.Errorf("failed to shutdown previous exporter of %s: %w", otlp.cfg.Endpoint, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Shutdown stops exporting, flushing the metrics of its own meter provider,
+// and removes the rules flowmon installed.
 func (e *Exporter) Shutdown(ctx context.Context) error {
 	shutdownCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
+	if e.stopJSON != nil {
+		e.stopJSON()
+		<-e.jsonDone
+	}
+
+	if e.server != nil {
+		if err := e.server.Shutdown(shutdownCtx); err != nil {
+			return fmt.Errorf("failed to shutdown prometheus server: %w", err)
+		}
+	}
+
+	if e.admin != nil {
+		if err := e.admin.Shutdown(shutdownCtx); err != nil {
+			return fmt.Errorf("failed to shutdown admin server: %w", err)
+		}
+	}
+
+	// A given meter provider outlives the exporter, so the callback must not
+	// read, and thereby recreate, the rules removed below.
+	if e.registration != nil {
+		if err := e.registration.Unregister(); err != nil {
+			return fmt.Errorf("failed to unregister callback: %w", err)
+		}
+	}
+
 	if e.meterProvider != nil {
 		if err := e.meterProvider.Shutdown(shutdownCtx); err != nil {
 			return fmt.Errorf("failed to shutdown meter provider: %w", err)
 		}
 	}
 
-	if err := e.nftClient.Cleanup(); err != nil {
-		return fmt.Errorf("failed to cleanup nft client: %w", err)
+	var errs []error
+	for _, t := range e.tables {
+		if err := t.conn.Cleanup(); err != nil {
+			errs = append(errs, e.tableError(t, fmt.Errorf("failed to cleanup nft client: %w", err)))
+		}
 	}
-
-	return nil
+	return errors.Join(errs...)
 }
 
-func getExporter(ctx context.Context, cfg *types.Config) (sdkmetric.Exporter, error) {
-	otlpCfg := cfg.Exporter.OTLP
+func getExporter(ctx context.Context, otlpCfg types.OTLP) (sdkmetric.Exporter, error) {
 	protocol := otlpCfg.Protocol
 
 	switch otlpCfg.Protocol {
 	case types.OTLPProtocolStdout:
-		return stdoutmetric.New(stdoutmetric.WithPrettyPrint())
+		return stdoutmetric.New(
+			stdoutmetric.WithPrettyPrint(),
+			stdoutmetric.WithTemporalitySelector(temporalitySelector(otlpCfg.Temporality)),
+		)
 	case types.OTLPProtocolHTTP:
 		return newHTTPExporter(ctx, otlpCfg)
 	case types.OTLPProtocolGRPC:
 		return newGRPCExporter(ctx, otlpCfg)
 	default:
-		return nil, fmt.Errorf("unknown protocol %q, expected 'grpc' or 'http'", protocol)
+		return nil, fmt.Errorf("unknown protocol %q, expected 'grpc', 'http' or 'stdout'", protocol)
+	}
+}
+
+// retryConfig returns the backoff for r, filling unset fields with the
+// defaults of the OTLP exporters. The HTTP exporter takes the same struct
+// under its own name.
+func retryConfig(r *types.Retry) otlpmetricgrpc.RetryConfig {
+	rc := otlpmetricgrpc.RetryConfig{
+		Enabled:         r.Enabled == nil || *r.Enabled,
+		InitialInterval: 5 * time.Second,
+		MaxInterval:     30 * time.Second,
+		MaxElapsedTime:  time.Minute,
+	}
+	if r.InitialInterval > 0 {
+		rc.InitialInterval = time.Duration(r.InitialInterval)
+	}
+	if r.MaxInterval > 0 {
+		rc.MaxInterval = time.Duration(r.MaxInterval)
 	}
+	if r.MaxElapsedTime > 0 {
+		rc.MaxElapsedTime = time.Duration(r.MaxElapsedTime)
+	}
+	return rc
 }
 
 func newHTTPExporter(ctx context.Context, cfg types.OTLP) (sdkmetric.Exporter, error) {
 	opts := []otlpmetrichttp.Option{
-		otlpmetrichttp.WithEndpoint(cfg.Endpoint),
+		otlpmetrichttp.WithTemporalitySelector(temporalitySelector(cfg.Temporality)),
 	}
 
-	if cfg.TLS == nil {
+	insecure, err := endpointInsecure(cfg)
+	if err != nil {
+		return nil, err
+	}
+	headers, err := expandHeaders(cfg.Headers)
+	if err != nil {
+		return nil, err
+	}
+	if len(headers) > 0 {
+		opts = append(opts, otlpmetrichttp.WithHeaders(headers))
+	}
+	if cfg.Timeout != nil {
+		opts = append(opts, otlpmetrichttp.WithTimeout(time.Duration(*cfg.Timeout)))
+	}
+	if cfg.Retry != nil {
+		opts = append(opts, otlpmetrichttp.WithRetry(otlpmetrichttp.RetryConfig(retryConfig(cfg.Retry))))
+	}
+	switch {
+	case cfg.Endpoint == "":
+		// Left to the OTEL_EXPORTER_OTLP_* variables.
+	case strings.Contains(cfg.Endpoint, "://"):
+		opts = append(opts, otlpmetrichttp.WithEndpointURL(cfg.Endpoint))
+	default:
+		opts = append(opts, otlpmetrichttp.WithEndpoint(cfg.Endpoint))
+	}
+
+	if insecure {
 		opts = append(opts, otlpmetrichttp.WithInsecure())
-	} else {
+	} else if cfg.TLS != nil {
 		tlsConfig, err := buildTLSConfig(cfg.TLS)
 		if err != nil {
 			return nil, err
 		}
-		transport := &http.Transport{TLSClientConfig: tlsConfig}
-		client := &http.Client{Transport: transport, Timeout: 30 * time.Second}
-		opts = append(opts, otlpmetrichttp.WithHTTPClient(client))
+		opts = append(opts, otlpmetrichttp.WithTLSClientConfig(tlsConfig))
 	}
 
 	return otlpmetrichttp.New(ctx, opts...)
@@ -183,12 +826,38 @@ func newHTTPExporter(ctx context.Context, cfg types.OTLP) (sdkmetric.Exporter, e
 
 func newGRPCExporter(ctx context.Context, cfg types.OTLP) (sdkmetric.Exporter, error) {
 	opts := []otlpmetricgrpc.Option{
-		otlpmetricgrpc.WithEndpoint(cfg.Endpoint),
+		otlpmetricgrpc.WithTemporalitySelector(temporalitySelector(cfg.Temporality)),
 	}
 
-	if cfg.TLS == nil {
+	insecure, err := endpointInsecure(cfg)
+	if err != nil {
+		return nil, err
+	}
+	headers, err := expandHeaders(cfg.Headers)
+	if err != nil {
+		return nil, err
+	}
+	if len(headers) > 0 {
+		opts = append(opts, otlpmetricgrpc.WithHeaders(headers))
+	}
+	if cfg.Timeout != nil {
+		opts = append(opts, otlpmetricgrpc.WithTimeout(time.Duration(*cfg.Timeout)))
+	}
+	if cfg.Retry != nil {
+		opts = append(opts, otlpmetricgrpc.WithRetry(retryConfig(cfg.Retry)))
+	}
+	switch {
+	case cfg.Endpoint == "":
+		// Left to the OTEL_EXPORTER_OTLP_* variables.
+	case strings.Contains(cfg.Endpoint, "://"):
+		opts = append(opts, otlpmetricgrpc.WithEndpointURL(cfg.Endpoint))
+	default:
+		opts = append(opts, otlpmetricgrpc.WithEndpoint(cfg.Endpoint))
+	}
+
+	if insecure {
 		opts = append(opts, otlpmetricgrpc.WithInsecure())
-	} else {
+	} else if cfg.TLS != nil {
 		tlsConfig, err := buildTLSConfig(cfg.TLS)
 		if err != nil {
 			return nil, err
@@ -199,71 +868,106 @@ func newGRPCExporter(ctx context.Context, cfg types.OTLP) (sdkmetric.Exporter, e
 	return otlpmetricgrpc.New(ctx, opts...)
 }
 
-func buildTLSConfig(cfg *types.TLSConfig) (*tls.Config, error) {
-	if cfg == nil {
-		return &tls.Config{MinVersion: tls.VersionTLS12}, nil
+// endpointInsecure reports whether the endpoint is reached without TLS.
+// Plain host:port endpoints use TLS only when tls_config is set, URL
+// endpoints such as http://collector:4318/v1/metrics follow their scheme.
+// Without an endpoint the OTEL_EXPORTER_OTLP_* variables decide.
+func endpointInsecure(cfg types.OTLP) (bool, error) {
+	if cfg.Endpoint == "" {
+		return false, nil
 	}
-	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
-
-	if cfg.CAFile != "" {
-		caCert, err := os.ReadFile(cfg.CAFile)
-		if err != nil {
-			return nil, err
-		}
-		caPool := x509.NewCertPool()
-		if !caPool.AppendCertsFromPEM(caCert) {
-			return nil, fmt.Errorf("failed to parse CA cert")
-		}
-		tlsConfig.RootCAs = caPool
+	if !strings.Contains(cfg.Endpoint, "://") {
+		return cfg.TLS == nil, nil
 	}
 
-	if cfg.CertFile != "" && cfg.KeyFile != "" {
-		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
-		if err != nil {
-			return nil, err
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return false, fmt.Errorf("invalid endpoint %q: %w", cfg.Endpoint, err)
+	}
+	switch u.Scheme {
+	case "http":
+		if cfg.TLS != nil {
+			return false, fmt.Errorf("endpoint %q: tls_config requires an https endpoint", cfg.Endpoint)
 		}
-		tlsConfig.Certificates = []tls.Certificate{cert}
+		return true, nil
+	case "https":
+		return false, nil
+	default:
+		return false, fmt.Errorf("endpoint %q: unsupported scheme %q, expected 'http' or 'https'", cfg.Endpoint, u.Scheme)
 	}
-
-	return tlsConfig, nil
 }
 
-func buildAttributes(counter types.Counter) []attribute.KeyValue {
-	attrs := []attribute.KeyValue{
-		attribute.String("direction", counter.Dir),
-	}
-
-	if counter.Label != "" {
-		attrs = append(attrs, attribute.String("label", counter.Label))
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandHeaders replaces ${VAR} references in header values with the value
+// of the environment variable, so secrets can be kept out of the config
+// file. Referencing an unset variable is an error.
+func expandHeaders(headers map[string]string) (map[string]string, error) {
+	expanded := make(map[string]string, len(headers))
+	for name, value := range headers {
+		var missing string
+		expanded[name] = envRef.ReplaceAllStringFunc(value, func(ref string) string {
+			key := envRef.FindStringSubmatch(ref)[1]
+			v, ok := os.LookupEnv(key)
+			if !ok && missing == "" {
+				missing = key
+			}
+			return v
+		})
+		if missing != "" {
+			return nil, fmt.Errorf("header %q: environment variable %s is not set", name, missing)
+		}
 	}
+	return expanded, nil
+}
 
-	if counter.SrcAddr.IsValid() {
-		attrs = append(attrs, attribute.String("src_addr", counter.SrcAddr.String()))
+// temporalitySelector returns the temporality selector for an endpoint. Each
+// endpoint gets its own reader, so the SDK keeps separate aggregation state
+// and a cumulative and a delta backend can be fed from the same counters.
+func temporalitySelector(t types.Temporality) sdkmetric.TemporalitySelector {
+	if t != types.TemporalityDelta {
+		return sdkmetric.DefaultTemporalitySelector
 	}
-
-	if counter.DstAddr.IsValid() {
-		attrs = append(attrs, attribute.String("dst_addr", counter.DstAddr.String()))
+	return func(kind sdkmetric.InstrumentKind) metricdata.Temporality {
+		switch kind {
+		case sdkmetric.InstrumentKindUpDownCounter, sdkmetric.InstrumentKindObservableUpDownCounter:
+			// Up-down counters are not monotonic, delta makes no sense for them.
+			return metricdata.CumulativeTemporality
+		default:
+			return metricdata.DeltaTemporality
+		}
 	}
+}
 
-	if counter.Protocol > 0 {
-		attrs = append(attrs, attribute.String("protocol", counter.Protocol.String()))
+func buildTLSConfig(cfg *types.TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg == nil {
+		return tlsConfig, nil
 	}
 
-	if counter.SrcPort > 0 && (counter.Protocol == types.ProtocolTCP || counter.Protocol == types.ProtocolUDP) {
-		attrs = append(attrs, attribute.Int("src_port", int(counter.SrcPort)))
+	if cfg.CAFile != "" {
+		caCert, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("failed to parse CA file %s: no PEM certificates found", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = caPool
 	}
 
-	if counter.DstPort > 0 && (counter.Protocol == types.ProtocolTCP || counter.Protocol == types.ProtocolUDP) {
-		attrs = append(attrs, attribute.Int("dst_port", int(counter.DstPort)))
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, fmt.Errorf("cert_file and key_file must be set together")
 	}
 
-	if len(counter.TcpFlags) > 0 {
-		flags := make([]string, len(counter.TcpFlags))
-		for i, flag := range counter.TcpFlags {
-			flags[i] = flag.String()
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
 		}
-		attrs = append(attrs, attribute.StringSlice("tcp_flags", flags))
+		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
 
-	return attrs
+	return tlsConfig, nil
 }
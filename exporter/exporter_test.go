@@ -0,0 +1,541 @@
+package exporter
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nickgarlis/flowmon/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/metric/noop"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestEndpointInsecure(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      types.OTLP
+		insecure bool
+		wantErr  bool
+	}{
+		{"host and port", types.OTLP{Endpoint: "collector:4317"}, true, false},
+		{"host and port with tls", types.OTLP{Endpoint: "collector:4317", TLS: &types.TLSConfig{}}, false, false},
+		{"http url", types.OTLP{Endpoint: "http://collector:4318/v1/metrics"}, true, false},
+		{"https url", types.OTLP{Endpoint: "https://collector:4318/v1/metrics"}, false, false},
+		{"http url with tls", types.OTLP{Endpoint: "http://collector:4318", TLS: &types.TLSConfig{}}, false, true},
+		{"unsupported scheme", types.OTLP{Endpoint: "ftp://collector"}, false, true},
+		{"endpoint from the environment", types.OTLP{}, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			insecure, err := endpointInsecure(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("endpointInsecure() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if insecure != tt.insecure {
+				t.Errorf("endpointInsecure() = %v, want %v", insecure, tt.insecure)
+			}
+		})
+	}
+}
+
+func TestBuildTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		cfg  *types.TLSConfig
+	}{
+		{"missing CA file", &types.TLSConfig{CAFile: filepath.Join(dir, "missing.pem")}},
+		{"invalid CA file", &types.TLSConfig{CAFile: notPEM}},
+		{"cert without key", &types.TLSConfig{CertFile: notPEM}},
+		{"invalid key pair", &types.TLSConfig{CertFile: notPEM, KeyFile: notPEM}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := buildTLSConfig(tt.cfg); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestExpandHeaders(t *testing.T) {
+	t.Setenv("FLOWMON_TEST_TOKEN", "secret")
+
+	got, err := expandHeaders(map[string]string{
+		"authorization": "Bearer ${FLOWMON_TEST_TOKEN}",
+		"x-scope-orgid": "tenant-$1",
+	})
+	if err != nil {
+		t.Fatalf("expandHeaders: %v", err)
+	}
+	if got["authorization"] != "Bearer secret" {
+		t.Errorf("expected the token to be expanded, got %q", got["authorization"])
+	}
+	if got["x-scope-orgid"] != "tenant-$1" {
+		t.Errorf("expected values without ${...} to be kept, got %q", got["x-scope-orgid"])
+	}
+
+	if _, err := expandHeaders(map[string]string{"authorization": "${FLOWMON_TEST_UNSET}"}); err == nil {
+		t.Errorf("expected an error for an unset variable")
+	}
+}
+
+func TestNewResource(t *testing.T) {
+	cfg := &types.Config{
+		Version: "1.2.3",
+		Exporter: types.Exporter{
+			ServiceName: "flowmon-edge",
+			ResourceAttributes: map[string]string{
+				"service.instance.id": "edge-1",
+				"region":              "eu-west",
+			},
+		},
+	}
+
+	res, err := newResource(cfg)
+	if err != nil {
+		t.Fatalf("newResource: %v", err)
+	}
+
+	for key, want := range map[string]string{
+		"service.name":        "flowmon-edge",
+		"service.version":     "1.2.3",
+		"service.instance.id": "edge-1",
+		"region":              "eu-west",
+	} {
+		got, ok := res.Set().Value(attribute.Key(key))
+		if !ok || got.AsString() != want {
+			t.Errorf("%s: expected %q, got %q", key, want, got.AsString())
+		}
+	}
+}
+
+func TestInstanceID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "instance-id")
+
+	id := instanceID(path)
+	if _, err := uuid.Parse(id); err != nil {
+		t.Fatalf("Expected a UUID, got %q: %v", id, err)
+	}
+	if again := instanceID(path); again != id {
+		t.Errorf("Expected %q to persist, got %q", id, again)
+	}
+
+	t.Setenv("STATE_DIRECTORY", "/var/lib/flowmon:/var/lib/other")
+	if got := instanceIDFile(""); got != "/var/lib/flowmon/instance-id" {
+		t.Errorf("Expected the state directory, got %q", got)
+	}
+	if got := instanceIDFile(path); got != path {
+		t.Errorf("Expected the configured path, got %q", got)
+	}
+}
+
+func TestNewMeter(t *testing.T) {
+	tests := []struct {
+		cfg         types.Exporter
+		wantName    string
+		wantVersion string
+	}{
+		{types.Exporter{}, "flowmon", "1.2.3"},
+		{types.Exporter{ScopeName: "netmon", ScopeVersion: "2.0.0"}, "netmon", "2.0.0"},
+	}
+
+	for _, tt := range tests {
+		reader := sdkmetric.NewManualReader()
+		provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+		counter, err := newMeter(provider, &tt.cfg, "1.2.3").Int64Counter("test")
+		if err != nil {
+			t.Fatalf("Int64Counter: %v", err)
+		}
+		counter.Add(t.Context(), 1)
+
+		var rm metricdata.ResourceMetrics
+		if err := reader.Collect(t.Context(), &rm); err != nil {
+			t.Fatalf("Collect: %v", err)
+		}
+		if len(rm.ScopeMetrics) != 1 {
+			t.Fatalf("expected one scope, got %d", len(rm.ScopeMetrics))
+		}
+		if scope := rm.ScopeMetrics[0].Scope; scope.Name != tt.wantName || scope.Version != tt.wantVersion {
+			t.Errorf("expected scope %s %s, got %s %s", tt.wantName, tt.wantVersion, scope.Name, scope.Version)
+		}
+	}
+}
+
+func TestRetryConfig(t *testing.T) {
+	disabled := false
+	got := retryConfig(&types.Retry{Enabled: &disabled, MaxElapsedTime: types.Duration(5 * time.Minute)})
+	want := otlpmetricgrpc.RetryConfig{
+		Enabled:         false,
+		InitialInterval: 5 * time.Second,
+		MaxInterval:     30 * time.Second,
+		MaxElapsedTime:  5 * time.Minute,
+	}
+	if got != want {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+
+	if !retryConfig(&types.Retry{}).Enabled {
+		t.Errorf("expected retries to be enabled by default")
+	}
+}
+
+func TestNewReadersBestEffort(t *testing.T) {
+	cfg := &types.Config{
+		Exporter: types.Exporter{
+			Interval: types.Duration(time.Minute),
+			OTLP: types.OTLPEndpoints{
+				{Endpoint: "collector:4317", Protocol: types.OTLPProtocolGRPC, TLS: &types.TLSConfig{CAFile: "/nonexistent/ca.pem"}},
+				{Protocol: types.OTLPProtocolStdout},
+			},
+		},
+	}
+
+	e := &Exporter{cfg: cfg}
+	if _, err := e.newReaders(t.Context()); err == nil {
+		t.Fatalf("expected the broken endpoint to fail the start")
+	}
+
+	cfg.Exporter.OTLPBestEffort = true
+	e = &Exporter{cfg: cfg}
+	readers, err := e.newReaders(t.Context())
+	if err != nil {
+		t.Fatalf("newReaders: %v", err)
+	}
+	if len(readers) != 1 || len(e.exporters) != 1 || e.exporters[0].cfg.Protocol != types.OTLPProtocolStdout {
+		t.Errorf("expected only the stdout endpoint, got %d readers", len(readers))
+	}
+}
+
+func TestWithMeterProvider(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	cfg := &types.Config{
+		NFTables: types.NFTables{Family: types.TableFamilyIPv4, TableName: "test_table_provider"},
+		Counters: types.Counters{
+			Output: []types.Counter{{Label: "udp", Protocol: types.ProtocolUDP, DstPort: 9996}},
+		},
+	}
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	defer provider.Shutdown(t.Context())
+
+	e, err := New(cfg, WithMeterProvider(provider))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := e.Start(t.Context()); err != nil {
+		e.Shutdown(t.Context())
+		t.Fatalf("Start: %v", err)
+	}
+	if len(e.exporters) != 0 {
+		t.Errorf("expected no OTLP exporter with a given meter provider, got %d", len(e.exporters))
+	}
+
+	// Two datagrams of 29 and 31 bytes. Each gets its own socket, as the
+	// port unreachable reply to the first fails the next write.
+	for _, payload := range []string{"x", "xxx"} {
+		conn, err := net.Dial("udp", "127.0.0.1:9996")
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		if _, err := conn.Write([]byte(payload)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		conn.Close()
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(t.Context(), &rm); err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	names := map[string]bool{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			names[m.Name] = true
+			if m.Name != "flow.packet.size.avg" {
+				continue
+			}
+			points := m.Data.(metricdata.Gauge[float64]).DataPoints
+			if len(points) != 1 || points[0].Value != 30 {
+				t.Errorf("expected an average packet size of 30, got %v", points)
+			}
+		}
+	}
+	if !names["flow.packets"] || !names["flow.scrape.success"] || !names["flow.packet.size.avg"] {
+		t.Errorf("expected the flow metrics on the given provider, got %v", names)
+	}
+
+	if err := e.Shutdown(t.Context()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	// The provider belongs to the caller and keeps working, without the
+	// callback recreating the rules.
+	if err := reader.Collect(t.Context(), &rm); err != nil {
+		t.Fatalf("expected the given provider to outlive Shutdown, got %v", err)
+	}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if sum, ok := m.Data.(metricdata.Sum[int64]); ok && len(sum.DataPoints) > 0 {
+				t.Errorf("expected no %s data points after Shutdown, got %d", m.Name, len(sum.DataPoints))
+			}
+		}
+	}
+}
+
+func TestSharedReads(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	cfg := &types.Config{
+		Exporter: types.Exporter{Interval: types.Duration(10 * time.Second)},
+		NFTables: types.NFTables{Family: types.TableFamilyIPv4, TableName: "test_table_shared_reads"},
+		Counters: types.Counters{
+			Output: []types.Counter{{Label: "udp", Protocol: types.ProtocolUDP, DstPort: 9983}},
+		},
+	}
+	readers := []*sdkmetric.ManualReader{sdkmetric.NewManualReader(), sdkmetric.NewManualReader()}
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(readers[0]), sdkmetric.WithReader(readers[1]))
+	defer provider.Shutdown(t.Context())
+
+	e, err := New(cfg, WithMeterProvider(provider), WithReaders(2))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer e.Shutdown(t.Context())
+	if err := e.Start(t.Context()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	packets := func(reader *sdkmetric.ManualReader) int64 {
+		t.Helper()
+		var rm metricdata.ResourceMetrics
+		if err := reader.Collect(t.Context(), &rm); err != nil {
+			t.Fatalf("Collect: %v", err)
+		}
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				if m.Name != "flow.packets" {
+					continue
+				}
+				if points := m.Data.(metricdata.Gauge[int64]).DataPoints; len(points) == 1 {
+					return points[0].Value
+				}
+			}
+		}
+		t.Fatalf("expected a flow.packets data point")
+		return 0
+	}
+
+	for range 3 {
+		conn, err := net.Dial("udp", "127.0.0.1:9983")
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		conn.Write([]byte("x"))
+		conn.Close()
+	}
+
+	// Both readers of the cycle see the whole delta, the next cycle reads
+	// the counters again.
+	for i, want := range []int64{3, 3, 0} {
+		if got := packets(readers[i%2]); got != want {
+			t.Errorf("collection %d: expected %d packets, got %d", i, want, got)
+		}
+	}
+}
+
+func TestMultipleTables(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	cfg := &types.Config{
+		Tables: []types.Table{
+			{
+				NFTables: types.NFTables{Family: types.TableFamilyIPv4, TableName: "test_table_web"},
+				Counters: types.Counters{Output: []types.Counter{{Label: "web", Protocol: types.ProtocolUDP, DstPort: 9985}}},
+			},
+			{
+				NFTables: types.NFTables{Family: types.TableFamilyIPv4, TableName: "test_table_db"},
+				Counters: types.Counters{Output: []types.Counter{{Label: "db", Protocol: types.ProtocolUDP, DstPort: 9984}}},
+			},
+		},
+	}
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	defer provider.Shutdown(t.Context())
+
+	e, err := New(cfg, WithMeterProvider(provider))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer e.Shutdown(t.Context())
+	if err := e.Start(t.Context()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(t.Context(), &rm); err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	tables := map[string]string{}
+	infos := 0
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name == "flow.info" {
+				infos = len(m.Data.(metricdata.Gauge[int64]).DataPoints)
+			}
+			if m.Name != "flow.packets" {
+				continue
+			}
+			for _, point := range m.Data.(metricdata.Gauge[int64]).DataPoints {
+				label, _ := point.Attributes.Value("label")
+				table, _ := point.Attributes.Value("table")
+				tables[label.AsString()] = table.AsString()
+			}
+		}
+	}
+	if tables["web"] != "test_table_web" || tables["db"] != "test_table_db" {
+		t.Errorf("expected each counter tagged with its table, got %v", tables)
+	}
+	if infos != 2 {
+		t.Errorf("expected a flow.info series per table, got %d", infos)
+	}
+
+	if err := e.ReloadTables(cfg.Tables[:1]); err == nil {
+		t.Error("expected removing a table by a reload to fail")
+	}
+	if err := e.ReloadCounters(&types.Counters{}); err == nil {
+		t.Error("expected ReloadCounters to fail with several tables")
+	}
+	cfg.Tables[1].Counters.Output = nil
+	if err := e.ReloadTables(cfg.Tables); err != nil {
+		t.Fatalf("ReloadTables: %v", err)
+	}
+	counters, err := e.tables[1].conn.GetCounters()
+	if err != nil {
+		t.Fatalf("GetCounters: %v", err)
+	}
+	if len(counters.Output) != 0 {
+		t.Errorf("expected the db counter to be removed, got %v", counters.Output)
+	}
+}
+
+func TestWithGlobalMeterProvider(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	cfg := &types.Config{
+		NFTables: types.NFTables{Family: types.TableFamilyIPv4, TableName: "test_table_global"},
+		Counters: types.Counters{
+			Input: []types.Counter{{Label: "dns", Protocol: types.ProtocolUDP, DstPort: 53}},
+		},
+	}
+	provider := sdkmetric.NewMeterProvider()
+	defer provider.Shutdown(t.Context())
+	defer otel.SetMeterProvider(noop.NewMeterProvider())
+
+	for _, global := range []bool{false, true} {
+		opts := []Option{WithMeterProvider(provider)}
+		if global {
+			opts = append(opts, WithGlobalMeterProvider())
+		}
+		e, err := New(cfg, opts...)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		if err := e.Start(t.Context()); err != nil {
+			e.Shutdown(t.Context())
+			t.Fatalf("Start: %v", err)
+		}
+		if isGlobal := otel.GetMeterProvider() == provider; isGlobal != global {
+			t.Errorf("WithGlobalMeterProvider %v: got global provider set %v", global, isGlobal)
+		}
+		if err := e.Shutdown(t.Context()); err != nil {
+			t.Fatalf("Shutdown: %v", err)
+		}
+	}
+}
+
+func TestHeadersHTTP(t *testing.T) {
+	got := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case got <- r.Header.Get("X-Tenant"):
+		default:
+		}
+	}))
+	defer srv.Close()
+
+	exp, err := newHTTPExporter(t.Context(), types.OTLP{
+		Endpoint: srv.URL,
+		Headers:  map[string]string{"X-Tenant": "flowmon"},
+	})
+	if err != nil {
+		t.Fatalf("newHTTPExporter: %v", err)
+	}
+	defer exp.Shutdown(t.Context())
+
+	_ = exp.Export(t.Context(), &metricdata.ResourceMetrics{})
+	if tenant := <-got; tenant != "flowmon" {
+		t.Errorf("expected header X-Tenant=flowmon, got %q", tenant)
+	}
+}
+
+func TestHeadersGRPC(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	got := make(chan []string, 1)
+	srv := grpc.NewServer(grpc.UnknownServiceHandler(func(_ any, stream grpc.ServerStream) error {
+		md, _ := metadata.FromIncomingContext(stream.Context())
+		select {
+		case got <- md.Get("x-tenant"):
+		default:
+		}
+		return status.Error(codes.Unimplemented, "test server")
+	}))
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	exp, err := newGRPCExporter(t.Context(), types.OTLP{
+		Endpoint: lis.Addr().String(),
+		Headers:  map[string]string{"x-tenant": "flowmon"},
+	})
+	if err != nil {
+		t.Fatalf("newGRPCExporter: %v", err)
+	}
+	defer exp.Shutdown(t.Context())
+
+	_ = exp.Export(t.Context(), &metricdata.ResourceMetrics{})
+	if tenant := <-got; len(tenant) != 1 || tenant[0] != "flowmon" {
+		t.Errorf("expected header x-tenant=flowmon, got %q", tenant)
+	}
+}
@@ -0,0 +1,61 @@
+package exporter
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// instanceIDFile returns where the generated service.instance.id is kept:
+// the configured path, or the state directory systemd gives the service.
+func instanceIDFile(path string) string {
+	if path != "" {
+		return path
+	}
+	if dirs := os.Getenv("STATE_DIRECTORY"); dirs != "" {
+		dir, _, _ := strings.Cut(dirs, ":")
+		return filepath.Join(dir, "instance-id")
+	}
+	return ""
+}
+
+// instanceID returns the UUID stored in path, generating and storing one on
+// first use so the instance keeps its identity across restarts. Without a
+// path, or if it cannot be used, the UUID only lasts until flowmon exits.
+func instanceID(path string) string {
+	if path == "" {
+		return uuid.NewString()
+	}
+	id, err := loadInstanceID(path)
+	if err != nil {
+		id = uuid.NewString()
+		slog.Warn("Failed to persist the instance id, it will change on restart", "path", path, "err", err)
+	}
+	return id
+}
+
+func loadInstanceID(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		id, err := uuid.Parse(strings.TrimSpace(string(data)))
+		if err != nil {
+			return "", fmt.Errorf("parse %s: %v", path, err)
+		}
+		return id.String(), nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+
+	id := uuid.NewString()
+	if err := os.WriteFile(path, []byte(id+"\n"), 0o644); err != nil {
+		return "", err
+	}
+	return id, nil
+}
@@ -0,0 +1,97 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nickgarlis/flowmon/types"
+)
+
+// runJSON writes the counters every interval until ctx is done. The counters
+// are read without resetting them, so the dumps do not disturb the metrics,
+// and hold the running totals since flowmon started.
+func (e *Exporter) runJSON(ctx context.Context, cfg types.JSONExport) {
+	interval := time.Duration(cfg.Interval)
+	if interval <= 0 {
+		interval = time.Duration(e.cfg.Exporter.Interval)
+	}
+
+	ticker := e.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			snapshot, err := e.snapshot()
+			if err != nil {
+				slog.Error("Failed to get counters for the JSON export", "err", err)
+				continue
+			}
+			if err := writeCountersJSON(cfg.Path, snapshot); err != nil {
+				slog.Error("Failed to write the JSON export", "path", cfg.Path, "err", err)
+			}
+		}
+	}
+}
+
+// snapshot reads the counters of every table without resetting them. The
+// counters reset by the metrics only hold the traffic since the last
+// collection, which is added to the totals of the metrics. Tables flowmon
+// does not manage report the totals of their rules. With more than one
+// table each counter names its table.
+func (e *Exporter) snapshot() ([]types.CounterSnapshot, error) {
+	e.readMu.Lock()
+	defer e.readMu.Unlock()
+
+	snapshot := []types.CounterSnapshot{}
+	for _, t := range e.tables {
+		counters, err := t.conn.GetCounters()
+		if err != nil {
+			return nil, e.tableError(t, err)
+		}
+		for _, s := range counters.Snapshot() {
+			// The rules of a table flowmon does not manage are never
+			// reset and already hold the totals.
+			if t.cfg.Managed() {
+				set, _ := e.counterSet(t.conn.TableName(), s.Counter)
+				total := e.totals.current(set, s.Packets, s.Bytes)
+				s.Packets, s.Bytes = total.packets, total.bytes
+			}
+			if len(e.tables) > 1 {
+				s.Table = t.conn.TableName()
+			}
+			snapshot = append(snapshot, s)
+		}
+	}
+	return snapshot, nil
+}
+
+// writeCountersJSON writes snapshot to path, or to stdout if path is empty or
+// "-". The file is replaced atomically, so readers never see a partial dump.
+func writeCountersJSON(path string, snapshot []types.CounterSnapshot) error {
+	if path == "" || path == "-" {
+		return json.NewEncoder(os.Stdout).Encode(snapshot)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".flowmon-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := json.NewEncoder(tmp).Encode(snapshot); err != nil {
+		tmp.Close()
+		return fmt.Errorf("encode counters: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,205 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nickgarlis/flowmon/nft"
+	"github.com/nickgarlis/flowmon/types"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestWriteCountersJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "counters.json")
+	counters := &types.Counters{
+		Input: []types.Counter{{
+			Label:    "https",
+			Protocol: types.ProtocolTCP,
+			DstPort:  443,
+			SrcAddr:  netip.MustParseAddr("192.0.2.1"),
+			Dir:      "input",
+			Packets:  3,
+			Bytes:    180,
+		}},
+	}
+
+	if err := writeCountersJSON(path, counters.Snapshot()); err != nil {
+		t.Fatalf("writeCountersJSON: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read dump: %v", err)
+	}
+	var got []map[string]any
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("invalid JSON %s: %v", data, err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected one counter, got %s", data)
+	}
+
+	want := map[string]any{
+		"label":     "https",
+		"protocol":  "tcp",
+		"dst_port":  float64(443),
+		"src_addr":  "192.0.2.1",
+		"direction": "input",
+		"packets":   float64(3),
+		"bytes":     float64(180),
+	}
+	for key, value := range want {
+		if got[0][key] != value {
+			t.Errorf("%s: expected %v, got %v", key, value, got[0][key])
+		}
+	}
+	for _, key := range []string{"dst_addr", "src_port_range", "limit"} {
+		if _, ok := got[0][key]; ok {
+			t.Errorf("expected unset field %s to be omitted, got %s", key, data)
+		}
+	}
+}
+
+type fakeClock struct {
+	now   time.Time
+	ticks chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) NewTicker(time.Duration) Ticker { return fakeTicker{c.ticks} }
+
+type fakeTicker struct{ c chan time.Time }
+
+func (t fakeTicker) C() <-chan time.Time { return t.c }
+
+func (t fakeTicker) Stop() {}
+
+func TestRunJSON(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	path := filepath.Join(t.TempDir(), "counters.json")
+	cfg := &types.Config{
+		NFTables: types.NFTables{Family: types.TableFamilyIPv4, TableName: "test_table_json"},
+		Counters: types.Counters{
+			Input: []types.Counter{{Label: "dns", Protocol: types.ProtocolUDP, DstPort: 53}},
+		},
+	}
+	clock := &fakeClock{now: time.Now(), ticks: make(chan time.Time)}
+	e, err := New(cfg, WithClock(clock))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer e.Shutdown(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		e.runJSON(ctx, types.JSONExport{Path: path, Interval: types.Duration(time.Hour)})
+		close(done)
+	}()
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected no dump before the first tick, got %v", err)
+	}
+	// The second tick is only received once the first dump is written.
+	clock.ticks <- clock.now
+	clock.ticks <- clock.now
+	cancel()
+	<-done
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read dump: %v", err)
+	}
+	var got []map[string]any
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("invalid JSON %s: %v", data, err)
+	}
+	if len(got) != 1 || got[0]["label"] != "dns" {
+		t.Errorf("expected the dns counter, got %s", data)
+	}
+}
+
+func TestSnapshotReadOnly(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	counters := &types.Counters{
+		Output: []types.Counter{{Label: "udp", Protocol: types.ProtocolUDP, DstPort: 9982}},
+	}
+	owner, err := nft.New(&nft.Config{TableFamily: types.TableFamilyIPv4, TableName: "test_table_json_read_only"})
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	if err := owner.Setup(counters); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	defer owner.Cleanup()
+
+	manage := false
+	cfg := &types.Config{
+		Exporter: types.Exporter{Interval: types.Duration(10 * time.Second)},
+		NFTables: types.NFTables{Family: types.TableFamilyIPv4, TableName: "test_table_json_read_only", Manage: &manage},
+	}
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	defer provider.Shutdown(t.Context())
+
+	clock := &fakeClock{now: time.Now(), ticks: make(chan time.Time)}
+	e, err := New(cfg, WithMeterProvider(provider), WithClock(clock))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer e.Shutdown(t.Context())
+	if err := e.Start(t.Context()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	send := func(n int) {
+		t.Helper()
+		for range n {
+			conn, err := net.Dial("udp", "127.0.0.1:9982")
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			conn.Write([]byte("x"))
+			conn.Close()
+		}
+	}
+	collect := func() {
+		t.Helper()
+		// Collections further apart than the window read the counters
+		// again.
+		clock.now = clock.now.Add(10 * time.Second)
+		var rm metricdata.ResourceMetrics
+		if err := reader.Collect(t.Context(), &rm); err != nil {
+			t.Fatalf("Collect: %v", err)
+		}
+	}
+
+	// The metrics report the traffic since the previous collection, the
+	// JSON export the totals of the rule.
+	send(2)
+	collect()
+	send(3)
+	collect()
+
+	snapshot, err := e.snapshot()
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	if len(snapshot) != 1 || snapshot[0].Packets != 5 {
+		t.Errorf("expected the 5 packets counted by the rule, got %+v", snapshot)
+	}
+}
@@ -0,0 +1,71 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/metric"
+	"golang.org/x/sys/unix"
+)
+
+func (e *Exporter) registerProcessMetrics() error {
+	cpuCounter, err := e.meter.Float64ObservableCounter(
+		"flowmon.process.cpu",
+		metric.WithDescription("CPU time consumed by the flowmon process"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create process cpu counter: %w", err)
+	}
+
+	memoryGauge, err := e.meter.Int64ObservableGauge(
+		"flowmon.process.memory",
+		metric.WithDescription("Resident memory of the flowmon process"),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create process memory gauge: %w", err)
+	}
+
+	_, err = e.meter.RegisterCallback(func(ctx context.Context, o metric.Observer) error {
+		var usage unix.Rusage
+		if err := unix.Getrusage(unix.RUSAGE_SELF, &usage); err != nil {
+			return fmt.Errorf("failed to get resource usage: %v", err)
+		}
+		cpu := float64(usage.Utime.Nano()+usage.Stime.Nano()) / 1e9
+		o.ObserveFloat64(cpuCounter, cpu)
+
+		rss, err := residentMemory()
+		if err != nil {
+			return fmt.Errorf("failed to get resident memory: %v", err)
+		}
+		o.ObserveInt64(memoryGauge, rss)
+
+		return nil
+	}, cpuCounter, memoryGauge)
+	if err != nil {
+		return fmt.Errorf("failed to register process callback: %w", err)
+	}
+
+	return nil
+}
+
+// residentMemory returns the resident set size of the process in bytes.
+func residentMemory() (int64, error) {
+	statm, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(statm))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("unexpected /proc/self/statm format")
+	}
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return pages * int64(os.Getpagesize()), nil
+}
@@ -0,0 +1,47 @@
+package exporter
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+func TestListenPrometheus(t *testing.T) {
+	reader, server, err := listenPrometheus("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listenPrometheus: %v", err)
+	}
+	defer server.Shutdown(context.Background())
+
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	defer provider.Shutdown(context.Background())
+
+	_, err = provider.Meter("flowmon").Int64ObservableGauge("flow.packets",
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(42)
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatalf("failed to create gauge: %v", err)
+	}
+
+	resp, err := http.Get("http://" + server.Addr + "/metrics")
+	if err != nil {
+		t.Fatalf("scrape: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+
+	if !strings.Contains(string(body), "flow_packets") || !strings.Contains(string(body), " 42") {
+		t.Errorf("expected flow_packets 42 in the scrape, got:\n%s", body)
+	}
+}
@@ -0,0 +1,47 @@
+package exporter
+
+import (
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// flowRates turns the packets and bytes read since the previous collection
+// into per second rates. It remembers when each attribute set was last seen,
+// so counters added by a reload get their first rate one cycle later. The
+// values read are already deltas, and a counter reset by someone else reads
+// as the traffic since the reset, so rates never go negative.
+type flowRates struct {
+	mu   sync.Mutex
+	last map[attribute.Distinct]time.Time
+}
+
+type flowRate struct {
+	packets float64
+	bytes   float64
+}
+
+func newFlowRates() *flowRates {
+	return &flowRates{last: map[attribute.Distinct]time.Time{}}
+}
+
+// observe records that packets and bytes were read for set at now and
+// returns their rate. ok is false on the first observation of set, which has
+// no interval to divide by.
+func (r *flowRates) observe(set attribute.Set, packets, bytes uint64, now time.Time) (rate flowRate, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	last, seen := r.last[set.Equivalent()]
+	r.last[set.Equivalent()] = now
+	elapsed := now.Sub(last).Seconds()
+	if !seen || elapsed <= 0 {
+		return flowRate{}, false
+	}
+
+	return flowRate{
+		packets: float64(packets) / elapsed,
+		bytes:   float64(bytes) / elapsed,
+	}, true
+}
@@ -0,0 +1,30 @@
+package exporter
+
+import (
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func TestFlowRates(t *testing.T) {
+	rates := newFlowRates()
+	web := attribute.NewSet(attribute.String("label", "web"))
+	start := time.Unix(1000, 0)
+
+	if _, ok := rates.observe(web, 10, 1000, start); ok {
+		t.Errorf("expected no rate on the first observation")
+	}
+
+	got, ok := rates.observe(web, 20, 3000, start.Add(10*time.Second))
+	if !ok {
+		t.Fatalf("expected a rate on the second observation")
+	}
+	if got.packets != 2 || got.bytes != 300 {
+		t.Errorf("expected 2 packets/s and 300 bytes/s, got %v and %v", got.packets, got.bytes)
+	}
+
+	if _, ok := rates.observe(web, 1, 1, start.Add(10*time.Second)); ok {
+		t.Errorf("expected no rate without elapsed time")
+	}
+}
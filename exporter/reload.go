@@ -0,0 +1,59 @@
+package exporter
+
+import (
+	"context"
+	"sync"
+
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// reloadableExporter forwards to an exporter that can be replaced at runtime.
+// The reader and its aggregation state stay in place, so swapping the
+// exporter does not reset any counters.
+type reloadableExporter struct {
+	mu  sync.RWMutex
+	exp sdkmetric.Exporter
+}
+
+func newReloadableExporter(exp sdkmetric.Exporter) *reloadableExporter {
+	return &reloadableExporter{exp: exp}
+}
+
+func (r *reloadableExporter) current() sdkmetric.Exporter {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.exp
+}
+
+// swap replaces the exporter and shuts down the previous one once in-flight
+// exports have completed.
+func (r *reloadableExporter) swap(ctx context.Context, exp sdkmetric.Exporter) error {
+	r.mu.Lock()
+	old := r.exp
+	r.exp = exp
+	r.mu.Unlock()
+	return old.Shutdown(ctx)
+}
+
+func (r *reloadableExporter) Temporality(kind sdkmetric.InstrumentKind) metricdata.Temporality {
+	return r.current().Temporality(kind)
+}
+
+func (r *reloadableExporter) Aggregation(kind sdkmetric.InstrumentKind) sdkmetric.Aggregation {
+	return r.current().Aggregation(kind)
+}
+
+func (r *reloadableExporter) Export(ctx context.Context, rm *metricdata.ResourceMetrics) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.exp.Export(ctx, rm)
+}
+
+func (r *reloadableExporter) ForceFlush(ctx context.Context) error {
+	return r.current().ForceFlush(ctx)
+}
+
+func (r *reloadableExporter) Shutdown(ctx context.Context) error {
+	return r.current().Shutdown(ctx)
+}
@@ -0,0 +1,69 @@
+package exporter
+
+import (
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// flowTotals keeps running packet and byte totals per attribute set. The
+// nftables counters are reset on every read, so the monotonic counters are
+// the sum of all reads since startup.
+type flowTotals struct {
+	mu     sync.Mutex
+	totals map[attribute.Distinct]flowTotal
+	reset  map[attribute.Distinct]bool // whether the counters are reset on read
+}
+
+type flowTotal struct {
+	packets uint64
+	bytes   uint64
+}
+
+func newFlowTotals() *flowTotals {
+	return &flowTotals{totals: map[attribute.Distinct]flowTotal{}, reset: map[attribute.Distinct]bool{}}
+}
+
+// add adds packets and bytes to the totals of set and returns the new totals.
+func (t *flowTotals) add(set attribute.Set, packets, bytes uint64) flowTotal {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	total := t.totals[set.Equivalent()]
+	total.packets += packets
+	total.bytes += bytes
+	t.totals[set.Equivalent()] = total
+	t.reset[set.Equivalent()] = true
+	return total
+}
+
+// replace stores packets and bytes as the totals of set and returns the
+// traffic since the previous call. It is used when the nftables counters are
+// not reset and already hold the totals. Totals that went down belong to a
+// recreated rule, which counted from zero.
+func (t *flowTotals) replace(set attribute.Set, packets, bytes uint64) flowTotal {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	prev := t.totals[set.Equivalent()]
+	t.totals[set.Equivalent()] = flowTotal{packets: packets, bytes: bytes}
+	t.reset[set.Equivalent()] = false
+	if packets < prev.packets || bytes < prev.bytes {
+		return flowTotal{packets: packets, bytes: bytes}
+	}
+	return flowTotal{packets: packets - prev.packets, bytes: bytes - prev.bytes}
+}
+
+// current returns the totals of set given packets and bytes read from the
+// counters without resetting them. Counters that are reset on read only hold
+// the traffic since the last read, which is added to the totals.
+func (t *flowTotals) current(set attribute.Set, packets, bytes uint64) flowTotal {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.reset[set.Equivalent()] {
+		return flowTotal{packets: packets, bytes: bytes}
+	}
+	total := t.totals[set.Equivalent()]
+	return flowTotal{packets: total.packets + packets, bytes: total.bytes + bytes}
+}
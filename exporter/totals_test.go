@@ -0,0 +1,54 @@
+package exporter
+
+import (
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func TestFlowTotals(t *testing.T) {
+	totals := newFlowTotals()
+	web := attribute.NewSet(attribute.String("label", "web"))
+	dns := attribute.NewSet(attribute.String("label", "dns"))
+
+	totals.add(web, 2, 200)
+	totals.add(dns, 1, 60)
+	got := totals.add(attribute.NewSet(attribute.String("label", "web")), 3, 300)
+
+	if got.packets != 5 || got.bytes != 500 {
+		t.Errorf("expected 5 packets and 500 bytes, got %d and %d", got.packets, got.bytes)
+	}
+}
+
+func TestFlowTotalsReplace(t *testing.T) {
+	totals := newFlowTotals()
+	web := attribute.NewSet(attribute.String("label", "web"))
+
+	totals.replace(web, 2, 200)
+	if got := totals.replace(web, 5, 500); got.packets != 3 || got.bytes != 300 {
+		t.Errorf("expected 3 packets and 300 bytes since the previous read, got %d and %d", got.packets, got.bytes)
+	}
+	// The rule was recreated and counts from zero again.
+	if got := totals.replace(web, 1, 100); got.packets != 1 || got.bytes != 100 {
+		t.Errorf("expected 1 packet and 100 bytes after a reset, got %d and %d", got.packets, got.bytes)
+	}
+}
+
+func TestFlowTotalsCurrent(t *testing.T) {
+	totals := newFlowTotals()
+	web := attribute.NewSet(attribute.String("label", "web"))
+	dns := attribute.NewSet(attribute.String("label", "dns"))
+
+	// Nothing was reset yet, the counters hold everything.
+	if got := totals.current(web, 2, 200); got.packets != 2 || got.bytes != 200 {
+		t.Errorf("expected 2 packets and 200 bytes before the first read, got %d and %d", got.packets, got.bytes)
+	}
+	totals.add(web, 2, 200)
+	if got := totals.current(web, 1, 100); got.packets != 3 || got.bytes != 300 {
+		t.Errorf("expected 3 packets and 300 bytes after a reset, got %d and %d", got.packets, got.bytes)
+	}
+	totals.replace(dns, 5, 500)
+	if got := totals.current(dns, 6, 600); got.packets != 6 || got.bytes != 600 {
+		t.Errorf("expected the 6 packets and 600 bytes of a cumulative counter, got %d and %d", got.packets, got.bytes)
+	}
+}
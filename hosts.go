@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/nickgarlis/flowmon/types"
+)
+
+// hostLookupTimeout bounds resolving all the hostnames of a configuration.
+const hostLookupTimeout = 10 * time.Second
+
+// lookupHost resolves a hostname, replaced in tests.
+var lookupHost = func(ctx context.Context, host string) ([]netip.Addr, error) {
+	return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+}
+
+// resolveHosts replaces the src_host and dst_host of the counters with the
+// addresses they resolve to in the family of their table, one counter per
+// address. The addresses are looked up once, when the configuration is
+// loaded.
+func resolveHosts(cfg *types.Config) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hostLookupTimeout)
+	defer cancel()
+
+	r := &hostResolver{ctx: ctx, cache: map[string][]netip.Addr{}}
+	if err := r.resolve(&cfg.Counters, cfg.NFTables.Family); err != nil {
+		return err
+	}
+	for i := range cfg.Tables {
+		if err := r.resolve(&cfg.Tables[i].Counters, cfg.Tables[i].Family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type hostResolver struct {
+	ctx   context.Context
+	cache map[string][]netip.Addr
+}
+
+func (r *hostResolver) resolve(counters *types.Counters, family types.TableFamily) error {
+	for _, list := range []*[]types.Counter{&counters.Input, &counters.Output, &counters.Forward} {
+		if !slices.ContainsFunc(*list, func(c types.Counter) bool { return c.SrcHost != "" || c.DstHost != "" }) {
+			continue
+		}
+		var expanded []types.Counter
+		for _, counter := range *list {
+			resolved, err := r.expand(counter, family)
+			if err != nil {
+				return fmt.Errorf("counter %q: %w", counter.Label, err)
+			}
+			expanded = append(expanded, resolved...)
+		}
+		*list = expanded
+	}
+	return nil
+}
+
+// expand returns counter once for every pair of source and destination
+// addresses its hosts resolve to. With more than one, the addresses are
+// appended to the label to tell the counters apart.
+func (r *hostResolver) expand(counter types.Counter, family types.TableFamily) ([]types.Counter, error) {
+	srcs, err := r.addrs("src", counter.SrcHost, counter.SrcAddr, &counter, family)
+	if err != nil {
+		return nil, err
+	}
+	dsts, err := r.addrs("dst", counter.DstHost, counter.DstAddr, &counter, family)
+	if err != nil {
+		return nil, err
+	}
+
+	var counters []types.Counter
+	for _, src := range srcs {
+		for _, dst := range dsts {
+			// In an inet table a packet has addresses of one family.
+			if src.IsValid() && dst.IsValid() && src.Is4() != dst.Is4() {
+				continue
+			}
+			c := counter
+			c.SrcHost, c.DstHost = "", ""
+			c.SrcAddr, c.DstAddr = src, dst
+			if len(srcs)*len(dsts) > 1 {
+				if counter.SrcHost != "" && len(srcs) > 1 {
+					c.Label += "_" + src.String()
+				}
+				if counter.DstHost != "" && len(dsts) > 1 {
+					c.Label += "_" + dst.String()
+				}
+			}
+			counters = append(counters, c)
+		}
+	}
+	if len(counters) == 0 {
+		return nil, fmt.Errorf("src and dst have no addresses of the same family")
+	}
+	return counters, nil
+}
+
+// addrs returns the addresses of host in family, or addr if there is no
+// host.
+func (r *hostResolver) addrs(side, host string, addr netip.Addr, c *types.Counter, family types.TableFamily) ([]netip.Addr, error) {
+	if host == "" {
+		return []netip.Addr{addr}, nil
+	}
+	field := side + "_host"
+	if side == "src" && (c.SrcAddr.IsValid() || c.SrcNet.IsValid() || !c.SrcAddrRange.IsZero() || c.SrcSet != "") ||
+		side == "dst" && (c.DstAddr.IsValid() || c.DstNet.IsValid() || !c.DstAddrRange.IsZero() || c.DstSet != "") {
+		return nil, fmt.Errorf("%s cannot be combined with %s_addr, %s_net, %s_addr_range or %s_set", field, side, side, side, side)
+	}
+
+	resolved, ok := r.cache[host]
+	if !ok {
+		var err error
+		resolved, err = lookupHost(r.ctx, host)
+		if err != nil {
+			return nil, fmt.Errorf("resolve %s %q: %w", field, host, err)
+		}
+		r.cache[host] = resolved
+	}
+
+	// An inet table matches both families.
+	var addrs []netip.Addr
+	for _, a := range resolved {
+		a = a.Unmap()
+		inFamily := family == types.TableFamilyInet || a.Is4() == (family == types.TableFamilyIPv4)
+		if inFamily && !slices.Contains(addrs, a) {
+			addrs = append(addrs, a)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%s %q has no %s address", field, host, family)
+	}
+	slices.SortFunc(addrs, netip.Addr.Compare)
+
+	// A negated match on each address would count the others.
+	if c.IsNegated(side+"_addr") && len(addrs) > 1 {
+		return nil, fmt.Errorf("%s %q resolves to %d addresses and cannot be negated", field, host, len(addrs))
+	}
+	return addrs, nil
+}
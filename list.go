@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/nickgarlis/flowmon/nft"
+	"github.com/nickgarlis/flowmon/types"
+)
+
+// list prints the current value of the counters installed by a running
+// flowmon, table by table. It only reads the rules, so the daemon keeps its counts.
+func list(configPath string, asJSON bool) {
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		os.Exit(1)
+	}
+
+	tables := cfg.CounterTables()
+	snapshot := []types.CounterSnapshot{}
+	for i, t := range tables {
+		nftClient, err := nft.New(nft.ConfigFrom(&t.NFTables))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to connect to nftables: %v\n", err)
+			os.Exit(1)
+		}
+
+		counters, err := nftClient.GetCounters()
+		if errors.Is(err, nft.ErrTableNotFound) {
+			fmt.Fprintf(os.Stderr, "Table %s not found, is flowmon running?\n", t.TableName)
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list counters: %v\n", err)
+			os.Exit(1)
+		}
+
+		// With several tables, each counter names its table in JSON and
+		// each table gets a heading otherwise.
+		if asJSON {
+			for _, s := range counters.Snapshot() {
+				if len(tables) > 1 {
+					s.Table = t.TableName
+				}
+				snapshot = append(snapshot, s)
+			}
+			continue
+		}
+		if len(tables) > 1 {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("table %s %s\n", t.Family, t.TableName)
+		}
+		if err := writeTable(os.Stdout, counters); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write counters: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if asJSON {
+		if err := json.NewEncoder(os.Stdout).Encode(snapshot); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write counters: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+func writeTable(w io.Writer, counters *types.Counters) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DIRECTION\tLABEL\tPROTOCOL\tSOURCE\tDESTINATION\tVERDICT\tPACKETS\tBYTES")
+	for _, c := range counters.All() {
+		protocol := "any"
+		if c.Protocol != 0 {
+			protocol = c.Protocol.String()
+		}
+		verdict := "-"
+		if c.Verdict != "" {
+			verdict = string(c.Verdict)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\n",
+			c.Dir,
+			c.Label,
+			protocol,
+			endpoint(c.SrcAddr, c.SrcNet, c.SrcAddrRange, c.SrcSet, c.SrcPort, c.SrcPortRange),
+			endpoint(c.DstAddr, c.DstNet, c.DstAddrRange, c.DstSet, c.DstPort, c.DstPortRange),
+			verdict,
+			c.Packets,
+			c.Bytes,
+		)
+	}
+	return tw.Flush()
+}
+
+// endpoint formats the address and port a counter matches on one side, using
+// "*" for anything that is not matched and "@name" for a set.
+func endpoint(addr netip.Addr, prefix netip.Prefix, addrs types.AddrRange, set string, port uint16, ports types.PortRange) string {
+	host := "*"
+	if addr.IsValid() {
+		host = addr.String()
+	} else if prefix.IsValid() {
+		host = prefix.String()
+	} else if addrs.IsValid() {
+		host = addrs.String()
+	} else if set != "" {
+		host = "@" + set
+	}
+
+	switch {
+	case port != 0:
+		return host + ":" + strconv.Itoa(int(port))
+	case ports.IsValid():
+		return host + ":" + ports.String()
+	default:
+		return host
+	}
+}
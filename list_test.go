@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/nickgarlis/flowmon/types"
+)
+
+func TestWriteTable(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeTable(&buf, &types.Counters{
+		Input: []types.Counter{
+			{Dir: "input", Label: "https", Protocol: types.ProtocolTCP, DstPort: 443, SrcNet: netip.MustParsePrefix("10.0.0.0/8"), Packets: 3, Bytes: 180},
+		},
+		Output: []types.Counter{
+			{Dir: "output", Label: "all", Verdict: types.VerdictDrop},
+		},
+	})
+	if err != nil {
+		t.Fatalf("writeTable: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected a header and 2 rows, got %q", lines)
+	}
+	if got := strings.Fields(lines[1]); strings.Join(got, " ") != "input https tcp 10.0.0.0/8 *:443 - 3 180" {
+		t.Errorf("unexpected row %q", lines[1])
+	}
+	if got := strings.Fields(lines[2]); strings.Join(got, " ") != "output all any * * drop 0 0" {
+		t.Errorf("unexpected row %q", lines[2])
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+
+	"github.com/nickgarlis/flowmon/types"
+)
+
+// newLogger returns a logger writing to w in the level and format of cfg.
+func newLogger(w io.Writer, cfg types.Log) *slog.Logger {
+	var level slog.Level
+	switch cfg.Level {
+	case types.LogLevelDebug:
+		level = slog.LevelDebug
+	case types.LogLevelWarn:
+		level = slog.LevelWarn
+	case types.LogLevelError:
+		level = slog.LevelError
+	default:
+		level = slog.LevelInfo
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	if cfg.Format == types.LogFormatJSON {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
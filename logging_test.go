@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/nickgarlis/flowmon/types"
+)
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newLogger(&buf, types.Log{Level: types.LogLevelWarn, Format: types.LogFormatJSON})
+
+	logger.Info("dropped")
+	logger.Warn("kept", "table", "flowmon")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected only the warning to be logged, got %q", buf.String())
+	}
+	var got map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+		t.Fatalf("expected a JSON line, got %q: %v", lines[0], err)
+	}
+	if got["msg"] != "kept" || got["level"] != "WARN" || got["table"] != "flowmon" {
+		t.Errorf("unexpected record %v", got)
+	}
+}
@@ -4,13 +4,13 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 
 	"github.com/nickgarlis/flowmon/exporter"
+	"github.com/nickgarlis/flowmon/nft"
 	"github.com/nickgarlis/flowmon/types"
-	"go.yaml.in/yaml/v3"
 	"golang.org/x/sys/unix"
 )
 
@@ -18,63 +18,127 @@ var (
 	version = "dev"
 )
 
-func loadConfig(path string) (*types.Config, error) {
-	yamlFile, err := os.ReadFile(path)
+func start(configPath string) error {
+	ctx, cancel := signal.NotifyContext(context.Background(), unix.SIGINT, unix.SIGTERM)
+	defer cancel()
+
+	cfg, err := loadConfig(configPath)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed to load config: %w", err)
 	}
+	slog.SetDefault(newLogger(os.Stderr, cfg.Log))
 
-	cfg := &types.Config{
-		Version: version,
-		Exporter: types.Exporter{
-			Interval: 10,
-			OTLP: types.OTLP{
-				Endpoint: "localhost:4317",
-				Protocol: types.OTLPProtocolGRPC,
-			},
-		},
-		NFTables: types.NFTables{
-			Family:        types.TableFamilyIPv4,
-			TableName:     "flowmon",
-			ChainPriority: -300,
-		},
-		Counters: types.Counters{
-			Input:  []types.Counter{},
-			Output: []types.Counter{},
-		},
+	exp, err := exporter.New(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to create exporter: %w", err)
 	}
 
-	if err := yaml.Unmarshal(yamlFile, &cfg); err != nil {
-		return nil, err
+	slog.Info("Flowmon starting", "version", cfg.Version)
+	if err := exp.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start exporter: %w", err)
 	}
+	notify("READY=1")
+	if interval := watchdogInterval(); interval > 0 {
+		go watchdog(ctx, interval, exp.Ready)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, unix.SIGHUP)
+	defer signal.Stop(hup)
 
-	return cfg, nil
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-hup:
+			reload(ctx, configPath, exp)
+		}
+	}
+
+	slog.Info("Flowmon stopping")
+	notify("STOPPING=1")
+	if err := exp.Shutdown(context.Background()); err != nil {
+		return fmt.Errorf("failed to shutdown exporter: %w", err)
+	}
+	return nil
 }
 
-func start(configPath string) {
-	ctx, cancel := signal.NotifyContext(context.Background(), unix.SIGINT, unix.SIGTERM)
-	defer cancel()
+// reload applies the counters and log settings of the config file and
+// re-reads the TLS certificates. Whatever fails to load keeps its current
+// state.
+func reload(ctx context.Context, configPath string, exp *exporter.Exporter) {
+	// Stdin was consumed at startup, reading it again would find nothing.
+	var cfg *types.Config
+	var err error
+	if configPath == "-" {
+		slog.Warn("Config was read from stdin, keeping the current counters")
+	} else if cfg, err = loadConfig(configPath); err != nil {
+		slog.Error("Failed to reload config, keeping the current counters", "err", err)
+	} else {
+		slog.SetDefault(newLogger(os.Stderr, cfg.Log))
+		if err := exp.ReloadTables(cfg.CounterTables()); err != nil {
+			slog.Error("Failed to apply counters, keeping the current ones", "err", err)
+		} else {
+			slog.Info("Reloaded counters")
+		}
+	}
 
+	if err := exp.ReloadTLS(ctx); err != nil {
+		slog.Error("Failed to reload TLS certificates, keeping the current ones", "err", err)
+		return
+	}
+	slog.Info("Reloaded TLS certificates")
+}
+
+// validate loads the config and checks it without touching nftables.
+func validate(configPath string) {
 	cfg, err := loadConfig(configPath)
 	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		os.Exit(1)
 	}
 
-	exp, err := exporter.New(cfg)
-	if err != nil {
-		log.Fatalf("Failed to create exporter: %v", err)
+	if err := types.ValidateConfig(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config:\n%v\n", err)
+		os.Exit(1)
 	}
 
-	log.Println("Flowmon starting...")
-	if err := exp.Start(ctx); err != nil {
-		log.Fatalf("Failed to start exporter: %v", err)
+	fmt.Printf("%s is valid\n", configPath)
+}
+
+// dryRun prints the rules start would install, without touching nftables.
+// Tables flowmon does not manage are left out.
+func dryRun(configPath string) {
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		os.Exit(1)
 	}
 
-	<-ctx.Done()
+	var rendered int
+	for _, t := range cfg.CounterTables() {
+		if !t.Managed() {
+			continue
+		}
+		nftClient, err := nft.New(nft.ConfigFrom(&t.NFTables))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create nftables client: %v\n", err)
+			os.Exit(1)
+		}
 
-	log.Println("Flowmon stopping...")
-	if err := exp.Shutdown(context.Background()); err != nil {
-		log.Fatalf("Failed to shutdown exporter: %v", err)
+		script, err := nftClient.Render(&t.Counters)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to build rules: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Print(script)
+		rendered++
+	}
+
+	if rendered == 0 {
+		fmt.Fprintf(os.Stderr, "nftables.manage is false, flowmon does not install any rules\n")
+		os.Exit(1)
 	}
 }
 
@@ -83,6 +147,10 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Usage: %s <command> [options]\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "\nCommands:\n")
 		fmt.Fprintf(os.Stderr, "  start    Start the flowmon daemon\n")
+		fmt.Fprintf(os.Stderr, "  validate Check the config file without applying it\n")
+		fmt.Fprintf(os.Stderr, "  list     Show the current counter values\n")
+		fmt.Fprintf(os.Stderr, "  reset    Zero the counters without touching the rules\n")
+		fmt.Fprintf(os.Stderr, "  dump     Print the installed rules as an nft script\n")
 		fmt.Fprintf(os.Stderr, "  version  Show version information\n")
 		os.Exit(1)
 	}
@@ -90,9 +158,38 @@ func main() {
 	switch os.Args[1] {
 	case "start":
 		startCmd := flag.NewFlagSet("start", flag.ExitOnError)
-		configPath := startCmd.String("config", "/etc/flowmon/config.yaml", "path to config file")
+		configPath := startCmd.String("config", "/etc/flowmon/config.yaml", "path to config file, - for stdin or an http(s) URL")
+		dry := startCmd.Bool("dry-run", false, "print the nftables rules instead of installing them")
 		startCmd.Parse(os.Args[2:])
-		start(*configPath)
+		if *dry {
+			dryRun(*configPath)
+			return
+		}
+		if err := start(*configPath); err != nil {
+			slog.Error("Flowmon failed", "err", err)
+			os.Exit(1)
+		}
+	case "validate":
+		validateCmd := flag.NewFlagSet("validate", flag.ExitOnError)
+		configPath := validateCmd.String("config", "/etc/flowmon/config.yaml", "path to config file, - for stdin or an http(s) URL")
+		validateCmd.Parse(os.Args[2:])
+		validate(*configPath)
+	case "list":
+		listCmd := flag.NewFlagSet("list", flag.ExitOnError)
+		configPath := listCmd.String("config", "/etc/flowmon/config.yaml", "path to config file, - for stdin or an http(s) URL")
+		asJSON := listCmd.Bool("json", false, "print the counters as JSON")
+		listCmd.Parse(os.Args[2:])
+		list(*configPath, *asJSON)
+	case "reset":
+		resetCmd := flag.NewFlagSet("reset", flag.ExitOnError)
+		configPath := resetCmd.String("config", "/etc/flowmon/config.yaml", "path to config file, - for stdin or an http(s) URL")
+		resetCmd.Parse(os.Args[2:])
+		reset(*configPath)
+	case "dump":
+		dumpCmd := flag.NewFlagSet("dump", flag.ExitOnError)
+		configPath := dumpCmd.String("config", "/etc/flowmon/config.yaml", "path to config file, - for stdin or an http(s) URL")
+		dumpCmd.Parse(os.Args[2:])
+		dump(*configPath)
 	case "version":
 		fmt.Printf("flowmon version %s\n", version)
 	default:
@@ -0,0 +1,34 @@
+package nft_test
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/nickgarlis/flowmon/nft"
+	"github.com/nickgarlis/flowmon/types"
+)
+
+// Counters can be managed without the exporter, for example by a daemon that
+// reports them on its own.
+func ExampleConn_Reconcile() {
+	conn, err := nft.New(&nft.Config{TableName: "myapp"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Cleanup()
+
+	counters := &types.Counters{
+		Input: []types.Counter{{Label: "https", Protocol: types.ProtocolTCP, DstPort: 443}},
+	}
+	if err := conn.Reconcile(counters); err != nil {
+		log.Fatal(err)
+	}
+
+	got, err := conn.ListCounters()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, c := range got.All() {
+		fmt.Println(c.Label, c.Packets, c.Bytes)
+	}
+}
@@ -11,7 +11,7 @@ import (
 func getOrCreateTable(conn *nftables.Conn, tableName string, family nftables.TableFamily) (*nftables.Table, error) {
 	table, err := conn.ListTableOfFamily(tableName, family)
 	if err != nil && !errors.Is(err, unix.ENOENT) {
-		return nil, fmt.Errorf("get table %s: %v", tableName, err)
+		return nil, tableError(tableName, err)
 	}
 
 	if table == nil || errors.Is(err, unix.ENOENT) {
@@ -24,20 +24,38 @@ func getOrCreateTable(conn *nftables.Conn, tableName string, family nftables.Tab
 	return table, nil
 }
 
-func getOrCreateChain(conn *nftables.Conn, table *nftables.Table, chain *nftables.Chain) (*nftables.Chain, error) {
+// tableError wraps an error looking up a table. The table is the first thing
+// looked up, so a missing capability is reported here in plain words rather
+// than as a bare netlink error.
+func tableError(tableName string, err error) error {
+	if errors.Is(err, unix.EPERM) {
+		return fmt.Errorf("get table %s: %w", tableName, ErrPermission)
+	}
+	return fmt.Errorf("get table %s: %w", tableName, err)
+}
+
+// getOrCreateChain returns the existing chain if its hook matches the desired
+// one. Otherwise the chain is (re)created and created is true; the hook and
+// priority of a chain cannot be changed in place.
+func getOrCreateChain(conn *nftables.Conn, table *nftables.Table, chain *nftables.Chain) (*nftables.Chain, bool, error) {
 	got, err := conn.ListChain(table, chain.Name)
 	if err != nil && !errors.Is(err, unix.ENOENT) {
-		return nil, fmt.Errorf("get chain %s: %v", chain.Name, err)
+		return nil, false, fmt.Errorf("get chain %s: %v", chain.Name, err)
 	}
 
-	// If the chain exists, replace it
-	// TODO: Could only replace if the existing chain parameters differ
-	// from the desired ones.
 	if got != nil && !errors.Is(err, unix.ENOENT) {
+		if sameHook(got, chain) {
+			return got, false, nil
+		}
 		conn.FlushChain(got)
 		conn.DelChain(got)
 	}
 
-	chain = conn.AddChain(chain)
-	return chain, nil
+	return conn.AddChain(chain), true, nil
+}
+
+func sameHook(got, want *nftables.Chain) bool {
+	return got.Type == want.Type &&
+		got.Hooknum != nil && *got.Hooknum == *want.Hooknum &&
+		got.Priority != nil && *got.Priority == *want.Priority
 }
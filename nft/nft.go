@@ -1,8 +1,12 @@
+// Package nft installs and reads the counter rules of flowmon in an nftables
+// table. Conn can be used on its own to manage counters without exporting them.
 package nft
 
 import (
 	"errors"
 	"fmt"
+	"log/slog"
+	"strings"
 	"sync"
 
 	"github.com/google/nftables"
@@ -10,24 +14,122 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+// ErrTableNotFound and ErrChainNotFound are wrapped by the errors returned
+// when the table or one of its chains does not exist. ErrPermission is
+// wrapped when the kernel refuses access to nftables altogether.
+var (
+	ErrTableNotFound = errors.New("table not found")
+	ErrChainNotFound = errors.New("chain not found")
+	ErrPermission    = errors.New("flowmon requires root or CAP_NET_ADMIN to use nftables")
+)
+
+// Defaults for the fields of Config left unset.
+const (
+	DefaultTableName     = "flowmon"
+	DefaultChainPriority = -300 // raw priority, before conntrack
+)
+
 type Config struct {
 	TableFamily   types.TableFamily
 	TableName     string
 	InputChain    string
 	OutputChain   string
+	ForwardChain  string
 	ChainPriority int32
+	// Per direction priorities, overriding ChainPriority when set.
+	InputPriority   *int32
+	OutputPriority  *int32
+	ForwardPriority *int32
+	// ReadOnly reads the counters of a table managed by someone else. The
+	// table is never modified and its counters are never reset.
+	ReadOnly bool
+	// KeepTable makes Cleanup delete only the chains flowmon manages, and
+	// the table only if it is empty afterwards, so a table shared with
+	// other instances or tools survives.
+	KeepTable bool
+	// NoReset leaves the counters alone on ListCounters, which then
+	// reports their totals like GetCounters. Counters with Reset set
+	// override it.
+	NoReset bool
+	// LabelPrefix is prepended to the comment of every rule written, and
+	// rules whose comment lacks it are ignored. It is removed from the
+	// labels read.
+	LabelPrefix string
 }
 
+// Conn manages the flowmon table. Its methods are safe for concurrent use:
+// those touching the kernel hold mu for their whole run, so a reconcile
+// reads the installed rules and writes its changes in one step, and a read
+// of the counters that recreates missing rules does so before another call
+// can see them.
 type Conn struct {
-	mu            sync.Mutex
-	conn          *nftables.Conn
-	tableFamily   nftables.TableFamily
-	tableName     string
-	inputChain    string
-	outputChain   string
-	chainPriority int32
+	mu           sync.Mutex
+	conn         *nftables.Conn
+	tableFamily  nftables.TableFamily
+	tableName    string
+	inputChain   string
+	outputChain  string
+	forwardChain string
+	priorities   [3]int32 // indexed by direction
+	readOnly     bool
+	keepTable    bool
+	noReset      bool
+	labelPrefix  string
+	seen         map[uint64]counterValue // read-only: last values by rule handle
+	desired      *types.Counters         // last reconciled counters, to recreate the rules
+	resets       map[string]bool         // by rule key, counters overriding noReset
+	skipped      map[string]uint64       // read-only: rules not understood, by reason
+}
+
+type counterValue struct {
+	packets uint64
+	bytes   uint64
 }
 
+// direction is one of the chains flowmon manages.
+type direction int
+
+const (
+	dirInput direction = iota
+	dirOutput
+	dirForward
+)
+
+// String returns the name the direction is exported under, whatever the name
+// of its chain.
+func (d direction) String() string {
+	switch d {
+	case dirOutput:
+		return "output"
+	case dirForward:
+		return "forward"
+	default:
+		return "input"
+	}
+}
+
+// ConfigFrom returns the Config for the nftables section of the
+// configuration file. Defaults for unset fields are applied by New.
+func ConfigFrom(c *types.NFTables) *Config {
+	return &Config{
+		TableFamily:     c.Family,
+		TableName:       c.TableName,
+		ChainPriority:   c.ChainPriority,
+		InputChain:      c.InputChain,
+		OutputChain:     c.OutputChain,
+		ForwardChain:    c.ForwardChain,
+		InputPriority:   c.InputPriority,
+		OutputPriority:  c.OutputPriority,
+		ForwardPriority: c.ForwardPriority,
+		ReadOnly:        !c.Managed(),
+		KeepTable:       c.KeepTable,
+		NoReset:         !c.Resets(),
+		LabelPrefix:     c.LabelPrefix,
+	}
+}
+
+// New opens a netlink connection for the table described by c. The table is
+// not touched until Setup, Reconcile or Check is called.
 func New(c *Config) (*Conn, error) {
 	if c == nil {
 		c = &Config{}
@@ -36,7 +138,7 @@ func New(c *Config) (*Conn, error) {
 		c.TableFamily = types.TableFamilyIPv4
 	}
 	if c.TableName == "" {
-		c.TableName = "flowmon"
+		c.TableName = DefaultTableName
 	}
 	if c.InputChain == "" {
 		c.InputChain = "input"
@@ -44,9 +146,11 @@ func New(c *Config) (*Conn, error) {
 	if c.OutputChain == "" {
 		c.OutputChain = "output"
 	}
+	if c.ForwardChain == "" {
+		c.ForwardChain = "forward"
+	}
 	if c.ChainPriority == 0 {
-		// Default to raw priority -300
-		c.ChainPriority = -300
+		c.ChainPriority = DefaultChainPriority
 	}
 
 	conn, err := nftables.New()
@@ -55,105 +159,357 @@ func New(c *Config) (*Conn, error) {
 	}
 
 	return &Conn{
-		conn:          conn,
-		tableFamily:   nftables.TableFamily(c.TableFamily),
-		tableName:     c.TableName,
-		inputChain:    c.InputChain,
-		outputChain:   c.OutputChain,
-		chainPriority: c.ChainPriority,
+		conn:         conn,
+		tableFamily:  nftables.TableFamily(c.TableFamily),
+		tableName:    c.TableName,
+		inputChain:   c.InputChain,
+		outputChain:  c.OutputChain,
+		forwardChain: c.ForwardChain,
+		priorities: [3]int32{
+			priorityOr(c.InputPriority, c.ChainPriority),
+			priorityOr(c.OutputPriority, c.ChainPriority),
+			priorityOr(c.ForwardPriority, c.ChainPriority),
+		},
+		readOnly:    c.ReadOnly,
+		keepTable:   c.KeepTable,
+		noReset:     c.NoReset,
+		labelPrefix: c.LabelPrefix,
+		seen:        map[uint64]counterValue{},
 	}, nil
 }
 
+// TableName returns the name of the table, with the default applied.
+func (n *Conn) TableName() string {
+	return n.tableName
+}
+
+// Setup installs the rules for counters. Rules left by a previous run that
+// match a counter are kept, so their packet and byte counts carry over.
 func (n *Conn) Setup(counters *types.Counters) error {
-	n.mu.Lock()
-	defer n.mu.Unlock()
+	return n.Reconcile(counters)
+}
 
-	table, err := getOrCreateTable(n.conn, n.tableName, n.tableFamily)
-	if err != nil {
-		return err
-	}
+// ListCounters returns the counters and resets them, so every call reports
+// the traffic seen since the previous one. In read-only mode the counters are
+// left alone and the difference to the previous call is reported instead.
+// With NoReset, or Reset set to false on a counter, it returns the totals like
+// GetCounters and marks the counters Cumulative.
+func (n *Conn) ListCounters() (*types.Counters, error) {
+	return n.counters(true)
+}
 
-	if err := n.setupChain(n.conn, table, true, counters.Input); err != nil {
-		return err
-	}
-	if err := n.setupChain(n.conn, table, false, counters.Output); err != nil {
-		return err
-	}
+// GetCounters returns the counters without resetting them.
+func (n *Conn) GetCounters() (*types.Counters, error) {
+	return n.counters(false)
+}
 
-	if err := n.conn.Flush(); err != nil {
-		return fmt.Errorf("flush: %v", err)
-	}
+// Skipped returns how many times rules were skipped while reading the
+// counters of a table flowmon does not manage, by the reason they could not
+// be read.
+func (n *Conn) Skipped() map[string]uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
 
-	return nil
+	skipped := make(map[string]uint64, len(n.skipped))
+	for reason, count := range n.skipped {
+		skipped[reason] = count
+	}
+	return skipped
 }
 
-func (n *Conn) ListCounters() (*types.Counters, error) {
+// counters reads the counters, resetting them as configured if list is set.
+func (n *Conn) counters(list bool) (*types.Counters, error) {
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
+	counters, err := n.readCounters(list)
+	// Someone deleted the table or one of its chains. The counts are lost,
+	// but the rules can be put back so the metrics keep flowing.
+	missing := errors.Is(err, ErrTableNotFound) || errors.Is(err, ErrChainNotFound)
+	if missing && !n.readOnly && n.desired != nil {
+		slog.Warn("Rules are missing, recreating them", "table", n.tableName, "err", err)
+		if err := n.reconcile(n.desired); err != nil {
+			return nil, fmt.Errorf("recreate table %s: %w", n.tableName, err)
+		}
+		return n.readCounters(list)
+	}
+	return counters, err
+}
+
+func (n *Conn) readCounters(list bool) (*types.Counters, error) {
 	table, err := n.conn.ListTableOfFamily(n.tableName, n.tableFamily)
+	if errors.Is(err, unix.ENOENT) {
+		return nil, fmt.Errorf("get table %s: %w", n.tableName, ErrTableNotFound)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("get table %s: %v", n.tableName, err)
+		return nil, tableError(n.tableName, err)
 	}
 
-	inputRules, err := n.listCounters(n.conn, table, true)
-	if err != nil {
-		return nil, err
+	seen := map[uint64]counterValue{}
+	counters := &types.Counters{}
+	for _, dir := range []direction{dirInput, dirOutput, dirForward} {
+		rules, err := n.listCounters(n.conn, table, dir, list, seen)
+		// The forward chain only exists when forward counters are
+		// configured, and a foreign table need not have all chains.
+		if errors.Is(err, ErrChainNotFound) && (dir == dirForward || n.readOnly) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch dir {
+		case dirInput:
+			counters.Input = rules
+		case dirOutput:
+			counters.Output = rules
+		case dirForward:
+			counters.Forward = rules
+		}
 	}
 
-	outputRules, err := n.listCounters(n.conn, table, false)
-	if err != nil {
-		return nil, err
+	if list && n.readOnly && !n.noReset {
+		n.seen = seen
 	}
 
-	return &types.Counters{
-		Input:  inputRules,
-		Output: outputRules,
-	}, nil
+	return counters, nil
 }
 
-func (n *Conn) listCounters(conn *nftables.Conn, table *nftables.Table, input bool) ([]types.Counter, error) {
-	chainName := n.inputChain
-	if !input {
-		chainName = n.outputChain
-	}
+func (n *Conn) listCounters(conn *nftables.Conn, table *nftables.Table, dir direction, list bool, seen map[uint64]counterValue) ([]types.Counter, error) {
+	chainName := n.chainName(dir)
 
 	chain, err := conn.ListChain(table, chainName)
+	if errors.Is(err, unix.ENOENT) {
+		return nil, fmt.Errorf("get chain %s: %w", chainName, ErrChainNotFound)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("get chain %s: %v", chainName, err)
+		return nil, fmt.Errorf("get chain %s: %w", chainName, err)
 	}
 
-	rules, err := conn.ResetRules(table, chain)
+	reset := list && !n.noReset
+	// Counters overriding the default are reset one rule at a time, as
+	// are the ones of a chain shared with rules of other tools.
+	perRule := list && !n.readOnly && (len(n.resets) > 0 || n.labelPrefix != "")
+
+	var rules []*nftables.Rule
+	if reset && !n.readOnly && !perRule {
+		rules, err = conn.ResetRules(table, chain)
+	} else {
+		rules, err = conn.GetRules(table, chain)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("reset %s rules: %v", chainName, err)
+		return nil, fmt.Errorf("list %s rules: %v", chainName, err)
 	}
 
 	var counters []types.Counter
 	for _, rule := range rules {
 		counter, err := unmarshalRule(rule)
 		if err != nil {
+			// A table managed by someone else, or a chain shared with
+			// other tools, can hold any rule. Only the ones flowmon
+			// understands are reported.
+			if n.readOnly || n.labelPrefix != "" {
+				slog.Debug("Skipping rule", "chain", chainName, "handle", rule.Handle, "reason", err)
+				if n.skipped == nil {
+					n.skipped = map[string]uint64{}
+				}
+				n.skipped[err.Error()]++
+				continue
+			}
 			return nil, fmt.Errorf("unmarshalRule: %v", err)
 		}
-		counter.Dir = chainName
+		if !n.ownLabel(counter) {
+			slog.Debug("Skipping rule without the label prefix", "chain", chainName, "handle", rule.Handle, "label", counter.Label)
+			continue
+		}
+		switch {
+		case n.readOnly && reset:
+			seen[rule.Handle] = counterValue{counter.Packets, counter.Bytes}
+			n.since(rule.Handle, counter)
+		case perRule:
+			if counter, err = n.resetRule(conn, table, chain, rule, counter); err != nil {
+				return nil, err
+			}
+		default:
+			counter.Cumulative = !reset
+		}
+		counter.Dir = dir.String()
+		counter.Chain = chainName
 		counters = append(counters, *counter)
 	}
 
 	return counters, nil
 }
 
+// resetRule resets rule if its counter is to be reset, and returns the
+// counter with the values read by the reset.
+func (n *Conn) resetRule(conn *nftables.Conn, table *nftables.Table, chain *nftables.Chain, rule *nftables.Rule, counter *types.Counter) (*types.Counter, error) {
+	reset, ok := n.resets[counter.Key()]
+	if !ok {
+		reset = !n.noReset
+	}
+	if !reset {
+		counter.Cumulative = true
+		return counter, nil
+	}
+
+	rule, err := conn.ResetRule(table, chain, rule.Handle)
+	if err != nil {
+		return nil, fmt.Errorf("reset rule %q: %v", counter.Label, err)
+	}
+	counter, err = unmarshalRule(rule)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshalRule: %v", err)
+	}
+	n.ownLabel(counter)
+	return counter, nil
+}
+
+// ownLabel removes the label prefix from the label of counter. It reports
+// false if the label lacks it, for a rule flowmon does not own.
+func (n *Conn) ownLabel(counter *types.Counter) bool {
+	label, ok := strings.CutPrefix(counter.Label, n.labelPrefix)
+	counter.Label = label
+	return ok
+}
+
+// since replaces the values of counter with the traffic seen since the
+// previous read. A rule seen for the first time starts at zero, like a
+// freshly created one.
+func (n *Conn) since(handle uint64, counter *types.Counter) {
+	prev, ok := n.seen[handle]
+	if !ok {
+		counter.Packets, counter.Bytes = 0, 0
+		return
+	}
+	// Someone else reset the counter, everything was seen since.
+	if counter.Packets < prev.packets || counter.Bytes < prev.bytes {
+		return
+	}
+	counter.Packets -= prev.packets
+	counter.Bytes -= prev.bytes
+}
+
+// ResetCounters zeroes the counters of the rules in place and returns how
+// many were reset. The rules themselves are left untouched. It fails in
+// read-only mode, where the counters belong to someone else.
+func (n *Conn) ResetCounters() (int, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.readOnly {
+		return 0, fmt.Errorf("table %s is not managed by flowmon, its counters are never reset", n.tableName)
+	}
+
+	table, err := n.conn.ListTableOfFamily(n.tableName, n.tableFamily)
+	if errors.Is(err, unix.ENOENT) {
+		return 0, fmt.Errorf("get table %s: %w", n.tableName, ErrTableNotFound)
+	}
+	if err != nil {
+		return 0, tableError(n.tableName, err)
+	}
+
+	reset := 0
+	for _, dir := range []direction{dirInput, dirOutput, dirForward} {
+		chainName := n.chainName(dir)
+		chain, err := n.conn.ListChain(table, chainName)
+		// The forward chain only exists with forward counters.
+		if errors.Is(err, unix.ENOENT) && dir == dirForward {
+			continue
+		}
+		if errors.Is(err, unix.ENOENT) {
+			return reset, fmt.Errorf("get chain %s: %w", chainName, ErrChainNotFound)
+		}
+		if err != nil {
+			return reset, fmt.Errorf("get chain %s: %v", chainName, err)
+		}
+
+		if n.labelPrefix != "" {
+			count, err := n.resetOwnRules(table, chain)
+			reset += count
+			if err != nil {
+				return reset, err
+			}
+			continue
+		}
+		rules, err := n.conn.ResetRules(table, chain)
+		if err != nil {
+			return reset, fmt.Errorf("reset %s rules: %v", chainName, err)
+		}
+		reset += len(rules)
+	}
+	return reset, nil
+}
+
+// resetOwnRules resets the rules of chain carrying the label prefix, leaving
+// the counters of other rules alone.
+func (n *Conn) resetOwnRules(table *nftables.Table, chain *nftables.Chain) (int, error) {
+	rules, err := n.conn.GetRules(table, chain)
+	if err != nil {
+		return 0, fmt.Errorf("list %s rules: %v", chain.Name, err)
+	}
+	reset := 0
+	for _, rule := range rules {
+		counter, err := unmarshalRule(rule)
+		if err != nil || !n.ownLabel(counter) {
+			continue
+		}
+		if _, err := n.conn.ResetRule(table, chain, rule.Handle); err != nil {
+			return reset, fmt.Errorf("reset rule %q: %v", counter.Label, err)
+		}
+		reset++
+	}
+	return reset, nil
+}
+
+// Check verifies that the table exists and has at least one of the
+// configured chains. It is used instead of Setup in read-only mode.
+func (n *Conn) Check() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	table, err := n.conn.ListTableOfFamily(n.tableName, n.tableFamily)
+	if errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("table %s: %w", n.tableName, ErrTableNotFound)
+	}
+	if err != nil {
+		return tableError(n.tableName, err)
+	}
+
+	for _, dir := range []direction{dirInput, dirOutput, dirForward} {
+		_, err := n.conn.ListChain(table, n.chainName(dir))
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, unix.ENOENT) {
+			return fmt.Errorf("get chain %s: %v", n.chainName(dir), err)
+		}
+	}
+	return fmt.Errorf("table %s has none of the chains %s, %s and %s: %w", n.tableName, n.inputChain, n.outputChain, n.forwardChain, ErrChainNotFound)
+}
+
+// Cleanup removes the table, or only flowmon's chains with KeepTable. It
+// does nothing in read-only mode.
 func (n *Conn) Cleanup() error {
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
+	if n.readOnly {
+		return nil
+	}
+
 	table, err := n.conn.ListTableOfFamily(n.tableName, n.tableFamily)
 	if err != nil && !errors.Is(err, unix.ENOENT) {
-		return fmt.Errorf("get table %s: %v", n.tableName, err)
+		return tableError(n.tableName, err)
 	}
 
 	if table == nil || errors.Is(err, unix.ENOENT) {
 		return nil
 	}
 
+	if n.keepTable {
+		return n.cleanupChains(table)
+	}
+
 	n.conn.FlushTable(table)
 	n.conn.DelTable(table)
 
@@ -164,32 +520,97 @@ func (n *Conn) Cleanup() error {
 	return nil
 }
 
-func (n *Conn) setupChain(conn *nftables.Conn, table *nftables.Table, input bool, rules []types.Counter) error {
-	name := n.inputChain
+// cleanupChains deletes the chains flowmon manages, and the table if no
+// other chains or sets are left in it.
+func (n *Conn) cleanupChains(table *nftables.Table) error {
+	// Queued on a connection of its own, like reconcile.
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	for _, dir := range []direction{dirInput, dirOutput, dirForward} {
+		if err := n.removeChain(conn, table, dir); err != nil {
+			return err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("flush: %v", err)
+	}
+
+	chains, err := n.conn.ListChainsOfTableFamily(n.tableFamily)
+	if err != nil {
+		return fmt.Errorf("list chains: %v", err)
+	}
+	for _, chain := range chains {
+		if chain.Table.Name == n.tableName {
+			return nil
+		}
+	}
+	// Sets looked up by src_set and dst_set are loaded by someone else.
+	sets, err := n.conn.GetSets(table)
+	if err != nil {
+		return fmt.Errorf("list sets: %v", err)
+	}
+	if len(sets) > 0 {
+		return nil
+	}
+
+	n.conn.DelTable(table)
+	if err := n.conn.Flush(); err != nil {
+		return fmt.Errorf("flush: %v", err)
+	}
+	return nil
+}
+
+func priorityOr(p *int32, def int32) int32 {
+	if p != nil {
+		return *p
+	}
+	return def
+}
+
+func (n *Conn) chainName(dir direction) string {
+	switch dir {
+	case dirOutput:
+		return n.outputChain
+	case dirForward:
+		return n.forwardChain
+	default:
+		return n.inputChain
+	}
+}
+
+// chainSpec returns the desired chain for dir.
+func (n *Conn) chainSpec(table *nftables.Table, dir direction) *nftables.Chain {
 	hook := nftables.ChainHookInput
-	if !input {
-		name = n.outputChain
+	switch dir {
+	case dirOutput:
 		hook = nftables.ChainHookOutput
+	case dirForward:
+		hook = nftables.ChainHookForward
 	}
-	priority := nftables.ChainPriority(n.chainPriority)
-	chain, err := getOrCreateChain(conn, table, &nftables.Chain{
-		Name:     name,
+	priority := nftables.ChainPriority(n.priorities[dir])
+	return &nftables.Chain{
+		Name:     n.chainName(dir),
 		Table:    table,
 		Type:     nftables.ChainTypeFilter,
 		Hooknum:  hook,
 		Priority: &priority,
-	})
-	if err != nil {
-		return fmt.Errorf("getOrCreateChain: %v", err)
 	}
+}
 
-	for _, rr := range rules {
-		rule, err := marshalRule(table, chain, &rr)
-		if err != nil {
-			return fmt.Errorf("marshalRule: %v", err)
-		}
-		conn.AddRule(rule)
+// checkInterface rejects interface matches the chain can never see: the
+// output interface is unknown on input and vice versa. Forwarded packets
+// have both. Locally generated packets have no link layer header yet.
+func checkInterface(dir direction, counter *types.Counter) error {
+	if dir == dirOutput && (counter.SrcMac.IsValid() || counter.DstMac.IsValid()) {
+		return fmt.Errorf("counter %q: src_mac and dst_mac cannot be matched on output", counter.Label)
+	}
+	if dir == dirInput && counter.Oif != "" {
+		return fmt.Errorf("counter %q: oif cannot be matched on input", counter.Label)
+	}
+	if dir == dirOutput && counter.Iif != "" {
+		return fmt.Errorf("counter %q: iif cannot be matched on output", counter.Label)
 	}
-
 	return nil
 }
@@ -1,12 +1,20 @@
 package nft
 
 import (
+	"errors"
+	"fmt"
+	"net"
 	"net/netip"
 	"os"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
 	"github.com/nickgarlis/flowmon/types"
+	"golang.org/x/sys/unix"
 )
 
 func TestIPv4(t *testing.T) {
@@ -28,10 +36,18 @@ func TestIPv4(t *testing.T) {
 	wantCounters := &types.Counters{
 		Input: []types.Counter{
 			{Label: "rest_syn", DstPort: 8080, Protocol: types.ProtocolTCP, SrcAddr: netip.MustParseAddr("1.2.3.4"), TcpFlags: []types.TcpFlag{types.TcpFlagSYN}},
+			{Label: "ftp_data", Protocol: types.ProtocolTCP, CtHelper: "ftp"},
+			{Label: "private", SrcNet: netip.MustParsePrefix("10.0.0.0/8")},
+			{Label: "diameter", Protocol: types.ProtocolSCTP, DstPort: 3868},
+			{Label: "tunnel", Protocol: types.ProtocolGRE},
+			{Label: "ipsec", Protocol: types.ProtocolESP},
+			{Label: "fragments", Fragmented: true},
+			{Label: "gateway", SrcMac: types.MacAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}},
 		},
 		Output: []types.Counter{
 			{Label: "rest_syn_ack", SrcPort: 8080, Protocol: types.ProtocolTCP, TcpFlags: []types.TcpFlag{types.TcpFlagSYN, types.TcpFlagACK}, DstAddr: netip.MustParseAddr("1.2.3.4")},
 			{DstPort: 9090, Protocol: types.ProtocolUDP, DstAddr: netip.MustParseAddr("2.3.4.5")},
+			{Label: "not_dns", DstPort: 53, Protocol: types.ProtocolUDP, Negate: []string{"dst_port"}},
 		},
 	}
 
@@ -85,6 +101,8 @@ func TestIPv6(t *testing.T) {
 		Output: []types.Counter{
 			{Label: "rest_syn_ack", SrcPort: 8080, Protocol: types.ProtocolTCP, TcpFlags: []types.TcpFlag{types.TcpFlagSYN, types.TcpFlagACK}, DstAddr: netip.MustParseAddr("2001:db8::1")},
 			{DstPort: 9090, Protocol: types.ProtocolUDP, DstAddr: netip.MustParseAddr("2001:db8::2")},
+			{Label: "doc", DstNet: netip.MustParsePrefix("2001:db8::/32")},
+			{Label: "fragments", Fragmented: true},
 		},
 	}
 
@@ -115,15 +133,1536 @@ func TestIPv6(t *testing.T) {
 	}
 }
 
+func TestSetupAddressFamily(t *testing.T) {
+	nft, err := New(&Config{TableFamily: types.TableFamilyIPv4, TableName: "test_table_family"})
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+
+	err = nft.Setup(&types.Counters{
+		Input: []types.Counter{{Label: "v6", SrcNet: netip.MustParsePrefix("2001:db8::/32")}},
+	})
+	if err == nil || !strings.Contains(err.Error(), `counter "v6"`) {
+		t.Errorf("Expected an error naming the counter, got %v", err)
+	}
+}
+
+func TestChainNamesAndPriorities(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	outputPriority := int32(-150)
+	nft, err := New(&Config{
+		TableFamily:    types.TableFamilyIPv4,
+		TableName:      "test_table_chains",
+		InputChain:     "count_in",
+		OutputChain:    "count_out",
+		ChainPriority:  -300,
+		OutputPriority: &outputPriority,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	defer nft.Cleanup()
+
+	if err := nft.Setup(&types.Counters{
+		Input: []types.Counter{{Label: "udp", Protocol: types.ProtocolUDP, DstPort: 9994}},
+	}); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	table := &nftables.Table{Name: "test_table_chains", Family: nftables.TableFamilyIPv4}
+	for name, want := range map[string]nftables.ChainPriority{"count_in": -300, "count_out": -150} {
+		chain, err := nft.conn.ListChain(table, name)
+		if err != nil {
+			t.Fatalf("Failed to get chain %s: %v", name, err)
+		}
+		if chain.Priority == nil || *chain.Priority != want {
+			t.Errorf("Chain %s: expected priority %d, got %v", name, want, chain.Priority)
+		}
+	}
+
+	// The direction stays the same whatever the chain is called.
+	counters, err := nft.ListCounters()
+	if err != nil {
+		t.Fatalf("Failed to list counters: %v", err)
+	}
+	if len(counters.Input) != 1 || counters.Input[0].Dir != "input" || counters.Input[0].Chain != "count_in" {
+		t.Errorf("Expected an input counter in chain count_in, got %+v", counters.Input)
+	}
+}
+
+func TestRecreateDeletedTable(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	nft, err := New(&Config{TableFamily: types.TableFamilyIPv4, TableName: "test_table_recreate"})
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	defer nft.Cleanup()
+
+	counters := &types.Counters{
+		Input: []types.Counter{{Label: "udp", Protocol: types.ProtocolUDP, DstPort: 9994}},
+	}
+	if err := nft.Setup(counters); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	// Another tool removes the table.
+	nft.conn.DelTable(&nftables.Table{Name: "test_table_recreate", Family: nftables.TableFamilyIPv4})
+	if err := nft.conn.Flush(); err != nil {
+		t.Fatalf("Failed to delete table: %v", err)
+	}
+
+	got, err := nft.ListCounters()
+	if err != nil {
+		t.Fatalf("Expected the table to be recreated, got %v", err)
+	}
+	clearFields(got)
+	if !reflect.DeepEqual(got.Input, counters.Input) {
+		t.Errorf("Expected %+v, got %+v", counters.Input, got.Input)
+	}
+}
+
+func TestKeepTable(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	counters := &types.Counters{
+		Input: []types.Counter{{Label: "udp", Protocol: types.ProtocolUDP, DstPort: 9993}},
+	}
+	var conns []*Conn
+	for _, prefix := range []string{"a", "b"} {
+		nft, err := New(&Config{
+			TableName:   "test_table_shared",
+			InputChain:  prefix + "_input",
+			OutputChain: prefix + "_output",
+			KeepTable:   true,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create Nft instance: %v", err)
+		}
+		if err := nft.Setup(counters); err != nil {
+			t.Fatalf("Setup failed: %v", err)
+		}
+		conns = append(conns, nft)
+	}
+
+	if err := conns[0].Cleanup(); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	if err := conns[1].Check(); err != nil {
+		t.Fatalf("Expected the chains of the other instance to survive, got %v", err)
+	}
+	if _, err := conns[1].GetCounters(); err != nil {
+		t.Fatalf("GetCounters failed: %v", err)
+	}
+
+	if err := conns[1].Cleanup(); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	_, err := conns[1].conn.ListTableOfFamily("test_table_shared", nftables.TableFamilyIPv4)
+	if !errors.Is(err, unix.ENOENT) {
+		t.Errorf("Expected the empty table to be deleted, got %v", err)
+	}
+}
+
+func TestConcurrentReconcile(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	nft, err := New(&Config{TableFamily: types.TableFamilyIPv4, TableName: "test_table_concurrent"})
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	defer nft.Cleanup()
+
+	small := &types.Counters{
+		Input: []types.Counter{{Label: "dns", Protocol: types.ProtocolUDP, DstPort: 53}},
+	}
+	large := &types.Counters{
+		Input: []types.Counter{
+			{Label: "dns", Protocol: types.ProtocolUDP, DstPort: 53},
+			{Label: "https", Protocol: types.ProtocolTCP, DstPort: 443},
+		},
+		Forward: []types.Counter{{Label: "ssh", Protocol: types.ProtocolTCP, DstPort: 22}},
+	}
+	if err := nft.Setup(small); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for _, read := range []func() (*types.Counters, error){nft.ListCounters, nft.GetCounters} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				got, err := read()
+				if err != nil {
+					errs <- err
+					return
+				}
+				// Every read sees one of the two states, never a mix.
+				if n := len(got.Input); n != 1 && n != 2 {
+					errs <- fmt.Errorf("read %d input counters", n)
+					return
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range 50 {
+			counters := small
+			if i%2 == 0 {
+				counters = large
+			}
+			if err := nft.Reconcile(counters); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	cfg := Config{
+		TableFamily:   types.TableFamilyIPv4,
+		TableName:     "test_table_read_only",
+		ChainPriority: -300,
+	}
+
+	// The table is set up by someone else, here a managed instance, and
+	// holds a rule flowmon does not understand.
+	owner, err := New(&cfg)
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	defer owner.Cleanup()
+	if err := owner.Setup(&types.Counters{
+		Output: []types.Counter{{Label: "udp", Protocol: types.ProtocolUDP, DstPort: 9995}},
+	}); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	table := &nftables.Table{Name: cfg.TableName, Family: nftables.TableFamilyIPv4}
+	owner.conn.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: &nftables.Chain{Name: "output", Table: table},
+		Exprs: []expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}},
+	})
+	if err := owner.conn.Flush(); err != nil {
+		t.Fatalf("Failed to add foreign rule: %v", err)
+	}
+
+	cfg.ReadOnly = true
+	reader, err := New(&cfg)
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	if err := reader.Check(); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if err := reader.Setup(&types.Counters{}); err == nil {
+		t.Errorf("Expected Setup to fail in read-only mode")
+	}
+
+	if _, err := reader.ListCounters(); err != nil {
+		t.Fatalf("Failed to list counters: %v", err)
+	}
+	sendUDP(t, netip.MustParseAddrPort("127.0.0.1:9995"))
+	sendUDP(t, netip.MustParseAddrPort("127.0.0.1:9995"))
+	if _, err := reader.ListCounters(); err != nil {
+		t.Fatalf("Failed to list counters: %v", err)
+	}
+	sendUDP(t, netip.MustParseAddrPort("127.0.0.1:9995"))
+
+	counters, err := reader.ListCounters()
+	if err != nil {
+		t.Fatalf("Failed to list counters: %v", err)
+	}
+	if len(counters.Output) != 1 || counters.Output[0].Packets != 1 {
+		t.Errorf("Expected one packet since the previous read, got %+v", counters.Output)
+	}
+	if got := reader.Skipped()["unsupported verdict"]; got != 3 {
+		t.Errorf("Expected the foreign rule to be skipped on each of 3 reads, got %d", got)
+	}
+
+	// The counters of the table itself are left alone.
+	if err := reader.Cleanup(); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	owned, err := reader.GetCounters()
+	if err != nil {
+		t.Fatalf("Failed to get counters: %v", err)
+	}
+	if len(owned.Output) != 1 || owned.Output[0].Packets != 3 {
+		t.Errorf("Expected the table to keep counting all 3 packets, got %+v", owned.Output)
+	}
+}
+
+func TestLabelPrefix(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	cfg := Config{TableName: "test_table_label_prefix", LabelPrefix: "flowmon:"}
+	nft, err := New(&cfg)
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	defer nft.Cleanup()
+	counters := &types.Counters{
+		Output: []types.Counter{{Label: "udp", Protocol: types.ProtocolUDP, DstPort: 9979}},
+	}
+	if err := nft.Setup(counters); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	// Other tools add rules of their own to the chain, one flowmon can read
+	// and one it cannot.
+	table := &nftables.Table{Name: cfg.TableName, Family: nftables.TableFamilyIPv4}
+	chain := &nftables.Chain{Name: "output", Table: table}
+	foreign, err := marshalRule(table, chain, &types.Counter{Label: "other", Protocol: types.ProtocolUDP})
+	if err != nil {
+		t.Fatalf("marshalRule: %v", err)
+	}
+	nft.conn.AddRule(foreign)
+	nft.conn.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: chain,
+		Exprs: []expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}},
+	})
+	if err := nft.conn.Flush(); err != nil {
+		t.Fatalf("Failed to add foreign rules: %v", err)
+	}
+
+	if err := nft.Reconcile(counters); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	sendUDP(t, netip.MustParseAddrPort("127.0.0.1:9979"))
+
+	got, err := nft.ListCounters()
+	if err != nil {
+		t.Fatalf("Failed to list counters: %v", err)
+	}
+	if len(got.Output) != 1 || got.Output[0].Label != "udp" || got.Output[0].Packets != 1 {
+		t.Errorf("Expected only the udp counter without the prefix, got %+v", got.Output)
+	}
+
+	// Only the rule of flowmon was reset by the read, and the foreign rules
+	// survived the reconcile.
+	labels := map[string]uint64{}
+	rules, err := nft.conn.GetRules(table, chain)
+	if err != nil {
+		t.Fatalf("Failed to list rules: %v", err)
+	}
+	for _, rule := range rules {
+		counter, err := unmarshalRule(rule)
+		if err != nil {
+			labels["unreadable"]++
+			continue
+		}
+		labels[counter.Label] = counter.Packets
+	}
+	if len(labels) != 3 || labels["flowmon:udp"] != 0 || labels["other"] != 1 || labels["unreadable"] != 1 {
+		t.Errorf("Expected the prefixed rule next to the untouched foreign ones, got %v", labels)
+	}
+}
+
+func TestTableErrorPermission(t *testing.T) {
+	err := tableError("flowmon", fmt.Errorf("netlink receive: %w", unix.EPERM))
+	if !errors.Is(err, ErrPermission) {
+		t.Errorf("Expected ErrPermission, got %v", err)
+	}
+	if err := tableError("flowmon", unix.EINVAL); errors.Is(err, ErrPermission) || !errors.Is(err, unix.EINVAL) {
+		t.Errorf("Expected other errors to be wrapped as is, got %v", err)
+	}
+}
+
+func TestReadOnlyMissingTable(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	nft, err := New(&Config{TableName: "test_table_missing", ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	if err := nft.Check(); !errors.Is(err, ErrTableNotFound) {
+		t.Errorf("Expected ErrTableNotFound, got %v", err)
+	}
+	if _, err := nft.GetCounters(); !errors.Is(err, ErrTableNotFound) {
+		t.Errorf("Expected ErrTableNotFound, got %v", err)
+	}
+}
+
+func TestMissingChain(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	nft, err := New(&Config{TableFamily: types.TableFamilyIPv4, TableName: "test_table_missing_chain"})
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	defer nft.Cleanup()
+
+	// Without a desired state to recreate, the missing chain is reported.
+	table := nft.conn.AddTable(&nftables.Table{Name: "test_table_missing_chain", Family: nftables.TableFamilyIPv4})
+	nft.conn.AddChain(nft.chainSpec(table, dirInput))
+	if err := nft.conn.Flush(); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	_, err = nft.GetCounters()
+	if !errors.Is(err, ErrChainNotFound) {
+		t.Errorf("Expected ErrChainNotFound, got %v", err)
+	}
+}
+
+func TestForward(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	nft, err := New(&Config{
+		TableFamily:   types.TableFamilyIPv4,
+		TableName:     "test_table_forward",
+		ChainPriority: -300,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	defer nft.Cleanup()
+
+	forward := []types.Counter{
+		{Label: "lan_to_wan", Iif: "eth1", Oif: "eth0"},
+	}
+	if err := nft.Setup(&types.Counters{Forward: forward}); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	counters, err := nft.ListCounters()
+	if err != nil {
+		t.Fatalf("Failed to list counters: %v", err)
+	}
+	clearFields(counters)
+	if !reflect.DeepEqual(forward, counters.Forward) {
+		t.Errorf("Expected forward counters %+v, got %+v", forward, counters.Forward)
+	}
+
+	// Without forward counters the chain is removed again.
+	if err := nft.Reconcile(&types.Counters{}); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	counters, err = nft.ListCounters()
+	if err != nil {
+		t.Fatalf("Failed to list counters: %v", err)
+	}
+	if len(counters.Forward) != 0 {
+		t.Errorf("Expected no forward counters, got %+v", counters.Forward)
+	}
+}
+
+func TestIPv4Traffic(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	nft, err := New(&Config{
+		TableFamily:   types.TableFamilyIPv4,
+		TableName:     "test_table_traffic",
+		ChainPriority: -300,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	defer nft.Cleanup()
+
+	if err := nft.Setup(&types.Counters{
+		Output: []types.Counter{
+			{Label: "loopback_net", Protocol: types.ProtocolUDP, DstPort: 9999, DstNet: netip.MustParsePrefix("127.0.0.0/8")},
+			{Label: "loopback_host", Protocol: types.ProtocolUDP, DstPort: 9999, DstNet: netip.MustParsePrefix("127.0.0.2/32")},
+			{Label: "other_net", Protocol: types.ProtocolUDP, DstPort: 9999, DstNet: netip.MustParsePrefix("10.0.0.0/8")},
+			{Label: "port_range", Protocol: types.ProtocolUDP, DstPortRange: types.PortRange{Min: 9990, Max: 9999}},
+			{Label: "other_range", Protocol: types.ProtocolUDP, DstPortRange: types.PortRange{Min: 10000, Max: 10010}},
+			{Label: "loopback_if", Protocol: types.ProtocolUDP, DstPort: 9999, Oif: "lo"},
+			{Label: "other_if", Protocol: types.ProtocolUDP, DstPort: 9999, Oif: "flowmon0"},
+			// 20 byte IPv4 header, 8 byte UDP header and 1 byte of payload.
+			{Label: "exact_len", Protocol: types.ProtocolUDP, DstPort: 9999, MinLen: 29, MaxLen: 29},
+			{Label: "large", Protocol: types.ProtocolUDP, DstPort: 9999, MinLen: 1000},
+		},
+	}); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	sendUDP(t, netip.MustParseAddrPort("127.0.0.1:9999"))
+	sendUDP(t, netip.MustParseAddrPort("127.0.0.2:9999"))
+
+	// Reading without a reset must leave the counts for ListCounters.
+	if _, err := nft.GetCounters(); err != nil {
+		t.Fatalf("Failed to get counters: %v", err)
+	}
+
+	counters, err := nft.ListCounters()
+	if err != nil {
+		t.Fatalf("Failed to list counters: %v", err)
+	}
+
+	want := map[string]uint64{"loopback_net": 2, "loopback_host": 1, "other_net": 0, "port_range": 2, "other_range": 0, "loopback_if": 2, "other_if": 0, "exact_len": 2, "large": 0}
+	for _, counter := range counters.Output {
+		if counter.Packets != want[counter.Label] {
+			t.Errorf("Counter %s: expected %d packets, got %d", counter.Label, want[counter.Label], counter.Packets)
+		}
+	}
+}
+
+func TestIPv6ExtensionHeaders(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	nft, err := New(&Config{
+		TableFamily:   types.TableFamilyIPv6,
+		TableName:     "test_table_v6_exthdr",
+		ChainPriority: -300,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	defer nft.Cleanup()
+
+	if err := nft.Setup(&types.Counters{
+		Output: []types.Counter{
+			{Label: "hbh", Protocol: types.ProtocolUDP, DstPort: 9999},
+		},
+	}); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	// Send a UDP datagram carrying a hop-by-hop options header with a
+	// single PadN option.
+	fd, err := unix.Socket(unix.AF_INET6, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatalf("socket: %v", err)
+	}
+	defer unix.Close(fd)
+	if err := unix.SetsockoptString(fd, unix.IPPROTO_IPV6, unix.IPV6_HOPOPTS, string([]byte{0, 0, 1, 4, 0, 0, 0, 0})); err != nil {
+		t.Skipf("IPV6_HOPOPTS not supported: %v", err)
+	}
+	if err := unix.Sendto(fd, []byte("x"), 0, &unix.SockaddrInet6{Port: 9999, Addr: [16]byte{15: 1}}); err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+
+	counters, err := nft.ListCounters()
+	if err != nil {
+		t.Fatalf("Failed to list counters: %v", err)
+	}
+	if len(counters.Output) != 1 || counters.Output[0].Packets != 1 {
+		t.Errorf("Expected one packet counted behind the extension header, got %+v", counters.Output)
+	}
+}
+
+func TestIPv6TCPSyn(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	nft, err := New(&Config{TableFamily: types.TableFamilyIPv6, TableName: "test_table_v6_syn"})
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	defer nft.Cleanup()
+
+	syn := []types.TcpFlag{types.TcpFlagSYN}
+	if err := nft.Setup(&types.Counters{
+		Output: []types.Counter{
+			{Label: "plain", Protocol: types.ProtocolTCP, DstPort: 9990, TcpFlags: syn},
+			{Label: "hbh", Protocol: types.ProtocolTCP, DstPort: 9991, TcpFlags: syn},
+		},
+	}); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	// Nothing listens, so each connection attempt is a single SYN answered
+	// by a RST. The second SYN carries a hop-by-hop options header, which
+	// must not shift the port and flags.
+	for _, port := range []int{9990, 9991} {
+		fd, err := unix.Socket(unix.AF_INET6, unix.SOCK_STREAM, 0)
+		if err != nil {
+			t.Fatalf("socket: %v", err)
+		}
+		if port == 9991 {
+			if err := unix.SetsockoptString(fd, unix.IPPROTO_IPV6, unix.IPV6_HOPOPTS, string([]byte{0, 0, 1, 4, 0, 0, 0, 0})); err != nil {
+				unix.Close(fd)
+				t.Skipf("IPV6_HOPOPTS not supported: %v", err)
+			}
+		}
+		err = unix.Connect(fd, &unix.SockaddrInet6{Port: port, Addr: [16]byte{15: 1}})
+		unix.Close(fd)
+		if !errors.Is(err, unix.ECONNREFUSED) {
+			t.Skipf("IPv6 loopback not available: %v", err)
+		}
+	}
+
+	counters, err := nft.ListCounters()
+	if err != nil {
+		t.Fatalf("Failed to list counters: %v", err)
+	}
+	for _, c := range counters.Output {
+		if c.Packets != 1 {
+			t.Errorf("Expected %s to count one SYN, got %d", c.Label, c.Packets)
+		}
+	}
+}
+
+func TestManyFields(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	// After conntrack, for the ct matches.
+	nft, err := New(&Config{
+		TableFamily:   types.TableFamilyIPv6,
+		TableName:     "test_table_many_fields",
+		ChainPriority: -150,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	defer nft.Cleanup()
+
+	// Every match of the SYN below, needing more registers than the kernel
+	// has, so later matches reuse the registers of earlier ones. Each
+	// variant differs in a single field and must not count the SYN.
+	counter := func(label string, change func(*types.Counter)) types.Counter {
+		c := types.Counter{
+			Label:        label,
+			SrcAddr:      netip.MustParseAddr("::1"),
+			DstNet:       netip.MustParsePrefix("::/64"),
+			Dscp:         ptr(uint8(0)),
+			Protocol:     types.ProtocolTCP,
+			SrcPortRange: types.PortRange{Min: 1024, Max: 65535},
+			DstPort:      9980,
+			TcpFlags:     []types.TcpFlag{types.TcpFlagSYN},
+			Oif:          "lo",
+			CtState:      []types.ConntrackState{types.ConntrackStateNew},
+			CtDir:        types.CtDirectionOriginal,
+			Mark:         ptr(uint32(0)),
+			CtMark:       ptr(uint32(0)),
+			MinLen:       60,
+			MaxLen:       120,
+		}
+		if change != nil {
+			change(&c)
+		}
+		return c
+	}
+	all := counter("all", nil)
+
+	table := &nftables.Table{Name: "test", Family: nftables.TableFamilyIPv6}
+	rule, err := marshalRule(table, &nftables.Chain{Name: "output", Table: table}, &all)
+	if err != nil {
+		t.Fatalf("marshalRule: %v", err)
+	}
+	loaded := map[uint32]bool{}
+	reused := false
+	for _, e := range rule.Exprs {
+		var reg uint32
+		switch ex := e.(type) {
+		case *expr.Payload:
+			reg = ex.DestRegister
+		case *expr.Meta:
+			reg = ex.Register
+		case *expr.Ct:
+			reg = ex.Register
+		default:
+			continue
+		}
+		reused = reused || loaded[reg]
+		loaded[reg] = true
+	}
+	if !reused {
+		t.Fatalf("Expected the rule to reuse a register, got %d distinct loads", len(loaded))
+	}
+
+	if err := nft.Setup(&types.Counters{
+		Output: []types.Counter{
+			all,
+			counter("src_addr", func(c *types.Counter) { c.SrcAddr = netip.MustParseAddr("::2") }),
+			counter("dst_port", func(c *types.Counter) { c.DstPort = 9981 }),
+			counter("tcp_flags", func(c *types.Counter) { c.TcpFlags = []types.TcpFlag{types.TcpFlagACK} }),
+			counter("oif", func(c *types.Counter) { c.Oif = "flowmon0" }),
+			counter("ct_state", func(c *types.Counter) { c.CtState = []types.ConntrackState{types.ConntrackStateEstablished} }),
+			counter("ct_mark", func(c *types.Counter) { c.CtMark = ptr(uint32(1)) }),
+			counter("max_len", func(c *types.Counter) { c.MaxLen = 61 }),
+		},
+	}); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	// Nothing listens, so the connection attempt is a single SYN.
+	fd, err := unix.Socket(unix.AF_INET6, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("socket: %v", err)
+	}
+	err = unix.Connect(fd, &unix.SockaddrInet6{Port: 9980, Addr: [16]byte{15: 1}})
+	unix.Close(fd)
+	if !errors.Is(err, unix.ECONNREFUSED) {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+
+	counters, err := nft.ListCounters()
+	if err != nil {
+		t.Fatalf("Failed to list counters: %v", err)
+	}
+	for _, c := range counters.Output {
+		want := uint64(0)
+		if c.Label == "all" {
+			want = 1
+		}
+		if c.Packets != want {
+			t.Errorf("Counter %s: expected %d packets, got %d", c.Label, want, c.Packets)
+		}
+	}
+}
+
+func TestInetTable(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	nft, err := New(&Config{TableFamily: types.TableFamilyInet, TableName: "test_table_inet"})
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	defer nft.Cleanup()
+
+	if err := nft.Setup(&types.Counters{
+		Output: []types.Counter{
+			{Label: "v4", Protocol: types.ProtocolUDP, DstPort: 9981, DstAddr: netip.MustParseAddr("127.0.0.1"), Dscp: ptr(uint8(0))},
+			{Label: "v6", Protocol: types.ProtocolUDP, DstPort: 9981, DstAddr: netip.MustParseAddr("::1"), Dscp: ptr(uint8(0))},
+			{Label: "both", Protocol: types.ProtocolUDP, DstPort: 9981},
+		},
+	}); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	sendUDP(t, netip.MustParseAddrPort("127.0.0.1:9981"))
+	sendUDP(t, netip.MustParseAddrPort("[::1]:9981"))
+	sendUDP(t, netip.MustParseAddrPort("[::1]:9981"))
+
+	counters, err := nft.ListCounters()
+	if err != nil {
+		t.Fatalf("Failed to list counters: %v", err)
+	}
+	got := map[string]uint64{}
+	for _, c := range counters.Output {
+		got[c.Label] = c.Packets
+	}
+	if want := map[string]uint64{"v4": 1, "v6": 2, "both": 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestDscp(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	nft, err := New(&Config{TableFamily: types.TableFamilyIPv4, TableName: "test_table_dscp"})
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	defer nft.Cleanup()
+
+	ef, best := uint8(46), uint8(0)
+	if err := nft.Setup(&types.Counters{
+		Output: []types.Counter{
+			{Label: "ef", Protocol: types.ProtocolUDP, DstPort: 9996, Dscp: &ef},
+			{Label: "best_effort", Protocol: types.ProtocolUDP, DstPort: 9996, Dscp: &best},
+		},
+	}); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	if _, err := nft.ListCounters(); err != nil {
+		t.Fatalf("Failed to list counters: %v", err)
+	}
+
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:9996")))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn: %v", err)
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, int(ef)<<2)
+	}); err != nil || sockErr != nil {
+		t.Fatalf("set IP_TOS: %v %v", err, sockErr)
+	}
+	if _, err := conn.Write([]byte("x")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	sendUDP(t, netip.MustParseAddrPort("127.0.0.1:9996"))
+
+	counters, err := nft.ListCounters()
+	if err != nil {
+		t.Fatalf("Failed to list counters: %v", err)
+	}
+	for _, c := range counters.Output {
+		if c.Packets != 1 {
+			t.Errorf("Counter %s: expected 1 packet, got %d", c.Label, c.Packets)
+		}
+	}
+}
+
+func TestMark(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	nft, err := New(&Config{TableFamily: types.TableFamilyIPv4, TableName: "test_table_mark"})
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	defer nft.Cleanup()
+
+	if err := nft.Setup(&types.Counters{
+		Output: []types.Counter{
+			{Label: "marked", Protocol: types.ProtocolUDP, DstPort: 9989, Mark: ptr(uint32(0x110))},
+			{Label: "low_byte", Protocol: types.ProtocolUDP, DstPort: 9989, Mark: ptr(uint32(0x10)), MarkMask: ptr(uint32(0xff))},
+			{Label: "unmarked", Protocol: types.ProtocolUDP, DstPort: 9989, Mark: ptr(uint32(0x110)), Negate: []string{"mark"}},
+		},
+	}); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:9989")))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn: %v", err)
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, 0x110)
+	}); err != nil || sockErr != nil {
+		t.Fatalf("set SO_MARK: %v %v", err, sockErr)
+	}
+	if _, err := conn.Write([]byte("x")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	sendUDP(t, netip.MustParseAddrPort("127.0.0.1:9989"))
+
+	counters, err := nft.ListCounters()
+	if err != nil {
+		t.Fatalf("Failed to list counters: %v", err)
+	}
+	for _, c := range counters.Output {
+		if c.Packets != 1 {
+			t.Errorf("Counter %s: expected 1 packet, got %d", c.Label, c.Packets)
+		}
+	}
+}
+
+func TestSetLookup(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	cfg := Config{TableFamily: types.TableFamilyIPv4, TableName: "test_table_set", KeepTable: true}
+	nft, err := New(&cfg)
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	counters := &types.Counters{
+		Output: []types.Counter{
+			{Label: "local", Protocol: types.ProtocolUDP, DstPort: 9988, DstSet: "local"},
+			{Label: "not_local", Protocol: types.ProtocolUDP, DstPort: 9988, DstSet: "local", Negate: []string{"dst_set"}},
+		},
+	}
+	if err := nft.Setup(counters); err == nil || !strings.Contains(err.Error(), "set local not found") {
+		t.Errorf("Expected an error for the missing set, got %v", err)
+	}
+
+	// The set is loaded by someone else, into the table flowmon uses.
+	table := nft.conn.AddTable(&nftables.Table{Name: cfg.TableName, Family: nftables.TableFamilyIPv4})
+	set := &nftables.Set{Table: table, Name: "local", KeyType: nftables.TypeIPAddr}
+	if err := nft.conn.AddSet(set, []nftables.SetElement{{Key: []byte{127, 0, 0, 1}}}); err != nil {
+		t.Fatalf("AddSet: %v", err)
+	}
+	if err := nft.conn.Flush(); err != nil {
+		t.Fatalf("Failed to add set: %v", err)
+	}
+	defer func() {
+		nft.conn.DelTable(table)
+		nft.conn.Flush()
+	}()
+
+	if err := nft.Setup(counters); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	sendUDP(t, netip.MustParseAddrPort("127.0.0.1:9988"))
+
+	got, err := nft.ListCounters()
+	if err != nil {
+		t.Fatalf("Failed to list counters: %v", err)
+	}
+	if len(got.Output) != 2 || got.Output[0].Packets != 1 || got.Output[1].Packets != 0 {
+		t.Errorf("Expected the packet to be counted by the local set only, got %+v", got.Output)
+	}
+
+	// The table holds the set, so it outlives flowmon's chains.
+	if err := nft.Cleanup(); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	if _, err := nft.conn.GetSetByName(table, "local"); err != nil {
+		t.Errorf("Expected the set to survive Cleanup, got %v", err)
+	}
+}
+
+func TestSetupRollback(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	cfg := Config{TableFamily: types.TableFamilyIPv4, TableName: "test_table_rollback"}
+	nft, err := New(&cfg)
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	defer nft.Cleanup()
+
+	// The kernel rejects a comment longer than 256 bytes, which fails the
+	// whole batch.
+	if err := nft.Setup(&types.Counters{
+		Input: []types.Counter{{Label: strings.Repeat("x", 300), Protocol: types.ProtocolUDP}},
+	}); err == nil {
+		t.Fatal("Expected Setup to fail")
+	}
+	if _, err := nft.conn.ListTableOfFamily(cfg.TableName, nftables.TableFamilyIPv4); !errors.Is(err, unix.ENOENT) {
+		t.Fatalf("Expected no table after a failed Setup, got %v", err)
+	}
+
+	// The output counter is rejected after the table, the input chain and
+	// its rule have been queued.
+	if err := nft.Setup(&types.Counters{
+		Input:  []types.Counter{{Label: "stale", Protocol: types.ProtocolUDP, DstPort: 9987}},
+		Output: []types.Counter{{Label: "bad", Iif: "lo"}},
+	}); err == nil {
+		t.Fatal("Expected Setup to fail")
+	}
+
+	// None of it is sent along with the next batch.
+	if err := nft.Setup(&types.Counters{
+		Output: []types.Counter{{Label: "udp", Protocol: types.ProtocolUDP, DstPort: 9987}},
+	}); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	got, err := nft.GetCounters()
+	if err != nil {
+		t.Fatalf("Failed to get counters: %v", err)
+	}
+	if len(got.Input) != 0 || len(got.Output) != 1 {
+		t.Errorf("Expected only the udp counter, got input %v and output %v", got.Input, got.Output)
+	}
+}
+
+func TestNoReset(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	nft, err := New(&Config{TableFamily: types.TableFamilyIPv4, TableName: "test_table_noreset", NoReset: true})
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	defer nft.Cleanup()
+
+	if err := nft.Setup(&types.Counters{
+		Output: []types.Counter{{Label: "udp", Protocol: types.ProtocolUDP, DstPort: 9992}},
+	}); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	for want := uint64(1); want <= 2; want++ {
+		sendUDP(t, netip.MustParseAddrPort("127.0.0.1:9992"))
+		counters, err := nft.ListCounters()
+		if err != nil {
+			t.Fatalf("Failed to list counters: %v", err)
+		}
+		if got := counters.Output[0].Packets; got != want {
+			t.Errorf("Expected a total of %d packets, got %d", want, got)
+		}
+	}
+}
+
+func TestCounterReset(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	for _, noReset := range []bool{false, true} {
+		nft, err := New(&Config{TableFamily: types.TableFamilyIPv4, TableName: "test_table_counter_reset", NoReset: noReset})
+		if err != nil {
+			t.Fatalf("Failed to create Nft instance: %v", err)
+		}
+
+		// The second counter does the opposite of the table default.
+		override := noReset
+		if err := nft.Setup(&types.Counters{
+			Output: []types.Counter{
+				{Label: "default", Protocol: types.ProtocolUDP, DstPort: 9994},
+				{Label: "override", Protocol: types.ProtocolUDP, DstPort: 9995, Reset: &override},
+			},
+		}); err != nil {
+			nft.Cleanup()
+			t.Fatalf("Setup failed: %v", err)
+		}
+
+		for i := uint64(1); i <= 2; i++ {
+			sendUDP(t, netip.MustParseAddrPort("127.0.0.1:9994"))
+			sendUDP(t, netip.MustParseAddrPort("127.0.0.1:9995"))
+			counters, err := nft.ListCounters()
+			if err != nil {
+				nft.Cleanup()
+				t.Fatalf("Failed to list counters: %v", err)
+			}
+			for _, c := range counters.Output {
+				cumulative := noReset != (c.Label == "override")
+				want := uint64(1)
+				if cumulative {
+					want = i
+				}
+				if c.Packets != want || c.Cumulative != cumulative {
+					t.Errorf("noReset %v, read %d: expected %s to have %d packets and cumulative %v, got %d and %v",
+						noReset, i, c.Label, want, cumulative, c.Packets, c.Cumulative)
+				}
+			}
+		}
+		if err := nft.Cleanup(); err != nil {
+			t.Fatalf("Cleanup failed: %v", err)
+		}
+	}
+}
+
+func TestCounterResetIPv6(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	nft, err := New(&Config{TableFamily: types.TableFamilyIPv6, TableName: "test_table_counter_reset_ipv6"})
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	defer nft.Cleanup()
+
+	// The DSCP match depends on the family, so does the key of the rule.
+	if err := nft.Setup(&types.Counters{
+		Output: []types.Counter{
+			{Label: "ef", Protocol: types.ProtocolUDP, DstPort: 9994, Dscp: ptr(uint8(46)), Reset: ptr(false)},
+		},
+	}); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	counters, err := nft.ListCounters()
+	if err != nil {
+		t.Fatalf("Failed to list counters: %v", err)
+	}
+	if len(counters.Output) != 1 || !counters.Output[0].Cumulative {
+		t.Errorf("Expected the ef counter not to be reset, got %+v", counters.Output)
+	}
+}
+
+func TestResetCounters(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	cfg := Config{TableFamily: types.TableFamilyIPv4, TableName: "test_table_reset_counters", NoReset: true}
+	nft, err := New(&cfg)
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	defer nft.Cleanup()
+	if err := nft.Setup(&types.Counters{
+		Input:  []types.Counter{{Label: "all_in"}},
+		Output: []types.Counter{{Label: "udp", Protocol: types.ProtocolUDP, DstPort: 9993}},
+	}); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	sendUDP(t, netip.MustParseAddrPort("127.0.0.1:9993"))
+	sendUDP(t, netip.MustParseAddrPort("127.0.0.1:9993"))
+	before, err := nft.GetCounters()
+	if err != nil {
+		t.Fatalf("Failed to get counters: %v", err)
+	}
+
+	n, err := nft.ResetCounters()
+	if err != nil {
+		t.Fatalf("ResetCounters failed: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("Expected 2 counters to be reset, got %d", n)
+	}
+
+	after, err := nft.GetCounters()
+	if err != nil {
+		t.Fatalf("Failed to get counters: %v", err)
+	}
+	if len(before.Output) != 1 || before.Output[0].Packets != 2 {
+		t.Errorf("Expected 2 packets before the reset, got %+v", before.Output)
+	}
+	if len(after.Output) != 1 || after.Output[0].Packets != 0 || after.Output[0].Key() != before.Output[0].Key() {
+		t.Errorf("Expected the same rule with 0 packets after the reset, got %+v", after.Output)
+	}
+
+	cfg.ReadOnly = true
+	reader, err := New(&cfg)
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	if _, err := reader.ResetCounters(); err == nil {
+		t.Errorf("Expected ResetCounters to fail in read-only mode")
+	}
+}
+
+func TestICMPType(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	nft, err := New(&Config{
+		TableFamily:   types.TableFamilyIPv4,
+		TableName:     "test_table_icmp",
+		ChainPriority: -300,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	defer nft.Cleanup()
+
+	echoRequest, unreachable := uint8(8), uint8(3)
+	if err := nft.Setup(&types.Counters{
+		Output: []types.Counter{
+			{Label: "echo_request", Protocol: types.ProtocolICMP, IcmpType: &echoRequest},
+			{Label: "unreachable", Protocol: types.ProtocolICMP, IcmpType: &unreachable},
+		},
+	}); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_RAW, unix.IPPROTO_ICMP)
+	if err != nil {
+		t.Fatalf("socket: %v", err)
+	}
+	defer unix.Close(fd)
+	// Echo request with id 1, seq 1 and a precomputed checksum.
+	msg := []byte{8, 0, 0xf7, 0xfd, 0, 1, 0, 1}
+	if err := unix.Sendto(fd, msg, 0, &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatalf("sendto: %v", err)
+	}
+
+	counters, err := nft.ListCounters()
+	if err != nil {
+		t.Fatalf("Failed to list counters: %v", err)
+	}
+
+	want := map[string]uint64{"echo_request": 1, "unreachable": 0}
+	for _, counter := range counters.Output {
+		if counter.Packets != want[counter.Label] {
+			t.Errorf("Counter %s: expected %d packets, got %d", counter.Label, want[counter.Label], counter.Packets)
+		}
+	}
+}
+
+func TestICMPv6Type(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	nft, err := New(&Config{TableFamily: types.TableFamilyIPv6, TableName: "test_table_icmpv6"})
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	defer nft.Cleanup()
+
+	echoRequest, echoReply := uint8(128), uint8(129)
+	if err := nft.Setup(&types.Counters{
+		Output: []types.Counter{
+			{Label: "echo_request", Protocol: types.ProtocolICMPv6, IcmpType: &echoRequest},
+			{Label: "echo_reply", Protocol: types.ProtocolICMPv6, IcmpType: &echoReply},
+		},
+	}); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	fd, err := unix.Socket(unix.AF_INET6, unix.SOCK_RAW, unix.IPPROTO_ICMPV6)
+	if err != nil {
+		t.Fatalf("socket: %v", err)
+	}
+	defer unix.Close(fd)
+	// The kernel fills in the checksum of ICMPv6 raw sockets.
+	msg := []byte{128, 0, 0, 0, 0, 1, 0, 1}
+	if err := unix.Sendto(fd, msg, 0, &unix.SockaddrInet6{Addr: netip.IPv6Loopback().As16()}); err != nil {
+		t.Fatalf("sendto: %v", err)
+	}
+
+	counters, err := nft.ListCounters()
+	if err != nil {
+		t.Fatalf("Failed to list counters: %v", err)
+	}
+
+	// The reply of the loopback may or may not have been sent yet.
+	for _, counter := range counters.Output {
+		if counter.Label == "echo_request" && counter.Packets != 1 {
+			t.Errorf("Counter %s: expected 1 packet, got %d", counter.Label, counter.Packets)
+		}
+		if counter.Label == "echo_reply" && counter.Packets > 1 {
+			t.Errorf("Counter %s: expected at most 1 packet, got %d", counter.Label, counter.Packets)
+		}
+	}
+}
+
+func TestConntrackState(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	// ct state is only known once conntrack (priority -200) has seen the
+	// packet.
+	nft, err := New(&Config{
+		TableFamily:   types.TableFamilyIPv4,
+		TableName:     "test_table_ct_state",
+		ChainPriority: -150,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	defer nft.Cleanup()
+
+	if err := nft.Setup(&types.Counters{
+		Output: []types.Counter{
+			{Label: "new", Protocol: types.ProtocolUDP, DstPort: 9998, CtState: []types.ConntrackState{types.ConntrackStateNew}},
+			{Label: "established", Protocol: types.ProtocolUDP, DstPort: 9998, CtState: []types.ConntrackState{types.ConntrackStateEstablished}},
+			{Label: "original", Protocol: types.ProtocolUDP, DstPort: 9998, CtDir: types.CtDirectionOriginal},
+			{Label: "reply", Protocol: types.ProtocolUDP, DstPort: 9998, CtDir: types.CtDirectionReply},
+		},
+	}); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	sendUDP(t, netip.MustParseAddrPort("127.0.0.1:9998"))
+
+	counters, err := nft.ListCounters()
+	if err != nil {
+		t.Fatalf("Failed to list counters: %v", err)
+	}
+
+	want := map[string]uint64{"new": 1, "established": 0, "original": 1, "reply": 0}
+	for _, counter := range counters.Output {
+		if counter.Packets != want[counter.Label] {
+			t.Errorf("Counter %s: expected %d packets, got %d", counter.Label, want[counter.Label], counter.Packets)
+		}
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	nft, err := New(&Config{
+		TableFamily:   types.TableFamilyIPv4,
+		TableName:     "test_table_reconcile",
+		ChainPriority: -300,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	defer nft.Cleanup()
+
+	kept := types.Counter{Label: "kept", Protocol: types.ProtocolUDP, DstPort: 9999}
+	if err := nft.Setup(&types.Counters{
+		Output: []types.Counter{
+			kept,
+			{Label: "removed", Protocol: types.ProtocolUDP, DstPort: 9999},
+		},
+	}); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	sendUDP(t, netip.MustParseAddrPort("127.0.0.1:9999"))
+
+	if err := nft.Reconcile(&types.Counters{
+		Output: []types.Counter{
+			kept,
+			{Label: "added", Protocol: types.ProtocolUDP, DstPort: 9999},
+		},
+	}); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+
+	counters, err := nft.GetCounters()
+	if err != nil {
+		t.Fatalf("Failed to get counters: %v", err)
+	}
+
+	got := map[string]uint64{}
+	for _, counter := range counters.Output {
+		got[counter.Label] = counter.Packets
+	}
+	want := map[string]uint64{"kept": 1, "added": 0}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected counters %v after reconcile, got %v", want, got)
+	}
+}
+
+func TestSetupKeepsCounters(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	cfg := Config{
+		TableFamily:   types.TableFamilyIPv4,
+		TableName:     "test_table_restart",
+		ChainPriority: -300,
+	}
+	counters := &types.Counters{
+		Output: []types.Counter{{Label: "udp", Protocol: types.ProtocolUDP, DstPort: 9999}},
+	}
+
+	first, err := New(&cfg)
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	defer first.Cleanup()
+	if err := first.Setup(counters); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	sendUDP(t, netip.MustParseAddrPort("127.0.0.1:9999"))
+
+	// A new process setting up the same counters picks up the old rules.
+	second, err := New(&cfg)
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	if err := second.Setup(counters); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	got, err := second.ListCounters()
+	if err != nil {
+		t.Fatalf("Failed to list counters: %v", err)
+	}
+	if len(got.Output) != 1 || got.Output[0].Packets != 1 {
+		t.Errorf("Expected the packet counted before the second Setup, got %+v", got.Output)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	nft, err := New(&Config{
+		TableFamily:   types.TableFamilyIPv4,
+		TableName:     "test_table_limit",
+		ChainPriority: -300,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	defer nft.Cleanup()
+
+	if err := nft.Setup(&types.Counters{
+		Output: []types.Counter{
+			{Label: "policed", Protocol: types.ProtocolUDP, DstPort: 9997, Limit: &types.Limit{Rate: 1, Unit: types.LimitUnitHour, Burst: 1}},
+		},
+	}); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	// An unconnected socket, so ICMP errors from earlier packets don't fail
+	// later writes.
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer conn.Close()
+
+	// Packets dropped on output fail the write with EPERM.
+	dst := net.UDPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:9997"))
+	dropped := 0
+	for range 5 {
+		if _, err := conn.WriteToUDP([]byte("x"), dst); errors.Is(err, unix.EPERM) {
+			dropped++
+		}
+	}
+	if dropped != 4 {
+		t.Errorf("Expected the 4 packets above the burst to be dropped, got %d", dropped)
+	}
+
+	counters, err := nft.ListCounters()
+	if err != nil {
+		t.Fatalf("Failed to list counters: %v", err)
+	}
+	if len(counters.Output) != 1 || counters.Output[0].Packets != 5 {
+		t.Errorf("Expected all 5 packets to be counted, got %+v", counters.Output)
+	}
+}
+
+func TestDropVerdict(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	nft, err := New(&Config{
+		TableFamily:   types.TableFamilyIPv4,
+		TableName:     "test_table_verdict",
+		ChainPriority: -300,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	defer nft.Cleanup()
+
+	if err := nft.Setup(&types.Counters{
+		Output: []types.Counter{
+			{Label: "blocked", Protocol: types.ProtocolUDP, DstPort: 9996, Verdict: types.VerdictDrop},
+			{Label: "after", Protocol: types.ProtocolUDP, DstPort: 9996},
+		},
+	}); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:9996")))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("x")); !errors.Is(err, unix.EPERM) {
+		t.Errorf("Expected the packet to be dropped, got %v", err)
+	}
+
+	counters, err := nft.ListCounters()
+	if err != nil {
+		t.Fatalf("Failed to list counters: %v", err)
+	}
+
+	// Rules after a drop never see the packet.
+	want := map[string]uint64{"blocked": 1, "after": 0}
+	for _, counter := range counters.Output {
+		if counter.Packets != want[counter.Label] {
+			t.Errorf("Counter %s: expected %d packets, got %d", counter.Label, want[counter.Label], counter.Packets)
+		}
+	}
+}
+
+func sendUDP(t *testing.T, dst netip.AddrPort) {
+	t.Helper()
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(dst))
+	if err != nil {
+		t.Fatalf("dial %s: %v", dst, err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("x")); err != nil {
+		t.Fatalf("write %s: %v", dst, err)
+	}
+}
+
 func clearFields(counters *types.Counters) {
 	for i := range counters.Input {
 		counters.Input[i].Bytes = 0
 		counters.Input[i].Packets = 0
 		counters.Input[i].Dir = ""
+		counters.Input[i].Chain = ""
 	}
 	for i := range counters.Output {
 		counters.Output[i].Bytes = 0
 		counters.Output[i].Packets = 0
 		counters.Output[i].Dir = ""
+		counters.Output[i].Chain = ""
+	}
+	for i := range counters.Forward {
+		counters.Forward[i].Bytes = 0
+		counters.Forward[i].Packets = 0
+		counters.Forward[i].Dir = ""
+		counters.Forward[i].Chain = ""
+	}
+}
+
+func TestQuota(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	nft, err := New(&Config{TableFamily: types.TableFamilyIPv4, TableName: "test_table_quota"})
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	defer nft.Cleanup()
+
+	if err := nft.Setup(&types.Counters{
+		Output: []types.Counter{{Label: "udp", Protocol: types.ProtocolUDP, DstPort: 9993, Quota: 40}},
+	}); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	// A one byte datagram is 29 bytes long, so the second one exceeds
+	// the quota but is still counted.
+	sendUDP(t, netip.MustParseAddrPort("127.0.0.1:9993"))
+	counters, err := nft.GetCounters()
+	if err != nil {
+		t.Fatalf("Failed to get counters: %v", err)
+	}
+	if got := counters.Output[0]; got.Quota != 40 || got.QuotaUsed != got.Bytes {
+		t.Errorf("Expected the quota to consume the %d bytes counted, got %d of %d", got.Bytes, got.QuotaUsed, got.Quota)
+	}
+
+	sendUDP(t, netip.MustParseAddrPort("127.0.0.1:9993"))
+	counters, err = nft.ListCounters()
+	if err != nil {
+		t.Fatalf("Failed to list counters: %v", err)
+	}
+	// The kernel reports the consumed bytes capped at the quota.
+	if got := counters.Output[0]; got.Packets != 2 || got.QuotaUsed != 40 {
+		t.Errorf("Expected 2 packets and an exhausted quota, got %d packets and %d bytes used", got.Packets, got.QuotaUsed)
+	}
+
+	// Resetting the counters resets the quota as well.
+	counters, err = nft.GetCounters()
+	if err != nil {
+		t.Fatalf("Failed to get counters: %v", err)
+	}
+	if got := counters.Output[0].QuotaUsed; got != 0 {
+		t.Errorf("Expected the quota to be reset with the counters, got %d bytes used", got)
 	}
 }
@@ -0,0 +1,210 @@
+package nft
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/nickgarlis/flowmon/types"
+	"golang.org/x/sys/unix"
+)
+
+// Reconcile updates the installed rules to match counters. Rules whose
+// counter is unchanged are kept with their packet and byte counts, new
+// counters are added and rules without a counter are removed. All changes
+// are applied in a single batch, so on error the table is left as it was.
+func (n *Conn) Reconcile(counters *types.Counters) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if err := n.reconcile(counters); err != nil {
+		return err
+	}
+	desired := *counters
+	n.desired = &desired
+
+	resets := map[string]bool{}
+	for _, counter := range counters.All() {
+		if counter.Reset == nil || *counter.Reset == !n.noReset {
+			continue
+		}
+		_, key, err := n.buildRule(&nftables.Table{Name: n.tableName, Family: n.tableFamily}, &nftables.Chain{}, &counter)
+		if err != nil {
+			return err
+		}
+		resets[key] = *counter.Reset
+	}
+	n.resets = resets
+	return nil
+}
+
+func (n *Conn) reconcile(counters *types.Counters) error {
+	if n.readOnly {
+		return fmt.Errorf("cannot change the rules of a read-only table")
+	}
+
+	// The changes are queued on a connection of their own, so an error
+	// before the flush drops them instead of leaving them to be sent with
+	// the next batch. The kernel applies a batch entirely or not at all.
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+
+	// Checked before anything is queued, the table may not exist yet.
+	lookup := &nftables.Table{Name: n.tableName, Family: n.tableFamily}
+	for _, counter := range counters.All() {
+		if err := counter.Validate(); err != nil {
+			return fmt.Errorf("counter %q: %v", counter.Label, err)
+		}
+		if err := counter.ValidateFamily(types.TableFamily(n.tableFamily)); err != nil {
+			return fmt.Errorf("counter %q: %v", counter.Label, err)
+		}
+		if err := checkSets(conn, lookup, &counter); err != nil {
+			return err
+		}
+	}
+
+	table, err := getOrCreateTable(conn, n.tableName, n.tableFamily)
+	if err != nil {
+		return err
+	}
+
+	if err := n.reconcileChain(conn, table, dirInput, counters.Input); err != nil {
+		return err
+	}
+	if err := n.reconcileChain(conn, table, dirOutput, counters.Output); err != nil {
+		return err
+	}
+	// Forwarded traffic is only hooked when there is something to count.
+	if len(counters.Forward) > 0 {
+		if err := n.reconcileChain(conn, table, dirForward, counters.Forward); err != nil {
+			return err
+		}
+	} else if err := n.removeChain(conn, table, dirForward); err != nil {
+		return err
+	}
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("flush: %v", err)
+	}
+
+	return nil
+}
+
+func (n *Conn) reconcileChain(conn *nftables.Conn, table *nftables.Table, dir direction, counters []types.Counter) error {
+	chain, created, err := getOrCreateChain(conn, table, n.chainSpec(table, dir))
+	if err != nil {
+		return fmt.Errorf("getOrCreateChain: %v", err)
+	}
+	name := chain.Name
+
+	// Index the installed rules by the counter they implement. Rules that
+	// cannot be read back were not written by us. They are removed, unless
+	// a label prefix marks the rules of flowmon and the chain is shared.
+	var rules []*nftables.Rule
+	if !created {
+		rules, err = conn.GetRules(table, chain)
+		if err != nil {
+			return fmt.Errorf("list %s rules: %v", name, err)
+		}
+	}
+	live := map[string][]*nftables.Rule{}
+	for _, rule := range rules {
+		counter, err := unmarshalRule(rule)
+		if err != nil && n.labelPrefix != "" {
+			continue
+		}
+		if err != nil {
+			if err := conn.DelRule(rule); err != nil {
+				return fmt.Errorf("delete rule: %v", err)
+			}
+			continue
+		}
+		// Set lookups flowmon does not write were added by hand, and
+		// rules without the label prefix by other tools. Both are left
+		// alone.
+		if len(counter.Sets) > 0 || !n.ownLabel(counter) {
+			continue
+		}
+		key := counter.Key()
+		live[key] = append(live[key], rule)
+	}
+
+	for _, counter := range counters {
+		if err := checkInterface(dir, &counter); err != nil {
+			return err
+		}
+		rule, key, err := n.buildRule(table, chain, &counter)
+		if err != nil {
+			return err
+		}
+
+		if existing := live[key]; len(existing) > 0 {
+			live[key] = existing[1:]
+			continue
+		}
+		conn.AddRule(rule)
+	}
+
+	for _, stale := range live {
+		for _, rule := range stale {
+			if err := conn.DelRule(rule); err != nil {
+				return fmt.Errorf("delete rule: %v", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// removeChain deletes the chain for dir if it exists.
+func (n *Conn) removeChain(conn *nftables.Conn, table *nftables.Table, dir direction) error {
+	chain, err := conn.ListChain(table, n.chainName(dir))
+	if errors.Is(err, unix.ENOENT) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("get chain %s: %v", n.chainName(dir), err)
+	}
+	conn.FlushChain(chain)
+	conn.DelChain(chain)
+	return nil
+}
+
+// checkSets reports a set referenced by counter that is missing from the
+// table, which the kernel would only reject along with the whole batch.
+func checkSets(conn *nftables.Conn, table *nftables.Table, counter *types.Counter) error {
+	for _, set := range []string{counter.SrcSet, counter.DstSet} {
+		if set == "" {
+			continue
+		}
+		_, err := conn.GetSetByName(table, set)
+		if errors.Is(err, unix.ENOENT) {
+			return fmt.Errorf("counter %q: set %s not found in table %s", counter.Label, set, table.Name)
+		}
+		if err != nil {
+			return fmt.Errorf("get set %s: %v", set, err)
+		}
+	}
+	return nil
+}
+
+// buildRule returns the rule for counter, labelled with the label prefix,
+// and its key. The key is taken from the rule as it will be read back, so
+// fields that do not survive the round trip (such as the negation order)
+// don't count as changes.
+func (n *Conn) buildRule(table *nftables.Table, chain *nftables.Chain, counter *types.Counter) (*nftables.Rule, string, error) {
+	labeled := *counter
+	labeled.Label = n.labelPrefix + counter.Label
+	rule, err := marshalRule(table, chain, &labeled)
+	if err != nil {
+		return nil, "", fmt.Errorf("marshalRule: %v", err)
+	}
+	normalized, err := unmarshalRule(rule)
+	if err != nil {
+		return nil, "", fmt.Errorf("unmarshalRule: %v", err)
+	}
+	n.ownLabel(normalized)
+	return rule, normalized.Key(), nil
+}
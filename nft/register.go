@@ -0,0 +1,46 @@
+package nft
+
+import "golang.org/x/sys/unix"
+
+// The kernel register file holds sixteen 32-bit words that can also be
+// addressed as four 128-bit registers (NFT_REG_1 to NFT_REG_4).
+const regWords = 16
+
+// regAllocator hands out distinct registers for the values a rule loads, so
+// a match can keep several values live at once without clobbering another
+// one. Registers are numbered the way the kernel reports them back: word
+// offsets that line up with a 128-bit register use NFT_REG_1..4, everything
+// else uses NFT_REG32_00..15.
+type regAllocator struct {
+	next uint32 // next free 32-bit word
+}
+
+// alloc returns a register able to hold size bytes. Each match consumes its
+// registers before the next one is built, so once the register file is
+// exhausted allocation starts over from the first register.
+func (a *regAllocator) alloc(size uint32) uint32 {
+	words := (size + 3) / 4
+	if a.next+words > regWords {
+		a.next = 0
+	}
+	word := a.next
+	a.next += words
+
+	if word%4 == 0 {
+		return unix.NFT_REG_1 + word/4
+	}
+	return unix.NFT_REG32_00 + word
+}
+
+// regSpan returns the first and last 32-bit word covered by size bytes
+// stored in reg.
+func regSpan(reg, size uint32) (uint32, uint32) {
+	var word uint32
+	if reg >= unix.NFT_REG32_00 {
+		word = reg - unix.NFT_REG32_00
+	} else {
+		word = (reg - unix.NFT_REG_1) * 4
+	}
+	words := max((size+3)/4, 1)
+	return word, word + words - 1
+}
@@ -0,0 +1,340 @@
+package nft
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/nickgarlis/flowmon/types"
+	"golang.org/x/sys/unix"
+)
+
+// Render returns the table Setup would create for counters as an nft script,
+// without touching the kernel. Every rule is built and read back exactly like
+// Setup does, so the output shows what the kernel would be given.
+func (n *Conn) Render(counters *types.Counters) (string, error) {
+	for _, counter := range counters.All() {
+		if err := counter.Validate(); err != nil {
+			return "", fmt.Errorf("counter %q: %v", counter.Label, err)
+		}
+		if err := counter.ValidateFamily(types.TableFamily(n.tableFamily)); err != nil {
+			return "", fmt.Errorf("counter %q: %v", counter.Label, err)
+		}
+	}
+
+	table := &nftables.Table{Name: n.tableName, Family: n.tableFamily}
+
+	var chains []renderedChain
+	for _, d := range []struct {
+		dir      direction
+		counters []types.Counter
+	}{
+		{dirInput, counters.Input},
+		{dirOutput, counters.Output},
+		{dirForward, counters.Forward},
+	} {
+		// Like Setup, the forward chain only exists with forward counters.
+		if d.dir == dirForward && len(d.counters) == 0 {
+			continue
+		}
+		chain := n.chainSpec(table, d.dir)
+		rendered := renderedChain{chain: chain}
+		for _, counter := range d.counters {
+			if err := checkInterface(d.dir, &counter); err != nil {
+				return "", err
+			}
+			counter.Label = n.labelPrefix + counter.Label
+			rule, err := marshalRule(table, chain, &counter)
+			if err != nil {
+				return "", fmt.Errorf("marshalRule: %v", err)
+			}
+			built, err := unmarshalRule(rule)
+			if err != nil {
+				return "", fmt.Errorf("unmarshalRule: %v", err)
+			}
+			rendered.rules = append(rendered.rules, renderRule(n.tableFamily, built))
+		}
+		chains = append(chains, rendered)
+	}
+
+	return n.renderTable(chains), nil
+}
+
+// Dump returns the chains installed in the table as an nft script, in the
+// same form as Render, so the two can be diffed to find drift. Rules flowmon
+// cannot read, in a table it does not manage, are listed as comments.
+func (n *Conn) Dump() (string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	table, err := n.conn.ListTableOfFamily(n.tableName, n.tableFamily)
+	if errors.Is(err, unix.ENOENT) {
+		return "", fmt.Errorf("get table %s: %w", n.tableName, ErrTableNotFound)
+	}
+	if err != nil {
+		return "", tableError(n.tableName, err)
+	}
+
+	var chains []renderedChain
+	for _, dir := range []direction{dirInput, dirOutput, dirForward} {
+		chainName := n.chainName(dir)
+		chain, err := n.conn.ListChain(table, chainName)
+		if errors.Is(err, unix.ENOENT) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("get chain %s: %v", chainName, err)
+		}
+
+		rules, err := n.conn.GetRules(table, chain)
+		if err != nil {
+			return "", fmt.Errorf("list %s rules: %v", chainName, err)
+		}
+		rendered := renderedChain{chain: chain}
+		for _, rule := range rules {
+			counter, err := unmarshalRule(rule)
+			if err != nil {
+				rendered.rules = append(rendered.rules, fmt.Sprintf("# rule handle %d skipped: %v", rule.Handle, err))
+				continue
+			}
+			rendered.rules = append(rendered.rules, renderRule(n.tableFamily, counter))
+		}
+		chains = append(chains, rendered)
+	}
+
+	return n.renderTable(chains), nil
+}
+
+// renderedChain is a base chain with its rules in nft syntax.
+type renderedChain struct {
+	chain *nftables.Chain
+	rules []string
+}
+
+func (n *Conn) renderTable(chains []renderedChain) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "table %s %s {\n", types.TableFamily(n.tableFamily), n.tableName)
+	for _, c := range chains {
+		policy := "accept"
+		if c.chain.Policy != nil && *c.chain.Policy == nftables.ChainPolicyDrop {
+			policy = "drop"
+		}
+		typ := nftables.ChainTypeFilter
+		if c.chain.Type != "" {
+			typ = c.chain.Type
+		}
+		var priority int32
+		if c.chain.Priority != nil {
+			priority = int32(*c.chain.Priority)
+		}
+		fmt.Fprintf(&b, "\tchain %s {\n", c.chain.Name)
+		fmt.Fprintf(&b, "\t\ttype %s hook %s priority %d; policy %s;\n", typ, hookName(c.chain.Hooknum), priority, policy)
+		for _, rule := range c.rules {
+			fmt.Fprintf(&b, "\t\t%s\n", rule)
+		}
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// hookName returns the nft name of the hooks flowmon uses.
+func hookName(hook *nftables.ChainHook) string {
+	switch {
+	case hook == nil:
+		return "unknown"
+	case *hook == *nftables.ChainHookInput:
+		return "input"
+	case *hook == *nftables.ChainHookOutput:
+		return "output"
+	case *hook == *nftables.ChainHookForward:
+		return "forward"
+	case *hook == *nftables.ChainHookPrerouting:
+		return "prerouting"
+	case *hook == *nftables.ChainHookPostrouting:
+		return "postrouting"
+	default:
+		return fmt.Sprintf("%d", *hook)
+	}
+}
+
+// renderRule formats counter in nft syntax.
+func renderRule(family nftables.TableFamily, c *types.Counter) string {
+	// nft adds the family check of an inet table itself.
+	family = nftables.TableFamily(c.IPFamily(types.TableFamily(family)))
+	ip := "ip"
+	if family == nftables.TableFamilyIPv6 {
+		ip = "ip6"
+	}
+
+	var parts []string
+	match := func(field, selector, value string) {
+		op := ""
+		if c.IsNegated(field) {
+			op = "!= "
+		}
+		parts = append(parts, selector+" "+op+value)
+	}
+
+	if c.SrcAddr.IsValid() {
+		match("src_addr", ip+" saddr", c.SrcAddr.String())
+	}
+	if c.DstAddr.IsValid() {
+		match("dst_addr", ip+" daddr", c.DstAddr.String())
+	}
+	if c.SrcNet.IsValid() {
+		match("src_net", ip+" saddr", c.SrcNet.String())
+	}
+	if c.DstNet.IsValid() {
+		match("dst_net", ip+" daddr", c.DstNet.String())
+	}
+	if c.SrcAddrRange.IsValid() {
+		match("src_addr_range", ip+" saddr", c.SrcAddrRange.String())
+	}
+	if c.DstAddrRange.IsValid() {
+		match("dst_addr_range", ip+" daddr", c.DstAddrRange.String())
+	}
+	if c.SrcSet != "" {
+		match("src_set", ip+" saddr", "@"+c.SrcSet)
+	}
+	if c.DstSet != "" {
+		match("dst_set", ip+" daddr", "@"+c.DstSet)
+	}
+	if c.Dscp != nil {
+		match("dscp", ip+" dscp", strconv.Itoa(int(*c.Dscp)))
+	}
+	if c.Fragmented {
+		if family == nftables.TableFamilyIPv6 {
+			parts = append(parts, "exthdr frag exists")
+		} else {
+			parts = append(parts, "ip frag-off & 0x3fff != 0")
+		}
+	}
+	switch {
+	case c.ProtoHeader && family == nftables.TableFamilyIPv6:
+		match("protocol", "ip6 nexthdr", c.Protocol.String())
+	case c.ProtoHeader:
+		match("protocol", "ip protocol", c.Protocol.String())
+	case c.Protocol != 0:
+		match("protocol", "meta l4proto", c.Protocol.String())
+	}
+	if c.SrcPort != 0 {
+		match("src_port", "th sport", strconv.Itoa(int(c.SrcPort)))
+	}
+	if c.DstPort != 0 {
+		match("dst_port", "th dport", strconv.Itoa(int(c.DstPort)))
+	}
+	if c.SrcPortRange.IsValid() {
+		match("src_port_range", "th sport", c.SrcPortRange.String())
+	}
+	if c.DstPortRange.IsValid() {
+		match("dst_port_range", "th dport", c.DstPortRange.String())
+	}
+	if len(c.TcpFlags) > 0 {
+		list := func(flags []types.TcpFlag) string {
+			names := make([]string, len(flags))
+			for i, flag := range flags {
+				names[i] = flag.String()
+			}
+			return strings.Join(names, "|")
+		}
+		flags := list(c.TcpFlags)
+		switch c.TcpFlagsOp {
+		case types.TcpFlagsOpAny:
+			parts = append(parts, fmt.Sprintf("tcp flags & (%s) != 0", flags))
+		case types.TcpFlagsOpAll:
+			parts = append(parts, fmt.Sprintf("tcp flags & (%s) == %s", flags, flags))
+		case types.TcpFlagsOpNone:
+			parts = append(parts, fmt.Sprintf("tcp flags & (%s) == 0", flags))
+		default:
+			mask := types.TcpFlagsFromByte(types.TcpFlagsExactMask | types.TcpFlagsToByte(c.TcpFlags...))
+			parts = append(parts, fmt.Sprintf("tcp flags & (%s) == %s", list(mask), flags))
+		}
+	}
+	if c.TcpWindow != nil {
+		parts = append(parts, fmt.Sprintf("tcp window %d", *c.TcpWindow))
+	}
+	if c.IcmpType != nil {
+		match("icmp_type", c.Protocol.String()+" type", strconv.Itoa(int(*c.IcmpType)))
+	}
+	if c.IcmpCode != nil {
+		match("icmp_code", c.Protocol.String()+" code", strconv.Itoa(int(*c.IcmpCode)))
+	}
+	if c.Iif != "" {
+		match("iif", "iifname", strconv.Quote(c.Iif))
+	}
+	if c.Oif != "" {
+		match("oif", "oifname", strconv.Quote(c.Oif))
+	}
+	if c.SrcMac.IsValid() {
+		match("src_mac", "ether saddr", c.SrcMac.String())
+	}
+	if c.DstMac.IsValid() {
+		match("dst_mac", "ether daddr", c.DstMac.String())
+	}
+	if c.CtHelper != "" {
+		match("ct_helper", "ct helper", strconv.Quote(c.CtHelper))
+	}
+	if len(c.CtState) > 0 {
+		states := make([]string, len(c.CtState))
+		for i, state := range c.CtState {
+			states[i] = state.String()
+		}
+		parts = append(parts, "ct state "+strings.Join(states, ","))
+	}
+	if c.CtDir != "" {
+		parts = append(parts, "ct direction "+string(c.CtDir))
+	}
+	// A masked mark needs the operator spelled out, == or !=.
+	mark := func(field, selector string, value, mask *uint32) {
+		if mask == nil {
+			match(field, selector, fmt.Sprintf("%#x", *value))
+			return
+		}
+		op := "=="
+		if c.IsNegated(field) {
+			op = "!="
+		}
+		parts = append(parts, fmt.Sprintf("%s & %#x %s %#x", selector, *mask, op, *value))
+	}
+	if c.Mark != nil {
+		mark("mark", "meta mark", c.Mark, c.MarkMask)
+	}
+	if c.CtMark != nil {
+		mark("ct_mark", "ct mark", c.CtMark, c.CtMarkMask)
+	}
+	if c.MinLen != 0 {
+		parts = append(parts, fmt.Sprintf("meta length >= %d", c.MinLen))
+	}
+	if c.MaxLen != 0 {
+		parts = append(parts, fmt.Sprintf("meta length <= %d", c.MaxLen))
+	}
+
+	parts = append(parts, "counter")
+
+	if l := c.Limit; l != nil {
+		unit := "packets"
+		rate := fmt.Sprintf("%d/%s", l.Rate, l.Unit)
+		if l.Bytes {
+			unit = "bytes"
+			rate = fmt.Sprintf("%d bytes/%s", l.Rate, l.Unit)
+		}
+		limit := "limit rate over " + rate
+		if l.Burst != 0 {
+			limit += fmt.Sprintf(" burst %d %s", l.Burst, unit)
+		}
+		parts = append(parts, limit, "drop")
+	}
+	if c.Verdict != "" {
+		parts = append(parts, string(c.Verdict))
+	}
+	if c.Quota != 0 {
+		parts = append(parts, fmt.Sprintf("quota %d bytes", c.Quota))
+	}
+
+	parts = append(parts, "comment "+strconv.Quote(c.Label))
+
+	return strings.Join(parts, " ")
+}
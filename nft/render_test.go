@@ -0,0 +1,151 @@
+package nft
+
+import (
+	"net/netip"
+	"os"
+	"testing"
+
+	"github.com/nickgarlis/flowmon/types"
+)
+
+func TestRender(t *testing.T) {
+	nft, err := New(&Config{TableFamily: types.TableFamilyIPv6, TableName: "flowmon", InputChain: "count_in"})
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+
+	got, err := nft.Render(&types.Counters{
+		Input: []types.Counter{
+			{Label: "broadcast", DstMac: types.MacAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+			{Label: "https", Protocol: types.ProtocolTCP, DstPort: 443, SrcNet: netip.MustParsePrefix("2001:db8::/32"), Negate: []string{"src_net"}},
+			{Label: "fragments", Fragmented: true},
+			{Label: "nexthdr_udp", Protocol: types.ProtocolUDP, ProtoHeader: true},
+			{Label: "marked", Mark: ptr[uint32](0x10), MarkMask: ptr[uint32](0xf0), CtMark: ptr[uint32](1), Negate: []string{"mark"}},
+			{Label: "syn_64240", Protocol: types.ProtocolTCP, TcpFlags: []types.TcpFlag{types.TcpFlagSYN}, TcpWindow: ptr[uint16](64240)},
+			{Label: "push", Protocol: types.ProtocolTCP, TcpFlags: []types.TcpFlag{types.TcpFlagPSH, types.TcpFlagACK}},
+			{Label: "no_ecn", Protocol: types.ProtocolTCP, TcpFlags: []types.TcpFlag{types.TcpFlagECE, types.TcpFlagCWR}, TcpFlagsOp: types.TcpFlagsOpNone},
+		},
+		Output: []types.Counter{
+			{Label: "dns", Protocol: types.ProtocolUDP, DstPort: 53, Oif: "eth0", Limit: &types.Limit{Rate: 100, Unit: types.LimitUnitSecond}},
+			{Label: "requests", Protocol: types.ProtocolTCP, DstPort: 443, CtDir: types.CtDirectionOriginal},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+
+	want := `table ip6 flowmon {
+	chain count_in {
+		type filter hook input priority -300; policy accept;
+		ether daddr ff:ff:ff:ff:ff:ff counter comment "broadcast"
+		ip6 saddr != 2001:db8::/32 meta l4proto tcp th dport 443 counter comment "https"
+		exthdr frag exists counter comment "fragments"
+		ip6 nexthdr udp counter comment "nexthdr_udp"
+		meta mark & 0xf0 != 0x10 ct mark 0x1 counter comment "marked"
+		meta l4proto tcp tcp flags & (fin|syn|rst|ack) == syn tcp window 64240 counter comment "syn_64240"
+		meta l4proto tcp tcp flags & (fin|syn|rst|psh|ack) == psh|ack counter comment "push"
+		meta l4proto tcp tcp flags & (ece|cwr) == 0 counter comment "no_ecn"
+	}
+	chain output {
+		type filter hook output priority -300; policy accept;
+		meta l4proto udp th dport 53 oifname "eth0" counter limit rate over 100/second drop comment "dns"
+		meta l4proto tcp th dport 443 ct direction original counter comment "requests"
+	}
+}
+`
+	if got != want {
+		t.Errorf("unexpected rules.\nExpected:\n%s\nGot:\n%s", want, got)
+	}
+}
+
+func TestRenderInet(t *testing.T) {
+	nft, err := New(&Config{TableFamily: types.TableFamilyInet, TableName: "flowmon"})
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+
+	got, err := nft.Render(&types.Counters{
+		Input: []types.Counter{
+			{Label: "v4", SrcNet: netip.MustParsePrefix("10.0.0.0/8"), Fragmented: true},
+			{Label: "v6", SrcNet: netip.MustParsePrefix("2001:db8::/32"), Fragmented: true},
+			{Label: "both", Protocol: types.ProtocolTCP, DstPort: 443},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+
+	want := `table inet flowmon {
+	chain input {
+		type filter hook input priority -300; policy accept;
+		ip saddr 10.0.0.0/8 ip frag-off & 0x3fff != 0 counter comment "v4"
+		ip6 saddr 2001:db8::/32 exthdr frag exists counter comment "v6"
+		meta l4proto tcp th dport 443 counter comment "both"
+	}
+	chain output {
+		type filter hook output priority -300; policy accept;
+	}
+}
+`
+	if got != want {
+		t.Errorf("unexpected rules.\nExpected:\n%s\nGot:\n%s", want, got)
+	}
+}
+
+func TestRenderInvalidCounter(t *testing.T) {
+	nft, err := New(&Config{TableFamily: types.TableFamilyIPv4})
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+
+	_, err = nft.Render(&types.Counters{
+		Input: []types.Counter{{Label: "lo_out", Oif: "lo"}},
+	})
+	if err == nil {
+		t.Errorf("Expected an error for oif on input")
+	}
+
+	_, err = nft.Render(&types.Counters{
+		Output: []types.Counter{{Label: "mac_out", DstMac: types.MacAddr{0x02, 0, 0, 0, 0, 1}}},
+	})
+	if err == nil {
+		t.Errorf("Expected an error for dst_mac on output")
+	}
+}
+
+func TestDump(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+
+	nft, err := New(&Config{TableFamily: types.TableFamilyIPv4, TableName: "test_table_dump", OutputPriority: ptr[int32](-150)})
+	if err != nil {
+		t.Fatalf("Failed to create Nft instance: %v", err)
+	}
+	defer nft.Cleanup()
+
+	counters := &types.Counters{
+		Input: []types.Counter{
+			{Label: "ssh", Protocol: types.ProtocolTCP, DstPort: 22, SrcNet: netip.MustParsePrefix("10.0.0.0/8")},
+		},
+		Output: []types.Counter{
+			{Label: "dns", Protocol: types.ProtocolUDP, DstPort: 53, Verdict: types.VerdictAccept},
+			{Label: "marked", Mark: ptr[uint32](1), CtState: []types.ConntrackState{types.ConntrackStateNew}},
+		},
+	}
+	if err := nft.Setup(counters); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	want, err := nft.Render(counters)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	got, err := nft.Dump()
+	if err != nil {
+		t.Fatalf("Dump: %v", err)
+	}
+	if got != want {
+		t.Errorf("Dump differs from Render.\nExpected:\n%s\nGot:\n%s", want, got)
+	}
+}
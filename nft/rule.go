@@ -1,8 +1,10 @@
 package nft
 
 import (
+	"bytes"
 	"fmt"
 	"net/netip"
+	"strings"
 
 	"github.com/google/nftables"
 	"github.com/google/nftables/binaryutil"
@@ -12,8 +14,42 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+// ifNameLen is the size of an interface name including the trailing NUL
+// (IFNAMSIZ).
+const ifNameLen = unix.IFNAMSIZ
+
+// ctHelperLen is the size of a conntrack helper name including the trailing
+// NUL (NF_CT_HELPER_NAME_LEN).
+const ctHelperLen = 16
+
 func marshalRule(table *nftables.Table, chain *nftables.Chain, counter *types.Counter) (*nftables.Rule, error) {
 	exprs := []expr.Any{}
+	regs := &regAllocator{}
+
+	for _, field := range counter.Negate {
+		if !types.Negatable(field) {
+			return nil, fmt.Errorf("field %q cannot be negated", field)
+		}
+	}
+	if counter.IsNegated("protocol") && (counter.SrcPort != 0 || counter.DstPort != 0 || len(counter.TcpFlags) > 0 || counter.TcpWindow != nil || counter.IcmpType != nil || counter.IcmpCode != nil) {
+		return nil, fmt.Errorf("a negated protocol cannot be combined with ports, TCP fields or ICMP fields")
+	}
+
+	// An inet table sees both families, the header fields are only read
+	// from packets of the family of the addresses.
+	family := nftables.TableFamily(counter.IPFamily(types.TableFamily(table.Family)))
+	if table.Family == nftables.TableFamilyINet && family != nftables.TableFamilyINet {
+		exprs = append(exprs, nfprotoMatch(regs, family)...)
+	}
+
+	matched := map[string]bool{}
+	cmpOp := func(field string) expr.CmpOp {
+		matched[field] = true
+		if counter.IsNegated(field) {
+			return expr.CmpOpNeq
+		}
+		return expr.CmpOpEq
+	}
 
 	if counter.SrcAddr.IsValid() {
 		len := uint32(4)
@@ -22,16 +58,17 @@ func marshalRule(table *nftables.Table, chain *nftables.Chain, counter *types.Co
 			len = 16
 			offset = 8 // IPv6 source address offset
 		}
+		reg := regs.alloc(len)
 		exprs = append(exprs,
 			&expr.Payload{
-				DestRegister: 1,
+				DestRegister: reg,
 				Base:         expr.PayloadBaseNetworkHeader,
 				Offset:       offset,
 				Len:          len,
 			},
 			&expr.Cmp{
-				Op:       expr.CmpOpEq,
-				Register: 1,
+				Op:       cmpOp("src_addr"),
+				Register: reg,
 				Data:     counter.SrcAddr.AsSlice(),
 			},
 		)
@@ -44,89 +81,336 @@ func marshalRule(table *nftables.Table, chain *nftables.Chain, counter *types.Co
 			len = 16
 			offset = 24
 		}
+		reg := regs.alloc(len)
 		exprs = append(exprs,
 			&expr.Payload{
-				DestRegister: 1,
+				DestRegister: reg,
 				Base:         expr.PayloadBaseNetworkHeader,
 				Offset:       offset,
 				Len:          len,
 			},
 			&expr.Cmp{
-				Op:       expr.CmpOpEq,
-				Register: 1,
+				Op:       cmpOp("dst_addr"),
+				Register: reg,
 				Data:     counter.DstAddr.AsSlice(),
 			},
 		)
 	}
 
-	if counter.Protocol > 0 {
+	if counter.SrcAddr.IsValid() && counter.SrcNet.IsValid() {
+		return nil, fmt.Errorf("src_addr and src_net are mutually exclusive")
+	}
+	if counter.DstAddr.IsValid() && counter.DstNet.IsValid() {
+		return nil, fmt.Errorf("dst_addr and dst_net are mutually exclusive")
+	}
+
+	if counter.SrcNet.IsValid() {
+		exprs = append(exprs, prefixMatch(regs, counter.SrcNet, true, cmpOp("src_net"))...)
+	}
+
+	if counter.DstNet.IsValid() {
+		exprs = append(exprs, prefixMatch(regs, counter.DstNet, false, cmpOp("dst_net"))...)
+	}
+
+	if counter.SrcAddrRange.IsValid() {
+		exprs = append(exprs, addrRangeMatch(regs, counter.SrcAddrRange, true, cmpOp("src_addr_range"))...)
+	}
+
+	if counter.DstAddrRange.IsValid() {
+		exprs = append(exprs, addrRangeMatch(regs, counter.DstAddrRange, false, cmpOp("dst_addr_range"))...)
+	}
+
+	if counter.SrcSet != "" {
+		exprs = append(exprs, setMatch(regs, family, counter.SrcSet, true, cmpOp("src_set"))...)
+	}
+
+	if counter.DstSet != "" {
+		exprs = append(exprs, setMatch(regs, family, counter.DstSet, false, cmpOp("dst_set"))...)
+	}
+
+	if counter.Dscp != nil {
+		if *counter.Dscp > 63 {
+			return nil, fmt.Errorf("dscp %d is out of range", *counter.Dscp)
+		}
+		exprs = append(exprs, dscpMatch(regs, family, *counter.Dscp, cmpOp("dscp"))...)
+	}
+
+	if counter.Fragmented {
+		exprs = append(exprs, fragmentMatch(regs, family)...)
+	}
+
+	// meta l4proto is resolved by the kernel after walking the IPv6
+	// extension header chain, unlike ip6 nexthdr which only reads the fixed
+	// header and would miss packets carrying e.g. hop-by-hop options. The
+	// header field is still matched if asked for.
+	if counter.Protocol > 0 && counter.ProtoHeader {
+		reg := regs.alloc(1)
 		exprs = append(exprs,
-			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
-			&expr.Cmp{Register: 1, Op: expr.CmpOpEq, Data: counter.Protocol.AsSlice()},
+			&expr.Payload{
+				DestRegister: reg,
+				Base:         expr.PayloadBaseNetworkHeader,
+				Offset:       protocolOffset(family),
+				Len:          1,
+			},
+			&expr.Cmp{Register: reg, Op: cmpOp("protocol"), Data: counter.Protocol.AsSlice()},
+		)
+	} else if counter.Protocol > 0 {
+		reg := regs.alloc(1)
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: reg},
+			&expr.Cmp{Register: reg, Op: cmpOp("protocol"), Data: counter.Protocol.AsSlice()},
 		)
 	}
 
-	if counter.SrcPort != 0 && (counter.Protocol == unix.IPPROTO_TCP || counter.Protocol == unix.IPPROTO_UDP) {
+	// The transport header base points past the IPv6 extension headers as
+	// well, the kernel finds it with ipv6_find_hdr when the packet enters
+	// the chain, so the transport fields below need no offset of their own.
+	if counter.SrcPort != 0 && counter.Protocol.HasPorts() {
+		reg := regs.alloc(2)
 		exprs = append(exprs,
 			&expr.Payload{
-				DestRegister: 1,
+				DestRegister: reg,
 				Base:         expr.PayloadBaseTransportHeader,
 				Offset:       0,
 				Len:          2,
 			},
 			&expr.Cmp{
-				Op:       expr.CmpOpEq,
-				Register: 1,
+				Op:       cmpOp("src_port"),
+				Register: reg,
 				Data:     binaryutil.BigEndian.PutUint16(counter.SrcPort),
 			},
 		)
 	}
 
-	if counter.DstPort != 0 && (counter.Protocol == unix.IPPROTO_TCP || counter.Protocol == unix.IPPROTO_UDP) {
+	if counter.DstPort != 0 && counter.Protocol.HasPorts() {
+		reg := regs.alloc(2)
 		exprs = append(exprs,
 			&expr.Payload{
-				DestRegister: 1,
+				DestRegister: reg,
 				Base:         expr.PayloadBaseTransportHeader,
 				Offset:       2,
 				Len:          2,
 			},
 			&expr.Cmp{
-				Op:       expr.CmpOpEq,
-				Register: 1,
+				Op:       cmpOp("dst_port"),
+				Register: reg,
 				Data:     binaryutil.BigEndian.PutUint16(counter.DstPort),
 			},
 		)
 	}
 
+	if counter.SrcPort != 0 && counter.SrcPortRange.IsValid() {
+		return nil, fmt.Errorf("src_port and src_port_range are mutually exclusive")
+	}
+	if counter.DstPort != 0 && counter.DstPortRange.IsValid() {
+		return nil, fmt.Errorf("dst_port and dst_port_range are mutually exclusive")
+	}
+
+	if counter.SrcPortRange.IsValid() && counter.Protocol.HasPorts() {
+		exprs = append(exprs, portRangeMatch(regs, counter.SrcPortRange, 0, cmpOp("src_port_range"))...)
+	}
+
+	if counter.DstPortRange.IsValid() && counter.Protocol.HasPorts() {
+		exprs = append(exprs, portRangeMatch(regs, counter.DstPortRange, 2, cmpOp("dst_port_range"))...)
+	}
+
 	if len(counter.TcpFlags) > 0 && counter.Protocol == types.ProtocolTCP {
 		match := types.TcpFlagsToByte(counter.TcpFlags...)
-		mask := types.TcpFlagsToByte(types.TcpFlagFIN, types.TcpFlagSYN, types.TcpFlagRST, types.TcpFlagACK)
+		mask := types.TcpFlagsExactMask | match
+		op := expr.CmpOpEq
+		switch counter.TcpFlagsOp {
+		case types.TcpFlagsOpAny:
+			// Keep only the requested flags, any of them being set
+			// leaves a non-zero value.
+			mask, match, op = match, 0, expr.CmpOpNeq
+		case types.TcpFlagsOpAll:
+			mask = match
+		case types.TcpFlagsOpNone:
+			mask, match = match, 0
+		}
+		reg := regs.alloc(1)
 		exprs = append(exprs,
 			&expr.Payload{
-				DestRegister: 1,
+				DestRegister: reg,
 				Base:         expr.PayloadBaseTransportHeader,
 				Offset:       13, // TCP flags offset
 				Len:          1,
 			},
 			&expr.Bitwise{
-				DestRegister:   1,
-				SourceRegister: 1,
+				DestRegister:   reg,
+				SourceRegister: reg,
 				Len:            1,
 				Mask:           []byte{byte(mask)},
 				Xor:            []byte{0x00},
 			},
 			&expr.Cmp{
-				Op:       expr.CmpOpEq,
-				Register: 1,
+				Op:       op,
+				Register: reg,
 				Data:     []byte{byte(match)},
 			},
 		)
 	}
 
+	if counter.TcpWindow != nil && counter.Protocol == types.ProtocolTCP {
+		reg := regs.alloc(2)
+		exprs = append(exprs,
+			&expr.Payload{
+				DestRegister: reg,
+				Base:         expr.PayloadBaseTransportHeader,
+				Offset:       14, // TCP window offset
+				Len:          2,
+			},
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: reg,
+				Data:     binaryutil.BigEndian.PutUint16(*counter.TcpWindow),
+			},
+		)
+	}
+
+	isICMP := counter.Protocol == types.ProtocolICMP || counter.Protocol == types.ProtocolICMPv6
+
+	if counter.IcmpType != nil && isICMP {
+		exprs = append(exprs, icmpMatch(regs, *counter.IcmpType, 0, cmpOp("icmp_type"))...)
+	}
+
+	if counter.IcmpCode != nil && isICMP {
+		exprs = append(exprs, icmpMatch(regs, *counter.IcmpCode, 1, cmpOp("icmp_code"))...)
+	}
+
+	if counter.Iif != "" {
+		match, err := ifnameMatch(regs, expr.MetaKeyIIFNAME, counter.Iif, cmpOp("iif"))
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, match...)
+	}
+
+	if counter.Oif != "" {
+		match, err := ifnameMatch(regs, expr.MetaKeyOIFNAME, counter.Oif, cmpOp("oif"))
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, match...)
+	}
+
+	if counter.SrcMac.IsValid() || counter.DstMac.IsValid() {
+		exprs = append(exprs, etherMatch(regs)...)
+	}
+
+	if counter.SrcMac.IsValid() {
+		exprs = append(exprs, macMatch(regs, counter.SrcMac, 6, cmpOp("src_mac"))...)
+	}
+
+	if counter.DstMac.IsValid() {
+		exprs = append(exprs, macMatch(regs, counter.DstMac, 0, cmpOp("dst_mac"))...)
+	}
+
+	if counter.CtHelper != "" {
+		if len(counter.CtHelper) >= ctHelperLen {
+			return nil, fmt.Errorf("conntrack helper name %q is too long", counter.CtHelper)
+		}
+		reg := regs.alloc(ctHelperLen)
+		data := make([]byte, ctHelperLen)
+		copy(data, counter.CtHelper)
+		exprs = append(exprs,
+			&expr.Ct{Key: expr.CtKeyHELPER, Register: reg},
+			&expr.Cmp{Op: cmpOp("ct_helper"), Register: reg, Data: data},
+		)
+	}
+
+	if len(counter.CtState) > 0 {
+		// ct state is a bitmask, so a packet matches when any of the
+		// requested state bits is set.
+		mask := binaryutil.NativeEndian.PutUint32(types.ConntrackStatesToMask(counter.CtState...))
+		reg := regs.alloc(4)
+		exprs = append(exprs,
+			&expr.Ct{Key: expr.CtKeySTATE, Register: reg},
+			&expr.Bitwise{
+				DestRegister:   reg,
+				SourceRegister: reg,
+				Len:            4,
+				Mask:           mask,
+				Xor:            make([]byte, 4),
+			},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: reg, Data: make([]byte, 4)},
+		)
+	}
+
+	if counter.CtDir != "" {
+		dir, ok := ctDirections[counter.CtDir]
+		if !ok {
+			return nil, fmt.Errorf("invalid ct direction %q", counter.CtDir)
+		}
+		reg := regs.alloc(1)
+		exprs = append(exprs,
+			&expr.Ct{Key: expr.CtKeyDIRECTION, Register: reg},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: reg, Data: []byte{dir}},
+		)
+	}
+
+	if counter.Mark != nil {
+		reg := regs.alloc(4)
+		exprs = append(exprs, &expr.Meta{Key: expr.MetaKeyMARK, Register: reg})
+		exprs = append(exprs, markMatch(reg, *counter.Mark, counter.MarkMask, cmpOp("mark"))...)
+	}
+
+	if counter.CtMark != nil {
+		reg := regs.alloc(4)
+		exprs = append(exprs, &expr.Ct{Key: expr.CtKeyMARK, Register: reg})
+		exprs = append(exprs, markMatch(reg, *counter.CtMark, counter.CtMarkMask, cmpOp("ct_mark"))...)
+	}
+
+	if counter.MinLen != 0 || counter.MaxLen != 0 {
+		// The length is loaded in host byte order, but cmp compares bytes
+		// from the first one, so convert it to big endian first.
+		reg := regs.alloc(4)
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyLEN, Register: reg},
+			&expr.Byteorder{SourceRegister: reg, DestRegister: reg, Op: expr.ByteorderHton, Len: 4, Size: 4},
+		)
+		if counter.MinLen != 0 {
+			exprs = append(exprs, &expr.Cmp{Op: expr.CmpOpGte, Register: reg, Data: binaryutil.BigEndian.PutUint32(counter.MinLen)})
+		}
+		if counter.MaxLen != 0 {
+			exprs = append(exprs, &expr.Cmp{Op: expr.CmpOpLte, Register: reg, Data: binaryutil.BigEndian.PutUint32(counter.MaxLen)})
+		}
+	}
+
+	for _, field := range counter.Negate {
+		if !matched[field] {
+			return nil, fmt.Errorf("negated field %q is not matched", field)
+		}
+	}
+
 	exprs = append(exprs,
 		&expr.Counter{},
 	)
 
+	// The limit follows the counter, so every matched packet is counted and
+	// only the excess is dropped.
+	if counter.Limit != nil {
+		limit, err := limitExpr(counter.Limit)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, limit, &expr.Verdict{Kind: expr.VerdictDrop})
+	}
+
+	if counter.Verdict != "" {
+		kind, ok := verdictKinds[counter.Verdict]
+		if !ok {
+			return nil, fmt.Errorf("invalid verdict %q", counter.Verdict)
+		}
+		exprs = append(exprs, &expr.Verdict{Kind: kind})
+	}
+
+	// The quota comes last: once it is used up it stops the rule, but the
+	// counter before it keeps counting.
+	if counter.Quota != 0 {
+		exprs = append(exprs, &expr.Quota{Bytes: counter.Quota})
+	}
+
 	userData := userdata.AppendString([]byte{}, userdata.TypeComment, counter.Label)
 
 	return &nftables.Rule{
@@ -137,12 +421,365 @@ func marshalRule(table *nftables.Table, chain *nftables.Chain, counter *types.Co
 	}, nil
 }
 
+// prefixMatch loads the source or destination address, masks it to the
+// prefix length and compares it against the prefix. A full length prefix
+// still goes through the mask so that it round-trips as a prefix.
+func prefixMatch(regs *regAllocator, prefix netip.Prefix, src bool, op expr.CmpOp) []expr.Any {
+	addr := prefix.Masked().Addr()
+	len := uint32(4)
+	offset := uint32(16) // IPv4 destination address offset
+	if src {
+		offset = 12
+	}
+	if addr.Is6() {
+		len = 16
+		offset = 24
+		if src {
+			offset = 8
+		}
+	}
+
+	mask := make([]byte, len)
+	for i := 0; i < prefix.Bits(); i++ {
+		mask[i/8] |= 0x80 >> (i % 8)
+	}
+
+	reg := regs.alloc(len)
+	return []expr.Any{
+		&expr.Payload{
+			DestRegister: reg,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       offset,
+			Len:          len,
+		},
+		&expr.Bitwise{
+			DestRegister:   reg,
+			SourceRegister: reg,
+			Len:            len,
+			Mask:           mask,
+			Xor:            make([]byte, len),
+		},
+		&expr.Cmp{
+			Op:       op,
+			Register: reg,
+			Data:     addr.AsSlice(),
+		},
+	}
+}
+
+// ctDirections maps a ct direction to the value of IP_CT_DIR_ORIGINAL or
+// IP_CT_DIR_REPLY.
+var ctDirections = map[types.CtDirection]byte{
+	types.CtDirectionOriginal: 0,
+	types.CtDirectionReply:    1,
+}
+
+// addrRangeMatch loads the source or destination address and checks that it
+// lies within r.
+func addrRangeMatch(regs *regAllocator, r types.AddrRange, src bool, op expr.CmpOp) []expr.Any {
+	len := uint32(4)
+	offset := uint32(16) // IPv4 destination address offset
+	if src {
+		offset = 12
+	}
+	if r.Min.Is6() {
+		len = 16
+		offset = 24
+		if src {
+			offset = 8
+		}
+	}
+
+	reg := regs.alloc(len)
+	return []expr.Any{
+		&expr.Payload{
+			DestRegister: reg,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       offset,
+			Len:          len,
+		},
+		&expr.Range{
+			Op:       op,
+			Register: reg,
+			FromData: r.Min.AsSlice(),
+			ToData:   r.Max.AsSlice(),
+		},
+	}
+}
+
+var verdictKinds = map[types.Verdict]expr.VerdictKind{
+	types.VerdictAccept:   expr.VerdictAccept,
+	types.VerdictDrop:     expr.VerdictDrop,
+	types.VerdictContinue: expr.VerdictContinue,
+}
+
+var limitUnits = map[types.LimitUnit]expr.LimitTime{
+	types.LimitUnitSecond: expr.LimitTimeSecond,
+	types.LimitUnitMinute: expr.LimitTimeMinute,
+	types.LimitUnitHour:   expr.LimitTimeHour,
+	types.LimitUnitDay:    expr.LimitTimeDay,
+	types.LimitUnitWeek:   expr.LimitTimeWeek,
+}
+
+// limitExpr returns a limit matching the traffic above l. The unit defaults
+// to seconds.
+func limitExpr(l *types.Limit) (*expr.Limit, error) {
+	unit := expr.LimitTimeSecond
+	if l.Unit != "" {
+		var ok bool
+		if unit, ok = limitUnits[l.Unit]; !ok {
+			return nil, fmt.Errorf("invalid limit unit %q", l.Unit)
+		}
+	}
+	typ := expr.LimitTypePkts
+	if l.Bytes {
+		typ = expr.LimitTypePktBytes
+	}
+	return &expr.Limit{Type: typ, Rate: l.Rate, Over: true, Unit: unit, Burst: l.Burst}, nil
+}
+
+// setMatch looks the source or destination address up in the named set.
+// flowmon only references the set, its elements are managed by someone else.
+func setMatch(regs *regAllocator, family nftables.TableFamily, set string, src bool, op expr.CmpOp) []expr.Any {
+	len := uint32(4)
+	offset := uint32(16) // IPv4 destination address offset
+	if src {
+		offset = 12
+	}
+	if family == nftables.TableFamilyIPv6 {
+		len = 16
+		offset = 24
+		if src {
+			offset = 8
+		}
+	}
+
+	reg := regs.alloc(len)
+	return []expr.Any{
+		&expr.Payload{
+			DestRegister: reg,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       offset,
+			Len:          len,
+		},
+		&expr.Lookup{
+			SourceRegister: reg,
+			SetName:        set,
+			Invert:         op == expr.CmpOpNeq,
+		},
+	}
+}
+
+// nfprotoMatch restricts the rule to packets of family, like nft does before
+// a match on the IP header in an inet table.
+func nfprotoMatch(regs *regAllocator, family nftables.TableFamily) []expr.Any {
+	reg := regs.alloc(1)
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: reg},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: reg, Data: []byte{byte(family)}},
+	}
+}
+
+// markMatch compares the mark loaded into reg, after masking it if mask is
+// set. Marks are loaded in host byte order.
+func markMatch(reg, mark uint32, mask *uint32, op expr.CmpOp) []expr.Any {
+	var exprs []expr.Any
+	if mask != nil {
+		exprs = append(exprs, &expr.Bitwise{
+			DestRegister:   reg,
+			SourceRegister: reg,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(*mask),
+			Xor:            make([]byte, 4),
+		})
+	}
+	return append(exprs, &expr.Cmp{Op: op, Register: reg, Data: binaryutil.NativeEndian.PutUint32(mark)})
+}
+
+// protocolOffset is the offset of the protocol field of the IPv4 header, or
+// of the next header field of the IPv6 header.
+func protocolOffset(family nftables.TableFamily) uint32 {
+	if family == nftables.TableFamilyIPv6 {
+		return 6
+	}
+	return 9
+}
+
+// dscpMatch compares the DSCP, the upper 6 bits of the IPv4 TOS byte or of
+// the IPv6 traffic class. The traffic class straddles the first two bytes of
+// the IPv6 header, after the version.
+func dscpMatch(regs *regAllocator, family nftables.TableFamily, dscp uint8, op expr.CmpOp) []expr.Any {
+	offset, mask, data := uint32(1), []byte{0xfc}, []byte{dscp << 2}
+	if family == nftables.TableFamilyIPv6 {
+		offset, mask, data = 0, []byte{0x0f, 0xc0}, []byte{dscp >> 2, dscp << 6}
+	}
+	len := uint32(len(mask))
+	reg := regs.alloc(len)
+	return []expr.Any{
+		&expr.Payload{
+			DestRegister: reg,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       offset,
+			Len:          len,
+		},
+		&expr.Bitwise{
+			DestRegister:   reg,
+			SourceRegister: reg,
+			Len:            len,
+			Mask:           mask,
+			Xor:            make([]byte, len),
+		},
+		&expr.Cmp{Op: op, Register: reg, Data: data},
+	}
+}
+
+// fragmentMatch matches fragmented packets: IPv4 packets with the more
+// fragments flag or a fragment offset set, and IPv6 packets carrying a
+// fragment header.
+func fragmentMatch(regs *regAllocator, family nftables.TableFamily) []expr.Any {
+	if family == nftables.TableFamilyIPv6 {
+		reg := regs.alloc(1)
+		return []expr.Any{
+			&expr.Exthdr{
+				Op:           expr.ExthdrOpIpv6,
+				Type:         unix.IPPROTO_FRAGMENT,
+				Len:          1,
+				Flags:        unix.NFT_EXTHDR_F_PRESENT,
+				DestRegister: reg,
+			},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: reg, Data: []byte{1}},
+		}
+	}
+
+	reg := regs.alloc(2)
+	return []expr.Any{
+		&expr.Payload{
+			DestRegister: reg,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       6, // flags and fragment offset
+			Len:          2,
+		},
+		&expr.Bitwise{
+			DestRegister:   reg,
+			SourceRegister: reg,
+			Len:            2,
+			Mask:           fragmentMask,
+			Xor:            make([]byte, 2),
+		},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: reg, Data: make([]byte, 2)},
+	}
+}
+
+// fragmentMask selects the more fragments flag and the fragment offset of
+// the IPv4 header.
+var fragmentMask = []byte{0x3f, 0xff}
+
+// icmpMatch compares the ICMP type (offset 0) or code (offset 1) byte. ICMP
+// and ICMPv6 share the layout.
+func icmpMatch(regs *regAllocator, value uint8, offset uint32, op expr.CmpOp) []expr.Any {
+	reg := regs.alloc(1)
+	return []expr.Any{
+		&expr.Payload{
+			DestRegister: reg,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       offset,
+			Len:          1,
+		},
+		&expr.Cmp{Op: op, Register: reg, Data: []byte{value}},
+	}
+}
+
+// ifnameMatch compares the input or output interface name against name. The
+// kernel loads the NUL padded name, so the whole buffer is compared.
+func ifnameMatch(regs *regAllocator, key expr.MetaKey, name string, op expr.CmpOp) ([]expr.Any, error) {
+	if len(name) >= ifNameLen {
+		return nil, fmt.Errorf("interface name %q is too long", name)
+	}
+	data := make([]byte, ifNameLen)
+	copy(data, name)
+	reg := regs.alloc(ifNameLen)
+	return []expr.Any{
+		&expr.Meta{Key: key, Register: reg},
+		&expr.Cmp{Op: op, Register: reg, Data: data},
+	}, nil
+}
+
+// etherMatch checks that the packet came in on an Ethernet device, like nft
+// does before an ether match. Other devices have no or a different link layer
+// header, which would be read as garbage.
+func etherMatch(regs *regAllocator) []expr.Any {
+	reg := regs.alloc(2)
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyIIFTYPE, Register: reg},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: reg, Data: binaryutil.NativeEndian.PutUint16(unix.ARPHRD_ETHER)},
+	}
+}
+
+// macMatch compares the Ethernet address at offset in the link layer header
+// against mac.
+func macMatch(regs *regAllocator, mac types.MacAddr, offset uint32, op expr.CmpOp) []expr.Any {
+	reg := regs.alloc(6)
+	return []expr.Any{
+		&expr.Payload{
+			DestRegister: reg,
+			Base:         expr.PayloadBaseLLHeader,
+			Offset:       offset,
+			Len:          6,
+		},
+		&expr.Cmp{Op: op, Register: reg, Data: mac[:]},
+	}
+}
+
+// portRangeMatch loads the port at offset in the transport header and checks
+// that it lies within r.
+func portRangeMatch(regs *regAllocator, r types.PortRange, offset uint32, op expr.CmpOp) []expr.Any {
+	reg := regs.alloc(2)
+	return []expr.Any{
+		&expr.Payload{
+			DestRegister: reg,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       offset,
+			Len:          2,
+		},
+		&expr.Range{
+			Op:       op,
+			Register: reg,
+			FromData: binaryutil.BigEndian.PutUint16(r.Min),
+			ToData:   binaryutil.BigEndian.PutUint16(r.Max),
+		},
+	}
+}
+
+// prefixBits returns the prefix length described by a contiguous mask.
+func prefixBits(mask []byte) (int, error) {
+	bits := 0
+	done := false
+	for _, b := range mask {
+		for i := 7; i >= 0; i-- {
+			set := b&(1<<i) != 0
+			switch {
+			case set && done:
+				return 0, fmt.Errorf("non-contiguous mask")
+			case set:
+				bits++
+			default:
+				done = true
+			}
+		}
+	}
+	return bits, nil
+}
+
 func unmarshalRule(rule *nftables.Rule) (*types.Counter, error) {
 	rulespec := &types.Counter{}
 	parser := &ruleUnmarshaler{
 		counter: rulespec,
-		regs:    make(map[uint32]registerType),
+		regs:    make(map[uint32]regValue),
 	}
+	if rule.Table != nil {
+		parser.family = rule.Table.Family
+	}
+	tableFamily := parser.family
 
 	for _, e := range rule.Exprs {
 		if err := parser.unmarshalExpr(e); err != nil {
@@ -153,6 +790,21 @@ func unmarshalRule(rule *nftables.Rule) (*types.Counter, error) {
 	if !parser.hasCounterExpr {
 		return nil, fmt.Errorf("rule has no counter")
 	}
+	// The Ethernet check only goes with, and must guard, a mac match.
+	if parser.ether != (rulespec.SrcMac.IsValid() || rulespec.DstMac.IsValid()) {
+		return nil, fmt.Errorf("unsupported link layer match")
+	}
+	// In an inet table the family check goes with, and must guard, the
+	// addresses that select it.
+	if tableFamily == nftables.TableFamilyINet {
+		var want nftables.TableFamily
+		if ip := rulespec.IPFamily(types.TableFamilyInet); ip != types.TableFamilyInet {
+			want = nftables.TableFamily(ip)
+		}
+		if parser.nfproto != want {
+			return nil, fmt.Errorf("unsupported nfproto match")
+		}
+	}
 
 	name, ok := userdata.GetString(rule.UserData, userdata.TypeComment)
 	if !ok {
@@ -166,81 +818,273 @@ func unmarshalRule(rule *nftables.Rule) (*types.Counter, error) {
 type registerType string
 
 const (
-	regProtocol registerType = "protocol"
-	regSrcPort  registerType = "src_port"
-	regDstPort  registerType = "dst_port"
-	regTcpFlag  registerType = "tcp_flag"
-	regSrcAddr  registerType = "src_addr"
-	regDstAddr  registerType = "dst_addr"
+	regProtocol  registerType = "protocol"
+	regIPProto   registerType = "ip_protocol"
+	regSrcPort   registerType = "src_port"
+	regDstPort   registerType = "dst_port"
+	regTcpFlag   registerType = "tcp_flag"
+	regTcpWindow registerType = "tcp_window"
+	regSrcAddr   registerType = "src_addr"
+	regDstAddr   registerType = "dst_addr"
+	regIcmpType  registerType = "icmp_type"
+	regIcmpCode  registerType = "icmp_code"
+	regIif       registerType = "iif"
+	regOif       registerType = "oif"
+	regCtHelper  registerType = "ct_helper"
+	regCtState   registerType = "ct_state"
+	regCtDir     registerType = "ct_dir"
+	regMark      registerType = "mark"
+	regCtMark    registerType = "ct_mark"
+	regLen       registerType = "len"
+	regDscp      registerType = "dscp"
+	regFragment  registerType = "fragmented"
+	regIifType   registerType = "iiftype"
+	regNfproto   registerType = "nfproto"
+	regSrcMac    registerType = "src_mac"
+	regDstMac    registerType = "dst_mac"
 )
 
+// regValue describes what a register currently holds.
+type regValue struct {
+	typ  registerType
+	size uint32
+	mask []byte // mask applied by a bitwise expression, if any
+}
+
 type ruleUnmarshaler struct {
 	counter        *types.Counter
-	regs           map[uint32]registerType
+	regs           map[uint32]regValue
 	hasCounterExpr bool
+	limitDropped   bool
+	ether          bool // the input device was checked to be Ethernet
+	family         nftables.TableFamily
+	nfproto        nftables.TableFamily // the family the packets were checked to be, in an inet table
+}
+
+// store records that size bytes of typ were loaded into reg, forgetting any
+// value that the load overwrote.
+func (r *ruleUnmarshaler) store(reg uint32, typ registerType, size uint32) {
+	r.storeValue(reg, regValue{typ: typ, size: size})
+}
+
+func (r *ruleUnmarshaler) storeValue(reg uint32, value regValue) {
+	first, last := regSpan(reg, value.size)
+	for other, v := range r.regs {
+		otherFirst, otherLast := regSpan(other, v.size)
+		if first <= otherLast && otherFirst <= last {
+			delete(r.regs, other)
+		}
+	}
+	r.regs[reg] = value
+}
+
+// forget drops whatever is known about the registers overlapping size bytes
+// at reg.
+func (r *ruleUnmarshaler) forget(reg, size uint32) {
+	r.storeValue(reg, regValue{size: size})
+	delete(r.regs, reg)
+}
+
+// load returns the type of the value held in reg.
+func (r *ruleUnmarshaler) load(reg uint32) (registerType, bool) {
+	v, ok := r.regs[reg]
+	return v.typ, ok
+}
+
+// mask returns the mask applied to the value held in reg, if any.
+func (r *ruleUnmarshaler) mask(reg uint32) []byte {
+	return r.regs[reg].mask
 }
 
 func (r *ruleUnmarshaler) unmarshalExpr(e expr.Any) error {
 	switch ex := e.(type) {
 	case *expr.Meta:
 		return r.unmarshalMeta(ex)
+	case *expr.Ct:
+		return r.unmarshalCt(ex)
 	case *expr.Payload:
 		return r.unmarshalPayload(ex)
 	case *expr.Cmp:
 		return r.unmarshalCmp(ex)
+	case *expr.Range:
+		return r.unmarshalRange(ex)
 	case *expr.Counter:
 		return r.unmarshalCounter(ex)
 	case *expr.Bitwise:
-		// TCP flags bitwise masking - we can ignore this
-		return nil
+		return r.unmarshalBitwise(ex)
+	case *expr.Byteorder:
+		return r.unmarshalByteorder(ex)
+	case *expr.Limit:
+		return r.unmarshalLimit(ex)
+	case *expr.Verdict:
+		return r.unmarshalVerdict(ex)
+	case *expr.Quota:
+		return r.unmarshalQuota(ex)
+	case *expr.Lookup:
+		return r.unmarshalLookup(ex)
+	case *expr.Exthdr:
+		return r.unmarshalExthdr(ex)
 	default:
 		return fmt.Errorf("unknown expression type")
 	}
 }
 
 func (r *ruleUnmarshaler) unmarshalMeta(e *expr.Meta) error {
-	if e.Key == expr.MetaKeyL4PROTO {
-		r.regs[e.Register] = regProtocol
-		return nil
+	switch e.Key {
+	case expr.MetaKeyL4PROTO:
+		r.store(e.Register, regProtocol, 1)
+	case expr.MetaKeyIIFNAME:
+		r.store(e.Register, regIif, ifNameLen)
+	case expr.MetaKeyOIFNAME:
+		r.store(e.Register, regOif, ifNameLen)
+	case expr.MetaKeyLEN:
+		r.store(e.Register, regLen, 4)
+	case expr.MetaKeyIIFTYPE:
+		r.store(e.Register, regIifType, 2)
+	case expr.MetaKeyMARK:
+		r.store(e.Register, regMark, 4)
+	case expr.MetaKeyNFPROTO:
+		r.store(e.Register, regNfproto, 1)
+	default:
+		return fmt.Errorf("unsupported meta key")
 	}
-	return fmt.Errorf("unsupported meta key")
+	return nil
+}
+
+func (r *ruleUnmarshaler) unmarshalCt(e *expr.Ct) error {
+	switch e.Key {
+	case expr.CtKeyHELPER:
+		r.store(e.Register, regCtHelper, ctHelperLen)
+	case expr.CtKeySTATE:
+		r.store(e.Register, regCtState, 4)
+	case expr.CtKeyDIRECTION:
+		r.store(e.Register, regCtDir, 1)
+	case expr.CtKeyMARK:
+		r.store(e.Register, regCtMark, 4)
+	default:
+		return fmt.Errorf("unsupported ct key")
+	}
+	return nil
 }
 
 func (r *ruleUnmarshaler) unmarshalPayload(e *expr.Payload) error {
+	var typ registerType
 	switch {
-	// Transport layer (ports, TCP flags)
+	// Transport layer (ports, TCP flags and window, ICMP type and code)
 	case e.Base == expr.PayloadBaseTransportHeader && e.Offset == 0 && e.Len == 2:
-		r.regs[e.DestRegister] = regSrcPort
+		typ = regSrcPort
 	case e.Base == expr.PayloadBaseTransportHeader && e.Offset == 2 && e.Len == 2:
-		r.regs[e.DestRegister] = regDstPort
+		typ = regDstPort
 	case e.Base == expr.PayloadBaseTransportHeader && e.Offset == 13 && e.Len == 1:
-		r.regs[e.DestRegister] = regTcpFlag
+		typ = regTcpFlag
+	case e.Base == expr.PayloadBaseTransportHeader && e.Offset == 14 && e.Len == 2:
+		typ = regTcpWindow
+	case e.Base == expr.PayloadBaseTransportHeader && e.Offset == 0 && e.Len == 1:
+		typ = regIcmpType
+	case e.Base == expr.PayloadBaseTransportHeader && e.Offset == 1 && e.Len == 1:
+		typ = regIcmpCode
+
+	// Link layer
+	case e.Base == expr.PayloadBaseLLHeader && e.Offset == 0 && e.Len == 6:
+		typ = regDstMac
+	case e.Base == expr.PayloadBaseLLHeader && e.Offset == 6 && e.Len == 6:
+		typ = regSrcMac
+
+	// Network layer - protocol, at a different offset in each family
+	case e.Base == expr.PayloadBaseNetworkHeader && e.Len == 1 && e.Offset == protocolOffset(r.family):
+		typ = regIPProto
 
 	// Network layer - IPv4
+	case e.Base == expr.PayloadBaseNetworkHeader && e.Offset == 1 && e.Len == 1:
+		typ = regDscp
+	case e.Base == expr.PayloadBaseNetworkHeader && e.Offset == 6 && e.Len == 2:
+		typ = regFragment
 	case e.Base == expr.PayloadBaseNetworkHeader && e.Offset == 12 && e.Len == 4:
-		r.regs[e.DestRegister] = regSrcAddr
+		typ = regSrcAddr
 	case e.Base == expr.PayloadBaseNetworkHeader && e.Offset == 16 && e.Len == 4:
-		r.regs[e.DestRegister] = regDstAddr
+		typ = regDstAddr
 
 	// Network layer - IPv6
+	case e.Base == expr.PayloadBaseNetworkHeader && e.Offset == 0 && e.Len == 2:
+		typ = regDscp
 	case e.Base == expr.PayloadBaseNetworkHeader && e.Offset == 8 && e.Len == 16:
-		r.regs[e.DestRegister] = regSrcAddr
+		typ = regSrcAddr
 	case e.Base == expr.PayloadBaseNetworkHeader && e.Offset == 24 && e.Len == 16:
-		r.regs[e.DestRegister] = regDstAddr
+		typ = regDstAddr
 
 	default:
 		return fmt.Errorf("unsupported payload")
 	}
 
+	r.store(e.DestRegister, typ, e.Len)
+	return nil
+}
+
+func (r *ruleUnmarshaler) unmarshalExthdr(e *expr.Exthdr) error {
+	// Only the presence check of the IPv6 fragment header is supported.
+	if e.Op != expr.ExthdrOpIpv6 || e.Type != unix.IPPROTO_FRAGMENT || e.Flags != unix.NFT_EXTHDR_F_PRESENT || e.Len != 1 {
+		return fmt.Errorf("unsupported exthdr")
+	}
+	r.store(e.DestRegister, regFragment, e.Len)
+	return nil
+}
+
+func (r *ruleUnmarshaler) unmarshalBitwise(e *expr.Bitwise) error {
+	// The masked value keeps the meaning of the source register. Only the
+	// mask is recorded, flipping bits would change what the value compares
+	// against.
+	regType, ok := r.load(e.SourceRegister)
+	if !ok {
+		return fmt.Errorf("unknown register")
+	}
+	if !bytes.Equal(e.Xor, make([]byte, len(e.Xor))) {
+		return fmt.Errorf("unsupported bitwise xor")
+	}
+	r.storeValue(e.DestRegister, regValue{typ: regType, size: e.Len, mask: e.Mask})
+	return nil
+}
+
+func (r *ruleUnmarshaler) unmarshalByteorder(e *expr.Byteorder) error {
+	// Only the length is converted, the value keeps its meaning.
+	regType, ok := r.load(e.SourceRegister)
+	if !ok {
+		return fmt.Errorf("unknown register")
+	}
+	if regType != regLen || e.Op != expr.ByteorderHton {
+		return fmt.Errorf("unsupported byteorder conversion")
+	}
+	r.store(e.DestRegister, regType, e.Len)
 	return nil
 }
 
 func (r *ruleUnmarshaler) unmarshalCmp(e *expr.Cmp) error {
-	regType, ok := r.regs[e.Register]
+	regType, ok := r.load(e.Register)
 	if !ok {
 		return fmt.Errorf("unknown register")
 	}
 
+	if regType == regLen {
+		if len(e.Data) != 4 {
+			return fmt.Errorf("invalid length size")
+		}
+		switch e.Op {
+		case expr.CmpOpGte:
+			r.counter.MinLen = binaryutil.BigEndian.Uint32(e.Data)
+		case expr.CmpOpLte:
+			r.counter.MaxLen = binaryutil.BigEndian.Uint32(e.Data)
+		default:
+			return fmt.Errorf("unsupported length comparison")
+		}
+		return nil
+	}
+
+	if e.Op != expr.CmpOpEq && e.Op != expr.CmpOpNeq {
+		return fmt.Errorf("unsupported comparison operator")
+	}
+
+	// field is the counter field the comparison matches on.
+	field := string(regType)
+
 	switch regType {
 	case regProtocol:
 		if len(e.Data) != 1 {
@@ -248,6 +1092,14 @@ func (r *ruleUnmarshaler) unmarshalCmp(e *expr.Cmp) error {
 		}
 		r.counter.Protocol = types.Protocol(e.Data[0])
 
+	case regIPProto:
+		if len(e.Data) != 1 {
+			return fmt.Errorf("invalid protocol length")
+		}
+		r.counter.Protocol = types.Protocol(e.Data[0])
+		r.counter.ProtoHeader = true
+		field = "protocol"
+
 	case regSrcPort:
 		if len(e.Data) != 2 {
 			return fmt.Errorf("invalid port length")
@@ -268,6 +1120,21 @@ func (r *ruleUnmarshaler) unmarshalCmp(e *expr.Cmp) error {
 		if !ok {
 			return fmt.Errorf("invalid address")
 		}
+		if mask := r.mask(e.Register); mask != nil {
+			bits, err := prefixBits(mask)
+			if err != nil {
+				return err
+			}
+			prefix := netip.PrefixFrom(addr, bits)
+			if regType == regSrcAddr {
+				r.counter.SrcNet = prefix
+				field = "src_net"
+			} else {
+				r.counter.DstNet = prefix
+				field = "dst_net"
+			}
+			break
+		}
 		if regType == regSrcAddr {
 			r.counter.SrcAddr = addr
 		} else {
@@ -278,12 +1145,229 @@ func (r *ruleUnmarshaler) unmarshalCmp(e *expr.Cmp) error {
 		if len(e.Data) != 1 {
 			return fmt.Errorf("invalid flag length")
 		}
-		r.counter.TcpFlags = types.TcpFlagsFromByte(e.Data[0])
+		mask, flags := r.mask(e.Register), e.Data[0]
+		if e.Op == expr.CmpOpNeq {
+			// An any match keeps the flags in the mask and compares != 0.
+			if len(mask) == 1 && flags == 0 {
+				r.counter.TcpFlags = types.TcpFlagsFromByte(mask[0])
+				r.counter.TcpFlagsOp = types.TcpFlagsOpAny
+				return nil
+			}
+			break
+		}
+		switch {
+		case len(mask) != 1:
+			r.counter.TcpFlags = types.TcpFlagsFromByte(flags)
+		case flags == 0:
+			r.counter.TcpFlags = types.TcpFlagsFromByte(mask[0])
+			r.counter.TcpFlagsOp = types.TcpFlagsOpNone
+		case mask[0] == types.TcpFlagsExactMask|flags:
+			r.counter.TcpFlags = types.TcpFlagsFromByte(flags)
+		case mask[0] == flags:
+			r.counter.TcpFlags = types.TcpFlagsFromByte(flags)
+			r.counter.TcpFlagsOp = types.TcpFlagsOpAll
+		default:
+			return fmt.Errorf("unsupported tcp flags mask")
+		}
+
+	case regTcpWindow:
+		if len(e.Data) != 2 || e.Op != expr.CmpOpEq {
+			return fmt.Errorf("unsupported tcp window match")
+		}
+		window := binaryutil.BigEndian.Uint16(e.Data)
+		r.counter.TcpWindow = &window
+		return nil
+
+	case regIcmpType, regIcmpCode:
+		if len(e.Data) != 1 {
+			return fmt.Errorf("invalid ICMP field length")
+		}
+		value := e.Data[0]
+		if regType == regIcmpType {
+			r.counter.IcmpType = &value
+		} else {
+			r.counter.IcmpCode = &value
+		}
+
+	case regIif, regOif:
+		if len(e.Data) > ifNameLen {
+			return fmt.Errorf("invalid interface name length")
+		}
+		name := strings.TrimRight(string(e.Data), "\x00")
+		if regType == regIif {
+			r.counter.Iif = name
+		} else {
+			r.counter.Oif = name
+		}
+
+	case regNfproto:
+		// Only the family check written by nfprotoMatch is supported. The
+		// header fields that follow are read in that family.
+		if e.Op != expr.CmpOpEq || len(e.Data) != 1 || r.family != nftables.TableFamilyINet ||
+			e.Data[0] != byte(nftables.TableFamilyIPv4) && e.Data[0] != byte(nftables.TableFamilyIPv6) {
+			return fmt.Errorf("unsupported nfproto match")
+		}
+		r.nfproto = nftables.TableFamily(e.Data[0])
+		r.family = r.nfproto
+		return nil
+
+	case regIifType:
+		// Only the Ethernet check written by etherMatch is supported.
+		if e.Op != expr.CmpOpEq || !bytes.Equal(e.Data, binaryutil.NativeEndian.PutUint16(unix.ARPHRD_ETHER)) {
+			return fmt.Errorf("unsupported iiftype match")
+		}
+		r.ether = true
+		return nil
+
+	case regSrcMac, regDstMac:
+		var mac types.MacAddr
+		if len(e.Data) != len(mac) {
+			return fmt.Errorf("invalid mac address length")
+		}
+		copy(mac[:], e.Data)
+		if regType == regSrcMac {
+			r.counter.SrcMac = mac
+		} else {
+			r.counter.DstMac = mac
+		}
+
+	case regCtHelper:
+		if len(e.Data) > ctHelperLen {
+			return fmt.Errorf("invalid helper length")
+		}
+		r.counter.CtHelper = strings.TrimRight(string(e.Data), "\x00")
+
+	case regMark, regCtMark:
+		mask := r.mask(e.Register)
+		if len(e.Data) != 4 || mask != nil && len(mask) != 4 {
+			return fmt.Errorf("invalid mark length")
+		}
+		mark := binaryutil.NativeEndian.Uint32(e.Data)
+		var markMask *uint32
+		if mask != nil {
+			m := binaryutil.NativeEndian.Uint32(mask)
+			markMask = &m
+		}
+		if regType == regMark {
+			r.counter.Mark, r.counter.MarkMask = &mark, markMask
+		} else {
+			r.counter.CtMark, r.counter.CtMarkMask = &mark, markMask
+		}
+
+	case regDscp:
+		// The DSCP is only read through the mask written by dscpMatch.
+		mask := r.mask(e.Register)
+		var dscp uint8
+		switch {
+		case len(e.Data) == 1 && bytes.Equal(mask, []byte{0xfc}):
+			dscp = e.Data[0] >> 2
+		case len(e.Data) == 2 && bytes.Equal(mask, []byte{0x0f, 0xc0}):
+			dscp = e.Data[0]<<2 | e.Data[1]>>6
+		default:
+			return fmt.Errorf("unsupported dscp match")
+		}
+		r.counter.Dscp = &dscp
+
+	case regFragment:
+		// Both forms written by fragmentMatch are checks, not negations.
+		switch {
+		case e.Op == expr.CmpOpNeq && bytes.Equal(r.mask(e.Register), fragmentMask) && bytes.Equal(e.Data, make([]byte, 2)):
+		case e.Op == expr.CmpOpEq && r.mask(e.Register) == nil && bytes.Equal(e.Data, []byte{1}):
+		default:
+			return fmt.Errorf("unsupported fragment match")
+		}
+		r.counter.Fragmented = true
+		return nil
+
+	case regCtState:
+		// The states live in the mask, the comparison is always != 0.
+		mask := r.mask(e.Register)
+		if len(mask) != 4 || e.Op != expr.CmpOpNeq || !bytes.Equal(e.Data, make([]byte, 4)) {
+			return fmt.Errorf("unsupported ct state match")
+		}
+		r.counter.CtState = types.ConntrackStatesFromMask(binaryutil.NativeEndian.Uint32(mask))
+		return nil
+
+	case regCtDir:
+		if len(e.Data) != 1 || e.Op != expr.CmpOpEq {
+			return fmt.Errorf("unsupported ct direction match")
+		}
+		for dir, value := range ctDirections {
+			if value == e.Data[0] {
+				r.counter.CtDir = dir
+				return nil
+			}
+		}
+		return fmt.Errorf("invalid ct direction %d", e.Data[0])
 
 	default:
 		return fmt.Errorf("unknown register type")
 	}
 
+	if e.Op == expr.CmpOpNeq {
+		if !types.Negatable(field) {
+			return fmt.Errorf("unsupported negation of %s", field)
+		}
+		r.counter.Negate = append(r.counter.Negate, field)
+	}
+
+	return nil
+}
+
+func (r *ruleUnmarshaler) unmarshalRange(e *expr.Range) error {
+	regType, ok := r.load(e.Register)
+	if !ok {
+		return fmt.Errorf("unknown register")
+	}
+
+	if e.Op != expr.CmpOpEq && e.Op != expr.CmpOpNeq {
+		return fmt.Errorf("unsupported range operator")
+	}
+
+	var field string
+	switch regType {
+	case regSrcPort, regDstPort:
+		if len(e.FromData) != 2 || len(e.ToData) != 2 {
+			return fmt.Errorf("invalid port range length")
+		}
+		portRange := types.PortRange{
+			Min: binaryutil.BigEndian.Uint16(e.FromData),
+			Max: binaryutil.BigEndian.Uint16(e.ToData),
+		}
+		if regType == regSrcPort {
+			r.counter.SrcPortRange = portRange
+			field = "src_port_range"
+		} else {
+			r.counter.DstPortRange = portRange
+			field = "dst_port_range"
+		}
+
+	case regSrcAddr, regDstAddr:
+		min, okMin := netip.AddrFromSlice(e.FromData)
+		max, okMax := netip.AddrFromSlice(e.ToData)
+		if !okMin || !okMax || len(e.FromData) != len(e.ToData) {
+			return fmt.Errorf("invalid address range")
+		}
+		addrRange := types.AddrRange{Min: min, Max: max}
+		if regType == regSrcAddr {
+			r.counter.SrcAddrRange = addrRange
+			field = "src_addr_range"
+		} else {
+			r.counter.DstAddrRange = addrRange
+			field = "dst_addr_range"
+		}
+
+	default:
+		return fmt.Errorf("unsupported range on %s", regType)
+	}
+
+	if e.Op == expr.CmpOpNeq {
+		if !types.Negatable(field) {
+			return fmt.Errorf("unsupported negation of %s", field)
+		}
+		r.counter.Negate = append(r.counter.Negate, field)
+	}
+
 	return nil
 }
 
@@ -293,3 +1377,84 @@ func (r *ruleUnmarshaler) unmarshalCounter(e *expr.Counter) error {
 	r.counter.Bytes = e.Bytes
 	return nil
 }
+
+// unmarshalLookup records the named set a rule matches against. flowmon does
+// not create sets itself, but rules written by hand or by other tools can
+// reference them and are still reported.
+func (r *ruleUnmarshaler) unmarshalLookup(e *expr.Lookup) error {
+	// A whole address looked up in a set is what setMatch writes.
+	if v, ok := r.regs[e.SourceRegister]; ok && !e.IsDestRegSet && v.mask == nil && (v.typ == regSrcAddr || v.typ == regDstAddr) {
+		field := "src_set"
+		if v.typ == regSrcAddr {
+			r.counter.SrcSet = e.SetName
+		} else {
+			r.counter.DstSet = e.SetName
+			field = "dst_set"
+		}
+		if e.Invert {
+			r.counter.Negate = append(r.counter.Negate, field)
+		}
+		return nil
+	}
+
+	// The negation is kept with the name, there is no field to record it.
+	name := e.SetName
+	if e.Invert {
+		name = "!" + name
+	}
+	r.counter.Sets = append(r.counter.Sets, name)
+	if e.IsDestRegSet {
+		// A map lookup writes a value of unknown size and meaning.
+		r.forget(e.DestRegister, 16)
+	}
+	return nil
+}
+
+func (r *ruleUnmarshaler) unmarshalLimit(e *expr.Limit) error {
+	if !r.hasCounterExpr || !e.Over || r.counter.Quota != 0 {
+		return fmt.Errorf("unsupported limit")
+	}
+	limit := &types.Limit{Rate: e.Rate, Burst: e.Burst, Bytes: e.Type == expr.LimitTypePktBytes}
+	for unit, t := range limitUnits {
+		if t == e.Unit {
+			limit.Unit = unit
+		}
+	}
+	if limit.Unit == "" {
+		return fmt.Errorf("unsupported limit unit")
+	}
+	r.counter.Limit = limit
+	return nil
+}
+
+func (r *ruleUnmarshaler) unmarshalQuota(e *expr.Quota) error {
+	if !r.hasCounterExpr || e.Over || e.Bytes == 0 || r.counter.Limit != nil || r.counter.Verdict != "" {
+		return fmt.Errorf("unsupported quota")
+	}
+	r.counter.Quota = e.Bytes
+	r.counter.QuotaUsed = e.Consumed
+	return nil
+}
+
+func (r *ruleUnmarshaler) unmarshalVerdict(e *expr.Verdict) error {
+	if !r.hasCounterExpr || r.counter.Verdict != "" || r.counter.Quota != 0 {
+		return fmt.Errorf("unsupported verdict")
+	}
+
+	// A limit is always followed by a drop of the excess traffic.
+	if r.counter.Limit != nil && !r.limitDropped {
+		if e.Kind != expr.VerdictDrop {
+			return fmt.Errorf("unsupported limit verdict")
+		}
+		r.limitDropped = true
+		return nil
+	}
+
+	for verdict, kind := range verdictKinds {
+		if kind == e.Kind {
+			r.counter.Verdict = verdict
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported verdict")
+}
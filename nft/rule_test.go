@@ -0,0 +1,626 @@
+package nft
+
+import (
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"github.com/nickgarlis/flowmon/types"
+)
+
+func TestRuleRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		family  nftables.TableFamily
+		counter types.Counter
+	}{
+		{
+			name:    "label only",
+			family:  nftables.TableFamilyIPv4,
+			counter: types.Counter{Label: "all"},
+		},
+		{
+			name:   "ipv4 all fields",
+			family: nftables.TableFamilyIPv4,
+			counter: types.Counter{
+				Label:    "full",
+				SrcAddr:  netip.MustParseAddr("10.0.0.1"),
+				DstAddr:  netip.MustParseAddr("10.0.0.2"),
+				Protocol: types.ProtocolTCP,
+				SrcPort:  1234,
+				DstPort:  443,
+				TcpFlags: []types.TcpFlag{types.TcpFlagSYN, types.TcpFlagACK},
+			},
+		},
+		{
+			name:    "ipv4 protocol header",
+			family:  nftables.TableFamilyIPv4,
+			counter: types.Counter{Label: "udp", Protocol: types.ProtocolUDP, ProtoHeader: true, DstPort: 53},
+		},
+		{
+			name:    "ipv6 negated next header",
+			family:  nftables.TableFamilyIPv6,
+			counter: types.Counter{Label: "not_tcp", Protocol: types.ProtocolTCP, ProtoHeader: true, Negate: []string{"protocol"}},
+		},
+		{
+			name:   "ipv6 all fields",
+			family: nftables.TableFamilyIPv6,
+			counter: types.Counter{
+				Label:    "full6",
+				SrcAddr:  netip.MustParseAddr("2001:db8::1"),
+				DstAddr:  netip.MustParseAddr("2001:db8::2"),
+				Protocol: types.ProtocolUDP,
+				SrcPort:  53,
+				DstPort:  5353,
+			},
+		},
+		{
+			name:   "negated fields",
+			family: nftables.TableFamilyIPv4,
+			counter: types.Counter{
+				Label:    "not_https",
+				SrcAddr:  netip.MustParseAddr("10.0.0.1"),
+				Protocol: types.ProtocolTCP,
+				DstPort:  443,
+				Negate:   []string{"src_addr", "dst_port"},
+			},
+		},
+		{
+			name:   "ipv4 prefixes",
+			family: nftables.TableFamilyIPv4,
+			counter: types.Counter{
+				Label:  "office",
+				SrcNet: netip.MustParsePrefix("10.0.0.0/8"),
+				DstNet: netip.MustParsePrefix("192.0.2.7/32"),
+			},
+		},
+		{
+			name:    "ipv6 prefix",
+			family:  nftables.TableFamilyIPv6,
+			counter: types.Counter{Label: "site", DstNet: netip.MustParsePrefix("2001:db8:1200::/40")},
+		},
+		{
+			name:    "sctp ports",
+			family:  nftables.TableFamilyIPv4,
+			counter: types.Counter{Label: "diameter", Protocol: types.ProtocolSCTP, DstPort: 3868},
+		},
+		{
+			name:   "port ranges",
+			family: nftables.TableFamilyIPv4,
+			counter: types.Counter{
+				Label:        "ephemeral",
+				Protocol:     types.ProtocolUDP,
+				SrcPortRange: types.PortRange{Min: 32768, Max: 60999},
+				DstPortRange: types.PortRange{Min: 53, Max: 53},
+			},
+		},
+		{
+			name:    "conntrack helper",
+			family:  nftables.TableFamilyIPv4,
+			counter: types.Counter{Label: "sip", Protocol: types.ProtocolUDP, CtHelper: "sip"},
+		},
+		{
+			name:    "interfaces",
+			family:  nftables.TableFamilyIPv4,
+			counter: types.Counter{Label: "wan", Iif: "eth0", Oif: "wg0", Negate: []string{"oif"}},
+		},
+		{
+			name:    "icmp type and code",
+			family:  nftables.TableFamilyIPv4,
+			counter: types.Counter{Label: "unreachable", Protocol: types.ProtocolICMP, IcmpType: ptr(uint8(3)), IcmpCode: ptr(uint8(0))},
+		},
+		{
+			name:    "icmpv6 echo request",
+			family:  nftables.TableFamilyIPv6,
+			counter: types.Counter{Label: "ping6", Protocol: types.ProtocolICMPv6, IcmpType: ptr(uint8(128)), IcmpCode: ptr(uint8(0))},
+		},
+		{
+			name:    "negated icmpv6 type",
+			family:  nftables.TableFamilyIPv6,
+			counter: types.Counter{Label: "not_echo", Protocol: types.ProtocolICMPv6, IcmpType: ptr(uint8(128)), Negate: []string{"icmp_type"}},
+		},
+		{
+			name:    "udplite ports",
+			family:  nftables.TableFamilyIPv4,
+			counter: types.Counter{Label: "voip", Protocol: types.ProtocolUDPLite, DstPort: 5004},
+		},
+		{
+			name:    "esp",
+			family:  nftables.TableFamilyIPv6,
+			counter: types.Counter{Label: "ipsec", Protocol: types.ProtocolESP, DstAddr: netip.MustParseAddr("2001:db8::1")},
+		},
+		{
+			name:    "packet length",
+			family:  nftables.TableFamilyIPv4,
+			counter: types.Counter{Label: "amplification", Protocol: types.ProtocolUDP, SrcPort: 53, MinLen: 512, MaxLen: 1500},
+		},
+		{
+			name:   "negated net and ranges",
+			family: nftables.TableFamilyIPv4,
+			counter: types.Counter{
+				Label:        "external",
+				SrcNet:       netip.MustParsePrefix("10.0.0.0/8"),
+				DstAddrRange: types.AddrRange{Min: netip.MustParseAddr("192.0.2.1"), Max: netip.MustParseAddr("192.0.2.9")},
+				Protocol:     types.ProtocolTCP,
+				DstPortRange: types.PortRange{Min: 1, Max: 1023},
+				Negate:       []string{"src_net", "dst_addr_range", "dst_port_range"},
+			},
+		},
+		{
+			name:   "ipv4 address ranges",
+			family: nftables.TableFamilyIPv4,
+			counter: types.Counter{
+				Label:        "acl",
+				SrcAddrRange: types.AddrRange{Min: netip.MustParseAddr("10.0.5.10"), Max: netip.MustParseAddr("10.0.5.50")},
+				DstAddrRange: types.AddrRange{Min: netip.MustParseAddr("192.0.2.1"), Max: netip.MustParseAddr("192.0.2.9")},
+			},
+		},
+		{
+			name:    "ipv6 address range",
+			family:  nftables.TableFamilyIPv6,
+			counter: types.Counter{Label: "acl6", SrcAddrRange: types.AddrRange{Min: netip.MustParseAddr("2001:db8::10"), Max: netip.MustParseAddr("2001:db8::ff")}},
+		},
+		{
+			name:    "any tcp flags",
+			family:  nftables.TableFamilyIPv4,
+			counter: types.Counter{Label: "closing", Protocol: types.ProtocolTCP, TcpFlags: []types.TcpFlag{types.TcpFlagFIN, types.TcpFlagRST}, TcpFlagsOp: types.TcpFlagsOpAny},
+		},
+		{
+			name:    "all tcp flags",
+			family:  nftables.TableFamilyIPv4,
+			counter: types.Counter{Label: "syn_ack", Protocol: types.ProtocolTCP, TcpFlags: []types.TcpFlag{types.TcpFlagSYN, types.TcpFlagACK}, TcpFlagsOp: types.TcpFlagsOpAll},
+		},
+		{
+			name:    "no tcp flags",
+			family:  nftables.TableFamilyIPv4,
+			counter: types.Counter{Label: "no_ecn", Protocol: types.ProtocolTCP, TcpFlags: []types.TcpFlag{types.TcpFlagECE, types.TcpFlagCWR}, TcpFlagsOp: types.TcpFlagsOpNone},
+		},
+		{
+			name:    "exact tcp flags beyond the default mask",
+			family:  nftables.TableFamilyIPv4,
+			counter: types.Counter{Label: "push", Protocol: types.ProtocolTCP, TcpFlags: []types.TcpFlag{types.TcpFlagPSH, types.TcpFlagACK}},
+		},
+		{
+			name:   "mac addresses",
+			family: nftables.TableFamilyIPv4,
+			counter: types.Counter{
+				Label:  "not_from_gateway",
+				SrcMac: types.MacAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01},
+				DstMac: types.MacAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+				Negate: []string{"src_mac"},
+			},
+		},
+		{
+			name:    "tcp window",
+			family:  nftables.TableFamilyIPv4,
+			counter: types.Counter{Label: "syn_64240", Protocol: types.ProtocolTCP, TcpFlags: []types.TcpFlag{types.TcpFlagSYN}, TcpWindow: ptr[uint16](64240)},
+		},
+		{
+			name:    "ipv4 fragments",
+			family:  nftables.TableFamilyIPv4,
+			counter: types.Counter{Label: "frags", Fragmented: true, Protocol: types.ProtocolUDP},
+		},
+		{
+			name:    "ipv6 fragments",
+			family:  nftables.TableFamilyIPv6,
+			counter: types.Counter{Label: "frags6", Fragmented: true},
+		},
+		{
+			name:    "ipv4 dscp",
+			family:  nftables.TableFamilyIPv4,
+			counter: types.Counter{Label: "voice", Protocol: types.ProtocolUDP, Dscp: ptr[uint8](46)},
+		},
+		{
+			name:    "ipv6 dscp",
+			family:  nftables.TableFamilyIPv6,
+			counter: types.Counter{Label: "cs7", Dscp: ptr[uint8](63)},
+		},
+		{
+			name:    "minimum length only",
+			family:  nftables.TableFamilyIPv6,
+			counter: types.Counter{Label: "jumbo", MinLen: 1501},
+		},
+		{
+			name:    "packet limit",
+			family:  nftables.TableFamilyIPv4,
+			counter: types.Counter{Label: "policed", Protocol: types.ProtocolUDP, DstPort: 53, Limit: &types.Limit{Rate: 100, Unit: types.LimitUnitSecond, Burst: 10}},
+		},
+		{
+			name:    "byte limit",
+			family:  nftables.TableFamilyIPv6,
+			counter: types.Counter{Label: "shaped", Limit: &types.Limit{Rate: 1 << 20, Unit: types.LimitUnitMinute, Bytes: true}},
+		},
+		{
+			name:    "quota",
+			family:  nftables.TableFamilyIPv4,
+			counter: types.Counter{Label: "capped", Protocol: types.ProtocolTCP, DstPort: 443, Quota: 1 << 30},
+		},
+		{
+			name:    "drop verdict",
+			family:  nftables.TableFamilyIPv4,
+			counter: types.Counter{Label: "blocked", SrcNet: netip.MustParsePrefix("198.51.100.0/24"), Verdict: types.VerdictDrop},
+		},
+		{
+			name:    "limit and accept verdict",
+			family:  nftables.TableFamilyIPv4,
+			counter: types.Counter{Label: "ssh", Protocol: types.ProtocolTCP, DstPort: 22, Limit: &types.Limit{Rate: 10, Unit: types.LimitUnitMinute}, Verdict: types.VerdictAccept},
+		},
+		{
+			name:   "conntrack state",
+			family: nftables.TableFamilyIPv6,
+			counter: types.Counter{
+				Label:    "new_https",
+				Protocol: types.ProtocolTCP,
+				DstPort:  443,
+				CtState:  []types.ConntrackState{types.ConntrackStateRelated, types.ConntrackStateNew},
+			},
+		},
+		{
+			name:    "conntrack direction",
+			family:  nftables.TableFamilyIPv4,
+			counter: types.Counter{Label: "responses", Protocol: types.ProtocolUDP, SrcPort: 53, CtDir: types.CtDirectionReply},
+		},
+		{
+			name:    "inet ipv4",
+			family:  nftables.TableFamilyINet,
+			counter: types.Counter{Label: "v4", SrcNet: netip.MustParsePrefix("10.0.0.0/8"), Dscp: ptr(uint8(46)), Fragmented: true, Protocol: types.ProtocolUDP, ProtoHeader: true},
+		},
+		{
+			name:    "inet ipv6",
+			family:  nftables.TableFamilyINet,
+			counter: types.Counter{Label: "v6", DstAddr: netip.MustParseAddr("2001:db8::1"), SrcSet: "local", Dscp: ptr(uint8(10)), Fragmented: true, Protocol: types.ProtocolTCP, ProtoHeader: true},
+		},
+		{
+			name:    "inet without addresses",
+			family:  nftables.TableFamilyINet,
+			counter: types.Counter{Label: "any", Protocol: types.ProtocolTCP, DstPort: 443},
+		},
+		{
+			name:    "negated sets",
+			family:  nftables.TableFamilyIPv6,
+			counter: types.Counter{Label: "foreign", SrcSet: "local", DstSet: "blocked", Negate: []string{"src_set", "dst_set"}},
+		},
+		{
+			// More matches than fit in the register file at once.
+			name:   "every field",
+			family: nftables.TableFamilyIPv6,
+			counter: types.Counter{
+				Label:        "everything",
+				SrcNet:       netip.MustParsePrefix("2001:db8:1::/48"),
+				DstAddrRange: types.AddrRange{Min: netip.MustParseAddr("2001:db8::10"), Max: netip.MustParseAddr("2001:db8::20")},
+				Dscp:         ptr(uint8(10)),
+				Protocol:     types.ProtocolTCP,
+				SrcPortRange: types.PortRange{Min: 1024, Max: 65535},
+				DstPort:      443,
+				TcpFlags:     []types.TcpFlag{types.TcpFlagSYN},
+				TcpWindow:    ptr(uint16(65535)),
+				DstSet:       "country_de",
+				Mark:         ptr(uint32(0x10)),
+				MarkMask:     ptr(uint32(0xf0)),
+				CtMark:       ptr(uint32(7)),
+				Iif:          "eth0",
+				CtHelper:     "ftp",
+				CtState:      []types.ConntrackState{types.ConntrackStateNew},
+				CtDir:        types.CtDirectionOriginal,
+				Fragmented:   true,
+				MinLen:       64,
+				MaxLen:       1500,
+				Negate:       []string{"src_net", "iif", "ct_mark"},
+				Limit:        &types.Limit{Rate: 100, Unit: types.LimitUnitSecond, Burst: 5},
+				Verdict:      types.VerdictAccept,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := &nftables.Table{Name: "test", Family: tt.family}
+			chain := &nftables.Chain{Name: "input", Table: table}
+
+			rule, err := marshalRule(table, chain, &tt.counter)
+			if err != nil {
+				t.Fatalf("marshalRule: %v", err)
+			}
+
+			got, err := unmarshalRule(rule)
+			if err != nil {
+				t.Fatalf("unmarshalRule: %v", err)
+			}
+
+			if !reflect.DeepEqual(&tt.counter, got) {
+				t.Errorf("round trip mismatch.\nExpected: %+v\nGot: %+v", tt.counter, *got)
+			}
+		})
+	}
+}
+
+func TestRuleDistinctRegisters(t *testing.T) {
+	table := &nftables.Table{Name: "test", Family: nftables.TableFamilyIPv6}
+	chain := &nftables.Chain{Name: "input", Table: table}
+	counter := &types.Counter{
+		SrcAddr:  netip.MustParseAddr("2001:db8::1"),
+		DstAddr:  netip.MustParseAddr("2001:db8::2"),
+		Protocol: types.ProtocolTCP,
+		DstPort:  443,
+	}
+
+	rule, err := marshalRule(table, chain, counter)
+	if err != nil {
+		t.Fatalf("marshalRule: %v", err)
+	}
+
+	seen := map[uint32]bool{}
+	for _, e := range rule.Exprs {
+		var reg uint32
+		switch ex := e.(type) {
+		case *expr.Payload:
+			reg = ex.DestRegister
+		case *expr.Meta:
+			reg = ex.Register
+		default:
+			continue
+		}
+		if seen[reg] {
+			t.Errorf("register %d loaded more than once", reg)
+		}
+		seen[reg] = true
+	}
+}
+
+func TestICMPv6Payload(t *testing.T) {
+	// The transport header base is resolved by the kernel after the IPv6
+	// extension headers, so the type is always at offset 0.
+	table := &nftables.Table{Name: "test", Family: nftables.TableFamilyIPv6}
+	chain := &nftables.Chain{Name: "input", Table: table}
+	rule, err := marshalRule(table, chain, &types.Counter{Label: "ping6", Protocol: types.ProtocolICMPv6, IcmpType: ptr(uint8(128))})
+	if err != nil {
+		t.Fatalf("marshalRule: %v", err)
+	}
+
+	var payloads []*expr.Payload
+	for _, e := range rule.Exprs {
+		if p, ok := e.(*expr.Payload); ok {
+			payloads = append(payloads, p)
+		}
+	}
+	if len(payloads) != 1 || payloads[0].Base != expr.PayloadBaseTransportHeader || payloads[0].Offset != 0 || payloads[0].Len != 1 {
+		t.Errorf("expected a single 1 byte transport header load at offset 0, got %+v", payloads)
+	}
+}
+
+func TestUnmarshalClobberedRegister(t *testing.T) {
+	// A 16 byte load into NFT_REG_1 followed by a load into a 32-bit register
+	// overlapping it must not leave the address type behind.
+	rule := &nftables.Rule{
+		Exprs: []expr.Any{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 8, Len: 16},
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 9},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: netip.MustParseAddr("2001:db8::1").AsSlice()},
+			&expr.Counter{},
+		},
+	}
+
+	_, err := unmarshalRule(rule)
+	if err == nil || !strings.Contains(err.Error(), "unknown register") {
+		t.Errorf("expected an unknown register error, got %v", err)
+	}
+}
+
+func TestUnmarshalTcpFlagsMask(t *testing.T) {
+	// tcp flags & (syn|ack) == syn cannot be expressed by a counter.
+	rule := &nftables.Rule{
+		Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{byte(types.ProtocolTCP)}},
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 13, Len: 1},
+			&expr.Bitwise{DestRegister: 1, SourceRegister: 1, Len: 1, Mask: []byte{0x12}, Xor: []byte{0x00}},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0x02}},
+			&expr.Counter{},
+		},
+	}
+
+	_, err := unmarshalRule(rule)
+	if err == nil || !strings.Contains(err.Error(), "unsupported tcp flags mask") {
+		t.Errorf("expected an unsupported mask error, got %v", err)
+	}
+}
+
+func TestTcpFlagsRoundTrip(t *testing.T) {
+	table := &nftables.Table{Name: "test", Family: nftables.TableFamilyIPv4}
+	chain := &nftables.Chain{Name: "input", Table: table}
+	for _, op := range []types.TcpFlagsOp{"", types.TcpFlagsOpAny, types.TcpFlagsOpAll, types.TcpFlagsOpNone} {
+		counter := types.Counter{Label: "psh_urg", Protocol: types.ProtocolTCP, TcpFlags: []types.TcpFlag{types.TcpFlagPSH, types.TcpFlagURG}, TcpFlagsOp: op}
+		rule, err := marshalRule(table, chain, &counter)
+		if err != nil {
+			t.Fatalf("%q: marshalRule: %v", op, err)
+		}
+		got, err := unmarshalRule(rule)
+		if err != nil {
+			t.Fatalf("%q: unmarshalRule: %v", op, err)
+		}
+		if !reflect.DeepEqual(got.TcpFlags, counter.TcpFlags) || got.TcpFlagsOp != op {
+			t.Errorf("%q: expected flags %v, got %v with op %q", op, counter.TcpFlags, got.TcpFlags, got.TcpFlagsOp)
+		}
+	}
+
+	// These ops write the same rule as an exact match, which is what is
+	// read back. The counters must still be recognized.
+	for _, counter := range []types.Counter{
+		{Label: "exact", Protocol: types.ProtocolTCP, TcpFlags: []types.TcpFlag{types.TcpFlagSYN}, TcpFlagsOp: types.TcpFlagsOpExact},
+		{Label: "all", Protocol: types.ProtocolTCP, TcpFlags: []types.TcpFlag{types.TcpFlagFIN, types.TcpFlagSYN, types.TcpFlagRST, types.TcpFlagACK}, TcpFlagsOp: types.TcpFlagsOpAll},
+	} {
+		rule, err := marshalRule(table, chain, &counter)
+		if err != nil {
+			t.Fatalf("%s: marshalRule: %v", counter.Label, err)
+		}
+		got, err := unmarshalRule(rule)
+		if err != nil {
+			t.Fatalf("%s: unmarshalRule: %v", counter.Label, err)
+		}
+		if got.Key() != counter.Key() {
+			t.Errorf("%s: expected the key of %+v, got the one of %+v", counter.Label, counter, *got)
+		}
+	}
+}
+
+func TestUnmarshalBitwiseXor(t *testing.T) {
+	rule := &nftables.Rule{
+		Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{byte(types.ProtocolTCP)}},
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 13, Len: 1},
+			&expr.Bitwise{DestRegister: 1, SourceRegister: 1, Len: 1, Mask: []byte{0x28}, Xor: []byte{0x08}},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0x28}},
+			&expr.Counter{},
+		},
+	}
+
+	_, err := unmarshalRule(rule)
+	if err == nil || !strings.Contains(err.Error(), "unsupported bitwise xor") {
+		t.Errorf("expected an unsupported xor error, got %v", err)
+	}
+}
+
+func TestUnmarshalReusedRegister(t *testing.T) {
+	// nft loads every match into NFT_REG_1 and compares it right away.
+	rule := &nftables.Rule{
+		Exprs: []expr.Any{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{10, 0, 0, 1}},
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{10, 0, 0, 2}},
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{byte(types.ProtocolUDP)}},
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 2},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0x00, 0x35}},
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0x14, 0xe9}},
+			&expr.Counter{Packets: 2, Bytes: 120},
+		},
+		UserData: userdata.AppendString(nil, userdata.TypeComment, "dns"),
+	}
+
+	got, err := unmarshalRule(rule)
+	if err != nil {
+		t.Fatalf("unmarshalRule: %v", err)
+	}
+	want := &types.Counter{
+		Label:    "dns",
+		SrcAddr:  netip.MustParseAddr("10.0.0.1"),
+		DstAddr:  netip.MustParseAddr("10.0.0.2"),
+		Protocol: types.ProtocolUDP,
+		SrcPort:  53,
+		DstPort:  5353,
+		Negate:   []string{"dst_addr"},
+		Packets:  2,
+		Bytes:    120,
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected %+v, got %+v", *want, *got)
+	}
+}
+
+func TestUnmarshalSetLookup(t *testing.T) {
+	rule := &nftables.Rule{
+		Exprs: []expr.Any{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+			&expr.Lookup{SourceRegister: 1, SetName: "blocklist", Invert: true},
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{byte(types.ProtocolTCP)}},
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			&expr.Lookup{SourceRegister: 1, SetName: "ports", Invert: true},
+			&expr.Counter{Packets: 3},
+		},
+		UserData: userdata.AppendString(nil, userdata.TypeComment, "blocked"),
+	}
+
+	// The address lookup is a src_set, the port lookup flowmon cannot
+	// write is only reported, along with its negation.
+	got, err := unmarshalRule(rule)
+	if err != nil {
+		t.Fatalf("unmarshalRule: %v", err)
+	}
+	want := &types.Counter{Label: "blocked", SrcSet: "blocklist", Negate: []string{"src_set"}, Protocol: types.ProtocolTCP, Sets: []string{"!ports"}, Packets: 3}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected %+v, got %+v", *want, *got)
+	}
+}
+
+func TestInetFamilyCheck(t *testing.T) {
+	table := &nftables.Table{Name: "test", Family: nftables.TableFamilyINet}
+	chain := &nftables.Chain{Name: "input", Table: table}
+
+	rule, err := marshalRule(table, chain, &types.Counter{Label: "v4", SrcAddr: netip.MustParseAddr("192.0.2.1")})
+	if err != nil {
+		t.Fatalf("marshalRule: %v", err)
+	}
+	meta, ok := rule.Exprs[0].(*expr.Meta)
+	if !ok || meta.Key != expr.MetaKeyNFPROTO {
+		t.Fatalf("expected the rule to start with a meta nfproto check, got %+v", rule.Exprs[0])
+	}
+
+	// The address alone would read IPv6 packets at IPv4 offsets, and the
+	// check alone is a match flowmon cannot write.
+	for name, exprs := range map[string][]expr.Any{
+		"address without check": rule.Exprs[2:],
+		"check without address": append(append([]expr.Any{}, rule.Exprs[:2]...), rule.Exprs[len(rule.Exprs)-1]),
+	} {
+		if _, err := unmarshalRule(&nftables.Rule{Table: table, Exprs: exprs, UserData: rule.UserData}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestMarshalRuleNegateErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		counter types.Counter
+	}{
+		{"unsupported field", types.Counter{Protocol: types.ProtocolTCP, TcpFlags: []types.TcpFlag{types.TcpFlagSYN}, Negate: []string{"tcp_flags"}}},
+		{"field not set", types.Counter{Protocol: types.ProtocolTCP, Negate: []string{"dst_port"}}},
+		{"interface name too long", types.Counter{Iif: "averyverylongname"}},
+		{"negated protocol with port", types.Counter{Protocol: types.ProtocolTCP, DstPort: 80, Negate: []string{"protocol"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := marshalRule(&nftables.Table{}, &nftables.Chain{}, &tt.counter); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestPrefixBits(t *testing.T) {
+	tests := []struct {
+		mask    []byte
+		want    int
+		wantErr bool
+	}{
+		{[]byte{0xff, 0x00, 0x00, 0x00}, 8, false},
+		{[]byte{0xff, 0xff, 0xf0, 0x00}, 20, false},
+		{[]byte{0xff, 0xff, 0xff, 0xff}, 32, false},
+		{[]byte{0x00, 0x00, 0x00, 0x00}, 0, false},
+		{[]byte{0xff, 0x00, 0xff, 0x00}, 0, true},
+		{[]byte{0xf7, 0x00, 0x00, 0x00}, 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := prefixBits(tt.mask)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("prefixBits(%x) error = %v, wantErr %v", tt.mask, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("prefixBits(%x) = %d, want %d", tt.mask, got, tt.want)
+		}
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends state, such as READY=1, to systemd. It does nothing unless
+// flowmon runs as a service with Type=notify, which sets NOTIFY_SOCKET.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	// A leading @ names an abstract socket, which net handles on its own.
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		return fmt.Errorf("dial %s: %w", socket, err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("write %s: %w", socket, err)
+	}
+	return nil
+}
+
+// notify is sdNotify for callers that can only log the failure.
+func notify(state string) {
+	if err := sdNotify(state); err != nil {
+		slog.Warn("Failed to notify systemd", "state", state, "err", err)
+	}
+}
+
+// watchdogInterval returns how often systemd expects WATCHDOG=1, half of
+// WatchdogSec as sd_watchdog_enabled(3) advises, or 0 if the watchdog is off
+// or meant for another process.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseUint(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec == 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// watchdog pings systemd every interval until ctx is done. Each ping waits
+// for check, so a read of the counters that hangs stops the pings and gets
+// the service restarted. A read that fails is left to /readyz.
+func watchdog(ctx context.Context, interval time.Duration, check func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// Only a hang stops the pings, an error still means the
+			// process is alive.
+			if err := check(); err != nil {
+				slog.Debug("Watchdog check failed", "err", err)
+			}
+			notify("WATCHDOG=1")
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/nickgarlis/flowmon/nft"
+)
+
+// reset zeroes the counters installed by a running flowmon. The rules are
+// kept, so counting carries on from zero.
+func reset(configPath string) {
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		os.Exit(1)
+	}
+
+	tables := cfg.CounterTables()
+	var total int
+	for _, t := range tables {
+		// A table flowmon does not manage is refused, unless others are
+		// configured next to it.
+		if len(tables) > 1 && !t.Managed() {
+			continue
+		}
+		nftClient, err := nft.New(nft.ConfigFrom(&t.NFTables))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to connect to nftables: %v\n", err)
+			os.Exit(1)
+		}
+
+		n, err := nftClient.ResetCounters()
+		if errors.Is(err, nft.ErrTableNotFound) {
+			fmt.Fprintf(os.Stderr, "Table %s not found, is flowmon running?\n", nftClient.TableName())
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to reset counters: %v\n", err)
+			os.Exit(1)
+		}
+		total += n
+	}
+
+	fmt.Printf("Reset %d counters\n", total)
+}
@@ -1,54 +1,430 @@
 package types
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/netip"
-	"time"
+	"slices"
 )
 
 type NFTables struct {
-	Family        TableFamily `yaml:"family"`
-	TableName     string      `yaml:"table_name"`
-	ChainPriority int32       `yaml:"chain_priority"`
+	Family        TableFamily `yaml:"family" json:"family"`
+	TableName     string      `yaml:"table_name" json:"table_name"`
+	ChainPriority int32       `yaml:"chain_priority" json:"chain_priority"`
+	InputChain    string      `yaml:"input_chain" json:"input_chain"`
+	OutputChain   string      `yaml:"output_chain" json:"output_chain"`
+	ForwardChain  string      `yaml:"forward_chain" json:"forward_chain"`
+	// Per direction priorities, overriding ChainPriority when set.
+	InputPriority   *int32 `yaml:"input_priority" json:"input_priority,omitempty"`
+	OutputPriority  *int32 `yaml:"output_priority" json:"output_priority,omitempty"`
+	ForwardPriority *int32 `yaml:"forward_priority" json:"forward_priority,omitempty"`
+	// Manage lets flowmon create and remove its table. When false the
+	// counters of an existing table are only read.
+	Manage *bool `yaml:"manage" json:"manage,omitempty"`
+	// KeepTable makes flowmon remove only its own chains on exit, and the
+	// table only if nothing else is left in it.
+	KeepTable bool `yaml:"keep_table" json:"keep_table,omitempty"`
+	// Reset zeroes the counters on every read, which is the default, so
+	// each read reports the traffic since the previous one.
+	Reset *bool `yaml:"reset" json:"reset,omitempty"`
+	// LabelPrefix is prepended to the labels of the rules flowmon writes.
+	// Rules whose label lacks it belong to someone else and are ignored.
+	LabelPrefix string `yaml:"label_prefix" json:"label_prefix,omitempty"`
+}
+
+// Resets reports whether the counters are zeroed on every read.
+func (n NFTables) Resets() bool {
+	return n.Reset == nil || *n.Reset
+}
+
+// Managed reports whether flowmon owns the table, which is the default.
+func (n NFTables) Managed() bool {
+	return n.Manage == nil || *n.Manage
 }
 
 type Exporter struct {
-	Interval time.Duration `yaml:"interval"`
-	OTLP     OTLP          `yaml:"otlp"`
+	Interval Duration      `yaml:"interval" json:"interval"`
+	OTLP     OTLPEndpoints `yaml:"otlp" json:"otlp"`
+	// OTLPBestEffort starts with the OTLP endpoints that could be set up
+	// instead of failing if one of them cannot.
+	OTLPBestEffort    bool              `yaml:"otlp_best_effort" json:"otlp_best_effort,omitempty"`
+	AttributeKeyStyle AttributeKeyStyle `yaml:"attribute_key_style" json:"attribute_key_style"`
+	ProcessMetrics    bool              `yaml:"process_metrics" json:"process_metrics"`
+	AttributeLimits   AttributeLimits   `yaml:"attribute_limits" json:"attribute_limits"`
+	MetricKind        MetricKind        `yaml:"metric_kind" json:"metric_kind"`
+	Prometheus        *Prometheus       `yaml:"prometheus" json:"prometheus,omitempty"`
+	JSON              *JSONExport       `yaml:"json" json:"json,omitempty"`
+	// ServiceName overrides the service.name resource attribute.
+	ServiceName        string            `yaml:"service_name" json:"service_name"`
+	ResourceAttributes map[string]string `yaml:"resource_attributes" json:"resource_attributes,omitempty"`
+	// InstanceIDFile keeps the generated service.instance.id across
+	// restarts, $STATE_DIRECTORY/instance-id by default under systemd.
+	InstanceIDFile string `yaml:"instance_id_file" json:"instance_id_file,omitempty"`
+	// DefaultAttributes are added to the attributes of every counter,
+	// unless the counter already has an attribute with the same key.
+	DefaultAttributes map[string]string `yaml:"default_attributes" json:"default_attributes,omitempty"`
+	// ScopeName and ScopeVersion override the instrumentation scope of the
+	// metrics, "flowmon" and the flowmon version by default.
+	ScopeName    string `yaml:"scope_name" json:"scope_name,omitempty"`
+	ScopeVersion string `yaml:"scope_version" json:"scope_version,omitempty"`
+}
+
+// JSONExport periodically writes the counters as JSON to Path, or to stdout
+// if Path is empty or "-". Interval defaults to the exporter interval.
+type JSONExport struct {
+	Path     string   `yaml:"path" json:"path"`
+	Interval Duration `yaml:"interval" json:"interval,omitzero"`
+}
+
+// Prometheus serves the metrics for scraping instead of pushing them to an
+// OTLP endpoint.
+type Prometheus struct {
+	Listen string `yaml:"listen" json:"listen"`
+}
+
+// AttributeLimits caps the attributes attached to each counter. A zero value
+// means no limit.
+type AttributeLimits struct {
+	MaxKeyLength   int `yaml:"max_key_length" json:"max_key_length"`
+	MaxValueLength int `yaml:"max_value_length" json:"max_value_length"`
+	MaxCount       int `yaml:"max_count" json:"max_count"`
 }
 
 type OTLP struct {
-	Endpoint string       `yaml:"endpoint"`
-	Protocol OTLPProtocol `yaml:"protocol"`
-	TLS      *TLSConfig   `yaml:"tls_config,omitempty"`
+	Endpoint    string            `yaml:"endpoint" json:"endpoint"`
+	Protocol    OTLPProtocol      `yaml:"protocol" json:"protocol"`
+	Temporality Temporality       `yaml:"temporality" json:"temporality"`
+	TLS         *TLSConfig        `yaml:"tls_config,omitempty" json:"tls_config,omitempty"`
+	Headers     map[string]string `yaml:"headers" json:"headers,omitempty"`
+	// Timeout bounds every export including its retries, 10s if unset.
+	Timeout *Duration `yaml:"timeout" json:"timeout,omitempty"`
+	Retry   *Retry    `yaml:"retry" json:"retry,omitempty"`
+}
+
+// OTLPEndpoints are the endpoints the metrics are pushed to. In YAML a single
+// endpoint can also be given as a mapping instead of a list.
+type OTLPEndpoints []OTLP
+
+func (e *OTLPEndpoints) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	if _, ok := raw.([]interface{}); ok {
+		var list []OTLP
+		if err := unmarshal(&list); err != nil {
+			return err
+		}
+		*e = list
+		return nil
+	}
+
+	var single OTLP
+	if err := unmarshal(&single); err != nil {
+		return err
+	}
+	*e = OTLPEndpoints{single}
+	return nil
+}
+
+// Retry configures the exponential backoff of failed exports. Unset
+// intervals keep the defaults of 5s, 30s and 1m.
+type Retry struct {
+	Enabled         *bool    `yaml:"enabled" json:"enabled,omitempty"`
+	InitialInterval Duration `yaml:"initial_interval" json:"initial_interval,omitempty"`
+	MaxInterval     Duration `yaml:"max_interval" json:"max_interval,omitempty"`
+	MaxElapsedTime  Duration `yaml:"max_elapsed_time" json:"max_elapsed_time,omitempty"`
+}
+
+// Admin serves the health endpoints of the daemon on Listen.
+type Admin struct {
+	Listen string `yaml:"listen" json:"listen"`
+}
+
+// Log configures the messages flowmon writes to stderr.
+type Log struct {
+	Level  LogLevel  `yaml:"level" json:"level"`
+	Format LogFormat `yaml:"format" json:"format"`
 }
 
 type Config struct {
-	Version  string   // internal field of the application version
-	Exporter Exporter `yaml:"exporter"`
-	NFTables NFTables `yaml:"nftables"`
-	Counters Counters `yaml:"counters"`
+	Version   string             `json:"-"` // internal field of the application version
+	Log       Log                `yaml:"log" json:"log"`
+	Admin     *Admin             `yaml:"admin" json:"admin,omitempty"`
+	Exporter  Exporter           `yaml:"exporter" json:"exporter"`
+	NFTables  NFTables           `yaml:"nftables" json:"nftables"`
+	Counters  Counters           `yaml:"counters" json:"counters"`
+	Tables    []Table            `yaml:"tables" json:"tables,omitempty"`
+	Templates map[string]Counter `yaml:"templates" json:"templates,omitempty"`
+	// CountersFiles are merged into Counters, relative paths are resolved
+	// against the directory of the configuration file.
+	CountersFiles []string `yaml:"counters_files" json:"counters_files,omitempty"`
+	// CountersDir is merged like CountersFiles, one *.yaml file after the
+	// other in lexical order.
+	CountersDir string `yaml:"counters_dir" json:"counters_dir,omitempty"`
+}
+
+// Table is a table of its own with the counters installed in it, for
+// keeping groups of counters apart.
+type Table struct {
+	NFTables `yaml:",inline"`
+	Counters Counters `yaml:"counters" json:"counters"`
+}
+
+// CounterTables returns the tables the counters are installed in: the one
+// of NFTables and Counters followed by Tables. With Tables set, the first one
+// is left out unless it has counters.
+func (c *Config) CounterTables() []Table {
+	if len(c.Tables) == 0 {
+		return []Table{{NFTables: c.NFTables, Counters: c.Counters}}
+	}
+	var tables []Table
+	if len(c.Counters.All()) > 0 {
+		tables = append(tables, Table{NFTables: c.NFTables, Counters: c.Counters})
+	}
+	return append(tables, c.Tables...)
+}
+
+// ValidateTables checks that every table of Tables is named and that no
+// table is configured twice.
+func (c *Config) ValidateTables() error {
+	var errs []error
+	for i, t := range c.Tables {
+		if t.TableName == "" {
+			errs = append(errs, fmt.Errorf("tables[%d].table_name is required", i))
+		}
+	}
+	seen := map[string]bool{}
+	for _, t := range c.CounterTables() {
+		key := fmt.Sprintf("%s %s", t.Family, t.TableName)
+		if seen[key] {
+			errs = append(errs, fmt.Errorf("table %s is configured more than once", key))
+		}
+		seen[key] = true
+	}
+	return errors.Join(errs...)
 }
 
 type Counters struct {
-	Input  []Counter `yaml:"input"`
-	Output []Counter `yaml:"output"`
+	Input   []Counter `yaml:"input" json:"input"`
+	Output  []Counter `yaml:"output" json:"output"`
+	Forward []Counter `yaml:"forward" json:"forward,omitempty"`
+}
+
+// All returns the counters of every direction in a new slice.
+func (c *Counters) All() []Counter {
+	all := make([]Counter, 0, len(c.Input)+len(c.Output)+len(c.Forward))
+	all = append(all, c.Input...)
+	all = append(all, c.Output...)
+	return append(all, c.Forward...)
 }
 
 type Counter struct {
-	Label    string     `yaml:"label"`
-	SrcPort  uint16     `yaml:"src_port"`
-	DstPort  uint16     `yaml:"dst_port"`
-	TcpFlags []TcpFlag  `yaml:"tcp_flags"`
-	Protocol Protocol   `yaml:"protocol"`
-	SrcAddr  netip.Addr `yaml:"src_addr"`
-	DstAddr  netip.Addr `yaml:"dst_addr"`
-	Dir      string     // internal field to denote "input" or "output"
-	Packets  uint64     // internal field to hold counter value
-	Bytes    uint64     // internal field to hold byte count
+	Label        string           `yaml:"label" json:"label"`
+	SrcPort      uint16           `yaml:"src_port" json:"src_port,omitempty"`
+	DstPort      uint16           `yaml:"dst_port" json:"dst_port,omitempty"`
+	SrcPortRange PortRange        `yaml:"src_port_range" json:"src_port_range,omitzero"`
+	DstPortRange PortRange        `yaml:"dst_port_range" json:"dst_port_range,omitzero"`
+	TcpFlags     []TcpFlag        `yaml:"tcp_flags" json:"tcp_flags,omitempty"`
+	TcpFlagsOp   TcpFlagsOp       `yaml:"tcp_flags_op" json:"tcp_flags_op,omitempty"`
+	TcpWindow    *uint16          `yaml:"tcp_window" json:"tcp_window,omitempty"`
+	IcmpType     *uint8           `yaml:"icmp_type" json:"icmp_type,omitempty"`
+	IcmpCode     *uint8           `yaml:"icmp_code" json:"icmp_code,omitempty"`
+	Protocol     Protocol         `yaml:"protocol" json:"protocol,omitempty"`
+	ProtoHeader  bool             `yaml:"protocol_header" json:"protocol_header,omitempty"` // match ip protocol or ip6 nexthdr instead of meta l4proto
+	SrcAddr      netip.Addr       `yaml:"src_addr" json:"src_addr,omitzero"`
+	DstAddr      netip.Addr       `yaml:"dst_addr" json:"dst_addr,omitzero"`
+	SrcHost      string           `yaml:"src_host" json:"src_host,omitempty"` // resolved into SrcAddr when loading the configuration
+	DstHost      string           `yaml:"dst_host" json:"dst_host,omitempty"`
+	SrcNet       netip.Prefix     `yaml:"src_net" json:"src_net,omitzero"`
+	DstNet       netip.Prefix     `yaml:"dst_net" json:"dst_net,omitzero"`
+	SrcAddrRange AddrRange        `yaml:"src_addr_range" json:"src_addr_range,omitzero"`
+	DstAddrRange AddrRange        `yaml:"dst_addr_range" json:"dst_addr_range,omitzero"`
+	SrcSet       string           `yaml:"src_set" json:"src_set,omitempty"` // named set of addresses in the table
+	DstSet       string           `yaml:"dst_set" json:"dst_set,omitempty"`
+	Iif          string           `yaml:"iif" json:"iif,omitempty"`
+	Oif          string           `yaml:"oif" json:"oif,omitempty"`
+	SrcMac       MacAddr          `yaml:"src_mac" json:"src_mac,omitzero"`
+	DstMac       MacAddr          `yaml:"dst_mac" json:"dst_mac,omitzero"`
+	CtHelper     string           `yaml:"ct_helper" json:"ct_helper,omitempty"`
+	CtState      []ConntrackState `yaml:"ct_state" json:"ct_state,omitempty"`
+	CtDir        CtDirection      `yaml:"ct_dir" json:"ct_dir,omitempty"`
+	Mark         *uint32          `yaml:"mark" json:"mark,omitempty"` // packet mark (fwmark)
+	MarkMask     *uint32          `yaml:"mark_mask" json:"mark_mask,omitempty"`
+	CtMark       *uint32          `yaml:"ct_mark" json:"ct_mark,omitempty"` // connection mark
+	CtMarkMask   *uint32          `yaml:"ct_mark_mask" json:"ct_mark_mask,omitempty"`
+	MinLen       uint32           `yaml:"min_len" json:"min_len,omitempty"`
+	MaxLen       uint32           `yaml:"max_len" json:"max_len,omitempty"`
+	Dscp         *uint8           `yaml:"dscp" json:"dscp,omitempty"`
+	Fragmented   bool             `yaml:"fragmented" json:"fragmented,omitempty"`
+	Limit        *Limit           `yaml:"limit" json:"limit,omitempty"`
+	Quota        uint64           `yaml:"quota" json:"quota,omitempty"`
+	Reset        *bool            `yaml:"reset" json:"reset,omitempty"` // overrides nftables.reset
+	Verdict      Verdict          `yaml:"verdict" json:"verdict,omitempty"`
+	Negate       []string         `yaml:"negate" json:"negate,omitempty"`
+	Template     string           `yaml:"template" json:"template,omitempty"`
+	Sets         []string         `json:"-"` // internal field listing the named sets the rule looks up, prefixed with ! when negated
+	Dir          string           `json:"-"` // internal field to denote "input", "output" or "forward"
+	Chain        string           `json:"-"` // internal field holding the name of the chain of the rule
+	Packets      uint64           `json:"-"` // internal field to hold counter value
+	Bytes        uint64           `json:"-"` // internal field to hold byte count
+	QuotaUsed    uint64           `json:"-"` // internal field to hold the bytes consumed of the quota
+	Cumulative   bool             `json:"-"` // internal field set when the values are totals rather than deltas
+}
+
+// CounterSnapshot is a counter together with the values read from nftables,
+// in the form it is serialized to JSON.
+type CounterSnapshot struct {
+	Counter
+	Table     string   `json:"table,omitempty"` // only set with more than one table
+	Sets      []string `json:"sets,omitempty"`
+	Direction string   `json:"direction"`
+	Packets   uint64   `json:"packets"`
+	Bytes     uint64   `json:"bytes"`
+	QuotaUsed *uint64  `json:"quota_used,omitempty"` // only set with a quota
+}
+
+// Snapshot returns the counters of every direction with their values.
+func (c *Counters) Snapshot() []CounterSnapshot {
+	all := c.All()
+	snapshot := make([]CounterSnapshot, 0, len(all))
+	for _, counter := range all {
+		s := CounterSnapshot{
+			Counter:   counter,
+			Sets:      counter.Sets,
+			Direction: counter.Dir,
+			Packets:   counter.Packets,
+			Bytes:     counter.Bytes,
+		}
+		if counter.Quota != 0 {
+			used := counter.QuotaUsed
+			s.QuotaUsed = &used
+		}
+		snapshot = append(snapshot, s)
+	}
+	return snapshot
+}
+
+// Limit polices the traffic of a counter: once the burst is used up, packets
+// exceeding Rate packets (or bytes) per Unit are dropped.
+type Limit struct {
+	Rate  uint64    `yaml:"rate" json:"rate"`
+	Unit  LimitUnit `yaml:"unit" json:"unit,omitempty"`
+	Burst uint32    `yaml:"burst" json:"burst,omitempty"`
+	Bytes bool      `yaml:"bytes" json:"bytes,omitempty"`
+}
+
+func (l Limit) String() string {
+	unit := l.Unit
+	if unit == "" {
+		unit = LimitUnitSecond
+	}
+	s := fmt.Sprintf("%d/%s", l.Rate, unit)
+	if l.Bytes {
+		s = fmt.Sprintf("%d bytes/%s", l.Rate, unit)
+	}
+	if l.Burst != 0 {
+		s += fmt.Sprintf(" burst %d", l.Burst)
+	}
+	return s
 }
 
 type TLSConfig struct {
-	CertFile string `yaml:"cert_file,omitempty"`
-	KeyFile  string `yaml:"key_file,omitempty"`
-	CAFile   string `yaml:"ca_file,omitempty"`
+	CertFile string `yaml:"cert_file,omitempty" json:"cert_file"`
+	KeyFile  string `yaml:"key_file,omitempty" json:"key_file"`
+	CAFile   string `yaml:"ca_file,omitempty" json:"ca_file"`
+}
+
+// Key identifies the traffic a counter matches under its label. Counters
+// written with their lists in a different order have the same key. The values
+// read from nftables and the settings that leave the match alone, such as
+// Reset and Template, are ignored.
+func (c *Counter) Key() string {
+	key := struct {
+		Counter
+		Sets []string `json:"sets,omitempty"`
+	}{Counter: *c, Sets: sortedOrNil(c.Sets)}
+	key.Dir, key.Chain = "", ""
+	key.Packets, key.Bytes, key.QuotaUsed = 0, 0, 0
+	key.Cumulative = false
+	key.Reset = nil
+	key.Template = ""
+	key.Negate = sortedOrNil(c.Negate)
+	key.TcpFlags = sortedOrNil(c.TcpFlags)
+	// Matching all of the flags an exact match compares and more is the
+	// same rule as the exact match, and reads back as one.
+	if c.TcpFlagsOp == TcpFlagsOpExact ||
+		c.TcpFlagsOp == TcpFlagsOpAll && TcpFlagsToByte(c.TcpFlags...)&TcpFlagsExactMask == TcpFlagsExactMask {
+		key.TcpFlagsOp = ""
+	}
+	key.CtState = sortedOrNil(c.CtState)
+
+	// A counter always marshals, none of its fields can fail to.
+	b, _ := json.Marshal(key)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// sortedOrNil returns a sorted copy of s, or nil if it is empty, so that
+// unset and empty lists compare equal.
+func sortedOrNil[S ~[]E, E interface{ ~string | ~uint8 | ~uint32 }](s S) S {
+	if len(s) == 0 {
+		return nil
+	}
+	sorted := slices.Clone(s)
+	slices.Sort(sorted)
+	return sorted
+}
+
+// IPFamily returns the family of the packets c matches in a table of family:
+// the family of the table, or in an inet table the family of the first
+// address of c. It is TableFamilyInet if c matches both.
+func (c *Counter) IPFamily(family TableFamily) TableFamily {
+	if family != TableFamilyInet {
+		return family
+	}
+	for _, addr := range c.addrs() {
+		if addr.Is4() {
+			return TableFamilyIPv4
+		}
+		return TableFamilyIPv6
+	}
+	return TableFamilyInet
+}
+
+// addrs returns the addresses, subnets and ranges c matches, each by its
+// first address.
+func (c *Counter) addrs() []netip.Addr {
+	var addrs []netip.Addr
+	for _, addr := range []netip.Addr{c.SrcAddr, c.DstAddr, c.SrcNet.Addr(), c.DstNet.Addr(), c.SrcAddrRange.Min, c.DstAddrRange.Min} {
+		if addr.IsValid() {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// IsNegated reports whether the match on field is inverted.
+func (c *Counter) IsNegated(field string) bool {
+	for _, f := range c.Negate {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Negatable reports whether the match on field can be inverted.
+func Negatable(field string) bool {
+	switch field {
+	case "protocol", "src_port", "dst_port", "src_addr", "dst_addr", "src_net", "dst_net",
+		"src_port_range", "dst_port_range", "src_addr_range", "dst_addr_range", "src_set", "dst_set",
+		"icmp_type", "icmp_code", "iif", "oif", "src_mac", "dst_mac", "ct_helper", "mark", "ct_mark":
+		return true
+	default:
+		return false
+	}
 }
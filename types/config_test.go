@@ -0,0 +1,108 @@
+package types
+
+import (
+	"encoding/json"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestConfigJSON(t *testing.T) {
+	cfg := Config{
+		Version:  "1.2.3",
+		NFTables: NFTables{Family: TableFamilyIPv6, TableName: "flowmon"},
+		Counters: Counters{
+			Input: []Counter{{Label: "https", Protocol: ProtocolTCP, DstPort: 443, SrcMac: MacAddr{0x02, 0, 0, 0, 0, 0x01}, Dir: "input", Packets: 7}},
+		},
+	}
+
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	got := string(data)
+
+	for _, want := range []string{`"family":"ip6"`, `"table_name":"flowmon"`, `"label":"https"`, `"protocol":"tcp"`, `"dst_port":443`, `"src_mac":"02:00:00:00:00:01"`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %s in %s", want, got)
+		}
+	}
+	for _, unwanted := range []string{"1.2.3", "packets", "Dir", "src_addr", "dst_mac"} {
+		if strings.Contains(got, unwanted) {
+			t.Errorf("expected no %s in %s", unwanted, got)
+		}
+	}
+}
+
+func TestMacAddrText(t *testing.T) {
+	var mac MacAddr
+	if err := mac.UnmarshalText([]byte("02:00:5E:10:00:01")); err != nil {
+		t.Fatalf("UnmarshalText: %v", err)
+	}
+	if got := mac.String(); got != "02:00:5e:10:00:01" {
+		t.Errorf("expected 02:00:5e:10:00:01, got %s", got)
+	}
+	for _, invalid := range []string{"02:00:5e:10:00", "02:00:5e:10:00:01:02:03", "gateway"} {
+		if err := mac.UnmarshalText([]byte(invalid)); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestCounterKey(t *testing.T) {
+	a := Counter{
+		Label:    "web",
+		Protocol: ProtocolTCP,
+		DstPort:  443,
+		SrcAddr:  netip.MustParseAddr("10.0.0.1"),
+		TcpFlags: []TcpFlag{TcpFlagSYN, TcpFlagACK},
+		CtState:  []ConntrackState{ConntrackStateNew, ConntrackStateRelated},
+		Negate:   []string{"src_addr", "dst_port"},
+	}
+	// The same counter with its lists in another order and values read
+	// from nftables.
+	b := Counter{
+		Negate:   []string{"dst_port", "src_addr"},
+		CtState:  []ConntrackState{ConntrackStateRelated, ConntrackStateNew},
+		TcpFlags: []TcpFlag{TcpFlagACK, TcpFlagSYN},
+		SrcAddr:  netip.MustParseAddr("10.0.0.1"),
+		DstPort:  443,
+		Protocol: ProtocolTCP,
+		Label:    "web",
+		Dir:      "input",
+		Packets:  10,
+		Bytes:    600,
+	}
+	if a.Key() != b.Key() {
+		t.Errorf("expected equal counters to have the same key")
+	}
+	if (&Counter{Label: "x", Negate: []string{}}).Key() != (&Counter{Label: "x"}).Key() {
+		t.Errorf("expected an empty list to have the same key as an unset one")
+	}
+
+	for _, c := range []Counter{
+		{Label: "web", Protocol: ProtocolTCP, DstPort: 443},
+		{Label: "web2", Protocol: ProtocolTCP, DstPort: 443, SrcAddr: netip.MustParseAddr("10.0.0.1"), TcpFlags: a.TcpFlags, CtState: a.CtState, Negate: a.Negate},
+		{Label: "web", Protocol: ProtocolTCP, DstPort: 443, SrcAddr: netip.MustParseAddr("10.0.0.1"), TcpFlags: a.TcpFlags, CtState: a.CtState, Negate: a.Negate, Sets: []string{"blocklist"}},
+	} {
+		if c.Key() == a.Key() {
+			t.Errorf("expected %+v to have a different key", c)
+		}
+	}
+}
+
+func TestSnapshotJSON(t *testing.T) {
+	counters := Counters{
+		Output: []Counter{{Label: "dns", Protocol: ProtocolUDP, Dir: "output", Packets: 2, Bytes: 120}},
+	}
+
+	data, err := json.Marshal(counters.Snapshot())
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+
+	want := `[{"label":"dns","protocol":"udp","direction":"output","packets":2,"bytes":120}]`
+	if string(data) != want {
+		t.Errorf("expected %s, got %s", want, data)
+	}
+}
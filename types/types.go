@@ -2,7 +2,11 @@ package types
 
 import (
 	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
@@ -10,10 +14,15 @@ import (
 type Protocol uint8
 
 const (
-	ProtocolTCP    Protocol = unix.IPPROTO_TCP
-	ProtocolUDP    Protocol = unix.IPPROTO_UDP
-	ProtocolICMP   Protocol = unix.IPPROTO_ICMP
-	ProtocolICMPv6 Protocol = unix.IPPROTO_ICMPV6
+	ProtocolTCP     Protocol = unix.IPPROTO_TCP
+	ProtocolUDP     Protocol = unix.IPPROTO_UDP
+	ProtocolICMP    Protocol = unix.IPPROTO_ICMP
+	ProtocolICMPv6  Protocol = unix.IPPROTO_ICMPV6
+	ProtocolSCTP    Protocol = unix.IPPROTO_SCTP
+	ProtocolGRE     Protocol = unix.IPPROTO_GRE
+	ProtocolESP     Protocol = unix.IPPROTO_ESP
+	ProtocolAH      Protocol = unix.IPPROTO_AH
+	ProtocolUDPLite Protocol = unix.IPPROTO_UDPLITE
 )
 
 func (p Protocol) String() string {
@@ -26,20 +35,46 @@ func (p Protocol) String() string {
 		return "icmp"
 	case ProtocolICMPv6:
 		return "icmpv6"
+	case ProtocolSCTP:
+		return "sctp"
+	case ProtocolGRE:
+		return "gre"
+	case ProtocolESP:
+		return "esp"
+	case ProtocolAH:
+		return "ah"
+	case ProtocolUDPLite:
+		return "udplite"
 	default:
 		return "unknown"
 	}
 }
 
+// HasPorts reports whether the protocol carries source and destination ports
+// in the first four bytes of its header. UDP-Lite shares the UDP header.
+func (p Protocol) HasPorts() bool {
+	return p == ProtocolTCP || p == ProtocolUDP || p == ProtocolSCTP || p == ProtocolUDPLite
+}
+
 func (p *Protocol) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	var s string
 	if err := unmarshal(&s); err != nil {
 		return err
 	}
 	*p = ProtocolFromString(s)
+	if *p == 0 {
+		return fmt.Errorf("invalid protocol %q, expected one of %s", s, strings.Join(protocolNames, ", "))
+	}
 	return nil
 }
 
+// protocolNames lists the protocols accepted in the configuration.
+var protocolNames = []string{"tcp", "udp", "udplite", "sctp", "icmp", "icmpv6", "gre", "esp", "ah"}
+
+func (p Protocol) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
 func (p Protocol) AsSlice() []byte {
 	return []byte{byte(p)}
 }
@@ -54,6 +89,16 @@ func ProtocolFromString(s string) Protocol {
 		return ProtocolICMP
 	case "icmpv6":
 		return ProtocolICMPv6
+	case "sctp":
+		return ProtocolSCTP
+	case "gre":
+		return ProtocolGRE
+	case "esp":
+		return ProtocolESP
+	case "ah":
+		return ProtocolAH
+	case "udplite":
+		return ProtocolUDPLite
 	default:
 		return 0
 	}
@@ -103,6 +148,10 @@ func (f *TcpFlag) UnmarshalText(text []byte) error {
 	return nil
 }
 
+func (f TcpFlag) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
 func (f TcpFlag) String() string {
 	switch f {
 	case TcpFlagFIN:
@@ -144,12 +193,161 @@ func TcpFlagsToByte(flags ...TcpFlag) byte {
 	return b
 }
 
+// TcpFlagsExactMask selects the flags compared by an exact TCP flags match,
+// in addition to the listed ones.
+var TcpFlagsExactMask = TcpFlagsToByte(TcpFlagFIN, TcpFlagSYN, TcpFlagRST, TcpFlagACK)
+
+// TcpFlagsOp selects how the TCP flags of a counter are matched.
+type TcpFlagsOp string
+
+const (
+	// TcpFlagsOpExact matches packets where exactly the listed flags out
+	// of FIN, SYN, RST, ACK and the listed ones are set. It is the default.
+	TcpFlagsOpExact TcpFlagsOp = "exact"
+	// TcpFlagsOpAny matches packets where any of the listed flags is set.
+	TcpFlagsOpAny TcpFlagsOp = "any"
+	// TcpFlagsOpAll matches packets where all of the listed flags are set.
+	TcpFlagsOpAll TcpFlagsOp = "all"
+	// TcpFlagsOpNone matches packets where none of the listed flags is set.
+	TcpFlagsOpNone TcpFlagsOp = "none"
+)
+
+func (o *TcpFlagsOp) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	switch strings.ToLower(s) {
+	case "exact":
+		*o = TcpFlagsOpExact
+	case "any":
+		*o = TcpFlagsOpAny
+	case "all":
+		*o = TcpFlagsOpAll
+	case "none":
+		*o = TcpFlagsOpNone
+	default:
+		return fmt.Errorf("invalid tcp_flags_op %q, expected 'exact', 'any', 'all' or 'none'", s)
+	}
+	return nil
+}
+
+// ConntrackState is a conntrack state bit as reported by ct state.
+type ConntrackState uint32
+
+const (
+	ConntrackStateInvalid     ConntrackState = 0x01
+	ConntrackStateEstablished ConntrackState = 0x02
+	ConntrackStateRelated     ConntrackState = 0x04
+	ConntrackStateNew         ConntrackState = 0x08
+	ConntrackStateUntracked   ConntrackState = 0x40
+)
+
+var conntrackStates = []ConntrackState{
+	ConntrackStateInvalid,
+	ConntrackStateEstablished,
+	ConntrackStateRelated,
+	ConntrackStateNew,
+	ConntrackStateUntracked,
+}
+
+func ConntrackStateFromString(s string) ConntrackState {
+	switch strings.ToLower(s) {
+	case "invalid":
+		return ConntrackStateInvalid
+	case "established":
+		return ConntrackStateEstablished
+	case "related":
+		return ConntrackStateRelated
+	case "new":
+		return ConntrackStateNew
+	case "untracked":
+		return ConntrackStateUntracked
+	default:
+		return 0
+	}
+}
+
+func (s *ConntrackState) UnmarshalText(text []byte) error {
+	*s = ConntrackStateFromString(string(text))
+	if *s == 0 {
+		return fmt.Errorf("invalid conntrack state: %s", string(text))
+	}
+	return nil
+}
+
+func (s ConntrackState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s ConntrackState) String() string {
+	switch s {
+	case ConntrackStateInvalid:
+		return "invalid"
+	case ConntrackStateEstablished:
+		return "established"
+	case ConntrackStateRelated:
+		return "related"
+	case ConntrackStateNew:
+		return "new"
+	case ConntrackStateUntracked:
+		return "untracked"
+	default:
+		return "unknown"
+	}
+}
+
+func ConntrackStatesFromMask(mask uint32) []ConntrackState {
+	states := []ConntrackState{}
+	for _, state := range conntrackStates {
+		if mask&uint32(state) != 0 {
+			states = append(states, state)
+		}
+	}
+	return states
+}
+
+func ConntrackStatesToMask(states ...ConntrackState) uint32 {
+	var mask uint32
+	for _, state := range states {
+		mask |= uint32(state)
+	}
+	return mask
+}
+
+// CtDirection is the direction of a packet within its connection as seen by
+// conntrack.
+type CtDirection string
+
+const (
+	// CtDirectionOriginal matches packets sent by the side that opened the
+	// connection.
+	CtDirectionOriginal CtDirection = "original"
+	// CtDirectionReply matches packets sent back by the other side.
+	CtDirectionReply CtDirection = "reply"
+)
+
+func (d *CtDirection) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	switch dir := CtDirection(strings.ToLower(s)); dir {
+	case CtDirectionOriginal, CtDirectionReply:
+		*d = dir
+	default:
+		return fmt.Errorf("invalid ct_dir %q, expected 'original' or 'reply'", s)
+	}
+	return nil
+}
+
 type TableFamily uint8
 
 const (
 	TableFamilyIPv4 TableFamily = unix.NFPROTO_IPV4
 	TableFamilyIPv6 TableFamily = unix.NFPROTO_IPV6
-	// Not yet supported
+	// TableFamilyInet sees the packets of both families, a counter matches
+	// the family of its addresses.
 	TableFamilyInet TableFamily = unix.NFPROTO_INET
 )
 
@@ -171,10 +369,18 @@ func (f *TableFamily) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err := unmarshal(&s); err != nil {
 		return err
 	}
-	*f = TableFamilyFromString(s)
+	family := TableFamilyFromString(s)
+	if family == 0 {
+		return fmt.Errorf("invalid family %q, expected 'ip', 'ip6' or 'inet'", s)
+	}
+	*f = family
 	return nil
 }
 
+func (f TableFamily) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
 func (f TableFamily) String() string {
 	switch f {
 	case TableFamilyIPv4:
@@ -209,7 +415,319 @@ func (p *OTLPProtocol) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	case "stdout":
 		*p = OTLPProtocolStdout
 	default:
-		*p = OTLPProtocolGRPC
+		return fmt.Errorf("invalid OTLP protocol %q, expected 'grpc', 'http' or 'stdout'", s)
+	}
+	return nil
+}
+
+type Temporality string
+
+const (
+	TemporalityCumulative Temporality = "cumulative"
+	TemporalityDelta      Temporality = "delta"
+)
+
+func (t *Temporality) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	switch strings.ToLower(s) {
+	case "cumulative":
+		*t = TemporalityCumulative
+	case "delta":
+		*t = TemporalityDelta
+	default:
+		return fmt.Errorf("invalid temporality %q, expected 'cumulative' or 'delta'", s)
+	}
+	return nil
+}
+
+// Verdict is the action taken on packets matched by a counter. The empty
+// verdict only counts and lets the packet continue through the chain.
+type Verdict string
+
+const (
+	VerdictAccept   Verdict = "accept"
+	VerdictDrop     Verdict = "drop"
+	VerdictContinue Verdict = "continue"
+)
+
+func (v *Verdict) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	switch verdict := Verdict(strings.ToLower(s)); verdict {
+	case VerdictAccept, VerdictDrop, VerdictContinue:
+		*v = verdict
+	default:
+		return fmt.Errorf("invalid verdict %q, expected 'accept', 'drop' or 'continue'", s)
+	}
+	return nil
+}
+
+// LimitUnit is the time unit of a rate limit.
+type LimitUnit string
+
+const (
+	LimitUnitSecond LimitUnit = "second"
+	LimitUnitMinute LimitUnit = "minute"
+	LimitUnitHour   LimitUnit = "hour"
+	LimitUnitDay    LimitUnit = "day"
+	LimitUnitWeek   LimitUnit = "week"
+)
+
+func (u *LimitUnit) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	switch unit := LimitUnit(strings.ToLower(s)); unit {
+	case LimitUnitSecond, LimitUnitMinute, LimitUnitHour, LimitUnitDay, LimitUnitWeek:
+		*u = unit
+	default:
+		return fmt.Errorf("invalid limit unit %q, expected 'second', 'minute', 'hour', 'day' or 'week'", s)
+	}
+	return nil
+}
+
+// MetricKind selects the instruments counters are exported as.
+type MetricKind string
+
+const (
+	MetricKindGauge   MetricKind = "gauge"
+	MetricKindCounter MetricKind = "counter"
+	MetricKindBoth    MetricKind = "both"
+)
+
+func (k *MetricKind) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	switch strings.ToLower(s) {
+	case "gauge":
+		*k = MetricKindGauge
+	case "counter":
+		*k = MetricKindCounter
+	case "both":
+		*k = MetricKindBoth
+	default:
+		return fmt.Errorf("invalid metric kind %q, expected 'gauge', 'counter' or 'both'", s)
+	}
+	return nil
+}
+
+// LogLevel is the minimum level of the messages logged.
+type LogLevel string
+
+const (
+	LogLevelDebug LogLevel = "debug"
+	LogLevelInfo  LogLevel = "info"
+	LogLevelWarn  LogLevel = "warn"
+	LogLevelError LogLevel = "error"
+)
+
+func (l *LogLevel) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	switch strings.ToLower(s) {
+	case "debug":
+		*l = LogLevelDebug
+	case "info":
+		*l = LogLevelInfo
+	case "warn", "warning":
+		*l = LogLevelWarn
+	case "error":
+		*l = LogLevelError
+	default:
+		return fmt.Errorf("invalid log level %q, expected 'debug', 'info', 'warn' or 'error'", s)
+	}
+	return nil
+}
+
+// LogFormat selects how log messages are written.
+type LogFormat string
+
+const (
+	LogFormatText LogFormat = "text"
+	LogFormatJSON LogFormat = "json"
+)
+
+func (f *LogFormat) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	switch strings.ToLower(s) {
+	case "text":
+		*f = LogFormatText
+	case "json":
+		*f = LogFormatJSON
+	default:
+		return fmt.Errorf("invalid log format %q, expected 'text' or 'json'", s)
+	}
+	return nil
+}
+
+type AttributeKeyStyle string
+
+const (
+	AttributeKeyStyleSnake AttributeKeyStyle = "snake"
+	AttributeKeyStyleDot   AttributeKeyStyle = "dot"
+	AttributeKeyStyleCamel AttributeKeyStyle = "camel"
+)
+
+func (s *AttributeKeyStyle) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return err
+	}
+	switch strings.ToLower(str) {
+	case "snake":
+		*s = AttributeKeyStyleSnake
+	case "dot":
+		*s = AttributeKeyStyleDot
+	case "camel":
+		*s = AttributeKeyStyleCamel
+	default:
+		return fmt.Errorf("invalid attribute key style %q, expected 'snake', 'dot' or 'camel'", str)
+	}
+	return nil
+}
+
+// AddrRange is an inclusive range of addresses of one family, written as
+// "min-max".
+type AddrRange struct {
+	Min netip.Addr
+	Max netip.Addr
+}
+
+func (r AddrRange) IsValid() bool {
+	return r.Min.IsValid() && r.Max.IsValid() && r.Min.Is4() == r.Max.Is4() && r.Min.Compare(r.Max) <= 0
+}
+
+func (r AddrRange) IsZero() bool {
+	return r == AddrRange{}
+}
+
+func (r AddrRange) String() string {
+	return fmt.Sprintf("%s-%s", r.Min, r.Max)
+}
+
+func (r AddrRange) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *AddrRange) UnmarshalText(text []byte) error {
+	lo, hi, ok := strings.Cut(string(text), "-")
+	if !ok {
+		return fmt.Errorf("invalid address range %q, expected min-max", string(text))
+	}
+	min, err := netip.ParseAddr(strings.TrimSpace(lo))
+	if err != nil {
+		return fmt.Errorf("invalid address range %q: %v", string(text), err)
+	}
+	max, err := netip.ParseAddr(strings.TrimSpace(hi))
+	if err != nil {
+		return fmt.Errorf("invalid address range %q: %v", string(text), err)
+	}
+	*r = AddrRange{Min: min, Max: max}
+	return nil
+}
+
+// MacAddr is an Ethernet address, written like "00:11:22:33:44:55".
+type MacAddr [6]byte
+
+func (m MacAddr) IsValid() bool {
+	return m != MacAddr{}
+}
+
+func (m MacAddr) String() string {
+	return net.HardwareAddr(m[:]).String()
+}
+
+func (m MacAddr) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *MacAddr) UnmarshalText(text []byte) error {
+	addr, err := net.ParseMAC(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid mac address %q: %v", string(text), err)
+	}
+	if len(addr) != len(m) {
+		return fmt.Errorf("invalid mac address %q, expected 6 bytes", string(text))
+	}
+	copy(m[:], addr)
+	return nil
+}
+
+// Duration is a time.Duration written with a unit, such as "30s" or "1m".
+// Bare numbers are rejected: they would silently be read as nanoseconds.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		if _, numErr := strconv.ParseFloat(s, 64); numErr == nil {
+			return fmt.Errorf("duration %q needs a unit, such as %ss", s, s)
+		}
+		return fmt.Errorf("invalid duration %q: %v", s, err)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// PortRange is an inclusive range of transport ports, written as "min-max".
+type PortRange struct {
+	Min uint16
+	Max uint16
+}
+
+func (r PortRange) IsValid() bool {
+	return r.Max != 0 && r.Min <= r.Max
+}
+
+func (r PortRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+func (r PortRange) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *PortRange) UnmarshalText(text []byte) error {
+	lo, hi, ok := strings.Cut(string(text), "-")
+	if !ok {
+		return fmt.Errorf("invalid port range %q, expected min-max", string(text))
+	}
+	min, err := strconv.ParseUint(strings.TrimSpace(lo), 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port range %q: %v", string(text), err)
+	}
+	max, err := strconv.ParseUint(strings.TrimSpace(hi), 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port range %q: %v", string(text), err)
+	}
+	*r = PortRange{Min: uint16(min), Max: uint16(max)}
+	if !r.IsValid() {
+		return fmt.Errorf("invalid port range %q", string(text))
 	}
 	return nil
 }
@@ -0,0 +1,345 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// Chain priorities outside this range are almost certainly a typo; the
+// standard hook priorities lie between -400 and 300.
+const (
+	minChainPriority = -1000
+	maxChainPriority = 1000
+)
+
+// maxDscp is the largest value of the 6 bit DSCP field.
+const maxDscp = 63
+
+// nameRe matches the identifiers nft accepts without quoting.
+var nameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_./-]*$`)
+
+// validName reports whether s can be used as a table or chain name. The
+// kernel limits names to NFT_NAME_MAXLEN (256) bytes including the NUL.
+func validName(s string) bool {
+	return len(s) < 256 && nameRe.MatchString(s)
+}
+
+// ValidateConfig checks cfg for settings that would fail at startup or make
+// a counter match something else than intended. All problems found are
+// returned joined together.
+func ValidateConfig(cfg *Config) error {
+	var errs []error
+
+	if cfg.Exporter.Interval <= 0 {
+		errs = append(errs, fmt.Errorf("exporter.interval must be positive"))
+	}
+
+	if err := cfg.Exporter.OTLP.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(cfg.Tables) == 0 || len(cfg.Counters.All()) > 0 {
+		errs = append(errs, validateTable("nftables.", "", cfg.NFTables, &cfg.Counters)...)
+	}
+	for i, t := range cfg.Tables {
+		key, prefix := fmt.Sprintf("tables[%d].", i), fmt.Sprintf("tables[%d] ", i)
+		errs = append(errs, validateTable(key, prefix, t.NFTables, &t.Counters)...)
+	}
+	if err := cfg.ValidateTables(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateTable checks the settings and counters of one table. Settings are
+// reported under key and counters under prefix.
+func validateTable(key, prefix string, n NFTables, counters *Counters) []error {
+	var errs []error
+
+	switch n.Family {
+	case TableFamilyIPv4, TableFamilyIPv6, TableFamilyInet:
+	default:
+		errs = append(errs, fmt.Errorf("%sfamily must be 'ip', 'ip6' or 'inet'", key))
+	}
+	if !validName(n.TableName) {
+		errs = append(errs, fmt.Errorf("%stable_name %q is not a valid nftables name", key, n.TableName))
+	}
+
+	chains := map[string]bool{}
+	for _, c := range []struct{ key, name string }{
+		{"input_chain", n.InputChain},
+		{"output_chain", n.OutputChain},
+		{"forward_chain", n.ForwardChain},
+	} {
+		if c.name == "" {
+			continue
+		}
+		if !validName(c.name) {
+			errs = append(errs, fmt.Errorf("%s%s %q is not a valid nftables name", key, c.key, c.name))
+		}
+		if chains[c.name] {
+			errs = append(errs, fmt.Errorf("%s%s %q is used for more than one direction", key, c.key, c.name))
+		}
+		chains[c.name] = true
+	}
+
+	for _, p := range []struct {
+		key      string
+		priority *int32
+	}{
+		{"chain_priority", &n.ChainPriority},
+		{"input_priority", n.InputPriority},
+		{"output_priority", n.OutputPriority},
+		{"forward_priority", n.ForwardPriority},
+	} {
+		if p.priority != nil && (*p.priority < minChainPriority || *p.priority > maxChainPriority) {
+			errs = append(errs, fmt.Errorf("%s%s %d is outside [%d, %d]", key, p.key, *p.priority, minChainPriority, maxChainPriority))
+		}
+	}
+
+	for i, counter := range counters.Input {
+		for _, err := range validateCounter(&counter, n.Family) {
+			errs = append(errs, fmt.Errorf("%sinput counter %d (%q): %w", prefix, i, counter.Label, err))
+		}
+	}
+	for i, counter := range counters.Output {
+		for _, err := range validateCounter(&counter, n.Family) {
+			errs = append(errs, fmt.Errorf("%soutput counter %d (%q): %w", prefix, i, counter.Label, err))
+		}
+	}
+	for i, counter := range counters.Forward {
+		for _, err := range validateCounter(&counter, n.Family) {
+			errs = append(errs, fmt.Errorf("%sforward counter %d (%q): %w", prefix, i, counter.Label, err))
+		}
+	}
+
+	if err := counters.ValidateLabels(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errs
+}
+
+// Validate checks the timeout and retry settings of o.
+func (o *OTLP) Validate() error {
+	var errs []error
+	if o.Timeout != nil && *o.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("exporter.otlp.timeout must be positive, got %s", *o.Timeout))
+	}
+	if r := o.Retry; r != nil {
+		for _, d := range []struct {
+			key   string
+			value Duration
+		}{
+			{"initial_interval", r.InitialInterval},
+			{"max_interval", r.MaxInterval},
+			{"max_elapsed_time", r.MaxElapsedTime},
+		} {
+			if d.value < 0 {
+				errs = append(errs, fmt.Errorf("exporter.otlp.retry.%s must not be negative, got %s", d.key, d.value))
+			}
+		}
+		if r.InitialInterval > 0 && r.MaxInterval > 0 && r.InitialInterval > r.MaxInterval {
+			errs = append(errs, fmt.Errorf("exporter.otlp.retry.initial_interval %s is greater than max_interval %s", r.InitialInterval, r.MaxInterval))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Validate checks every endpoint of e. With more than one, the errors name
+// the endpoint they belong to.
+func (e OTLPEndpoints) Validate() error {
+	var errs []error
+	for i, otlp := range e {
+		err := otlp.Validate()
+		if err != nil && len(e) > 1 {
+			err = fmt.Errorf("otlp endpoint %d (%q): %w", i, otlp.Endpoint, err)
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// ValidateFamily checks that the matches of c can be expressed in a table of
+// family. Addresses and ICMP of the other IP version would be read at the
+// offsets of the wrong header, matching garbage. In an inet table the
+// addresses select the IP version, and the other matches of the IP header
+// need one to be read at the right offsets.
+func (c *Counter) ValidateFamily(family TableFamily) error {
+	var errs []error
+	ip := c.IPFamily(family)
+	for _, addr := range c.addrs() {
+		if addr.Is4() == (ip == TableFamilyIPv4) {
+			continue
+		}
+		if family == TableFamilyInet {
+			errs = append(errs, fmt.Errorf("address %s does not match the family of the other addresses", addr))
+		} else {
+			errs = append(errs, fmt.Errorf("address %s does not match the table family", addr))
+		}
+	}
+	if !c.IsNegated("protocol") &&
+		(c.Protocol == ProtocolICMP && ip == TableFamilyIPv6 ||
+			c.Protocol == ProtocolICMPv6 && ip == TableFamilyIPv4) {
+		errs = append(errs, fmt.Errorf("protocol %s does not match the table family", c.Protocol))
+	}
+	if ip == TableFamilyInet {
+		for _, m := range []struct {
+			field string
+			set   bool
+		}{
+			{"protocol_header", c.ProtoHeader},
+			{"src_set", c.SrcSet != ""},
+			{"dst_set", c.DstSet != ""},
+			{"dscp", c.Dscp != nil},
+			{"fragmented", c.Fragmented},
+		} {
+			if m.set {
+				errs = append(errs, fmt.Errorf("%s requires an address to select ip or ip6 in an inet table", m.field))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ValidateLabels checks that no label is used twice within a direction.
+// Such counters are exported with the same label and are hard to tell apart.
+// Empty labels are not checked here.
+func (c *Counters) ValidateLabels() error {
+	var errs []error
+	for _, d := range []struct {
+		dir      string
+		counters []Counter
+	}{
+		{"input", c.Input},
+		{"output", c.Output},
+		{"forward", c.Forward},
+	} {
+		seen := map[string]bool{}
+		for _, counter := range d.counters {
+			if counter.Label == "" {
+				continue
+			}
+			if seen[counter.Label] {
+				errs = append(errs, fmt.Errorf("%s label %q is used by more than one counter", d.dir, counter.Label))
+			}
+			seen[counter.Label] = true
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validateCounter(c *Counter, family TableFamily) []error {
+	var errs []error
+
+	if c.Label == "" {
+		errs = append(errs, fmt.Errorf("label must not be empty"))
+	}
+
+	if err := c.ValidateFamily(family); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errs
+}
+
+// Validate checks that the match fields of the counter are consistent with
+// each other. Fields that only apply to some protocols are otherwise dropped
+// from the rule, making the counter match more traffic than intended.
+func (c *Counter) Validate() error {
+	var errs []error
+
+	if c.Protocol != 0 && c.Protocol.String() == "unknown" {
+		errs = append(errs, fmt.Errorf("unsupported protocol %d", c.Protocol))
+	}
+	if !c.Protocol.HasPorts() && (c.SrcPort != 0 || c.DstPort != 0 || c.SrcPortRange != (PortRange{}) || c.DstPortRange != (PortRange{})) {
+		errs = append(errs, fmt.Errorf("ports require protocol tcp, udp, udplite or sctp"))
+	}
+	if c.Protocol == 0 && c.ProtoHeader {
+		errs = append(errs, fmt.Errorf("protocol_header requires protocol"))
+	}
+	if c.Protocol != ProtocolTCP && len(c.TcpFlags) > 0 {
+		errs = append(errs, fmt.Errorf("tcp_flags require protocol tcp"))
+	}
+	if c.Protocol != ProtocolTCP && c.TcpWindow != nil {
+		errs = append(errs, fmt.Errorf("tcp_window requires protocol tcp"))
+	}
+	if c.TcpFlagsOp != "" && len(c.TcpFlags) == 0 {
+		errs = append(errs, fmt.Errorf("tcp_flags_op requires tcp_flags"))
+	}
+	if c.Protocol != ProtocolICMP && c.Protocol != ProtocolICMPv6 && (c.IcmpType != nil || c.IcmpCode != nil) {
+		errs = append(errs, fmt.Errorf("icmp_type and icmp_code require protocol icmp or icmpv6"))
+	}
+
+	if c.SrcPortRange != (PortRange{}) && !c.SrcPortRange.IsValid() {
+		errs = append(errs, fmt.Errorf("src_port_range %s is invalid", c.SrcPortRange))
+	}
+	if c.DstPortRange != (PortRange{}) && !c.DstPortRange.IsValid() {
+		errs = append(errs, fmt.Errorf("dst_port_range %s is invalid", c.DstPortRange))
+	}
+	if c.SrcPort != 0 && c.SrcPortRange != (PortRange{}) {
+		errs = append(errs, fmt.Errorf("src_port and src_port_range are mutually exclusive"))
+	}
+	if c.DstPort != 0 && c.DstPortRange != (PortRange{}) {
+		errs = append(errs, fmt.Errorf("dst_port and dst_port_range are mutually exclusive"))
+	}
+
+	if c.SrcAddr.IsValid() && c.SrcNet.IsValid() {
+		errs = append(errs, fmt.Errorf("src_addr and src_net are mutually exclusive"))
+	}
+	if c.DstAddr.IsValid() && c.DstNet.IsValid() {
+		errs = append(errs, fmt.Errorf("dst_addr and dst_net are mutually exclusive"))
+	}
+	if !c.SrcAddrRange.IsZero() && !c.SrcAddrRange.IsValid() {
+		errs = append(errs, fmt.Errorf("src_addr_range %s is invalid", c.SrcAddrRange))
+	}
+	if !c.DstAddrRange.IsZero() && !c.DstAddrRange.IsValid() {
+		errs = append(errs, fmt.Errorf("dst_addr_range %s is invalid", c.DstAddrRange))
+	}
+	if !c.SrcAddrRange.IsZero() && (c.SrcAddr.IsValid() || c.SrcNet.IsValid()) {
+		errs = append(errs, fmt.Errorf("src_addr_range cannot be combined with src_addr or src_net"))
+	}
+	if !c.DstAddrRange.IsZero() && (c.DstAddr.IsValid() || c.DstNet.IsValid()) {
+		errs = append(errs, fmt.Errorf("dst_addr_range cannot be combined with dst_addr or dst_net"))
+	}
+	if c.MarkMask != nil && c.Mark == nil {
+		errs = append(errs, fmt.Errorf("mark_mask requires mark"))
+	}
+	if c.Mark != nil && c.MarkMask != nil && *c.Mark&^*c.MarkMask != 0 {
+		errs = append(errs, fmt.Errorf("mark %#x has bits outside mark_mask %#x", *c.Mark, *c.MarkMask))
+	}
+	if c.CtMarkMask != nil && c.CtMark == nil {
+		errs = append(errs, fmt.Errorf("ct_mark_mask requires ct_mark"))
+	}
+	if c.CtMark != nil && c.CtMarkMask != nil && *c.CtMark&^*c.CtMarkMask != 0 {
+		errs = append(errs, fmt.Errorf("ct_mark %#x has bits outside ct_mark_mask %#x", *c.CtMark, *c.CtMarkMask))
+	}
+	if c.MinLen != 0 && c.MaxLen != 0 && c.MinLen > c.MaxLen {
+		errs = append(errs, fmt.Errorf("min_len %d is greater than max_len %d", c.MinLen, c.MaxLen))
+	}
+
+	if c.Dscp != nil && *c.Dscp > maxDscp {
+		errs = append(errs, fmt.Errorf("dscp %d is greater than %d", *c.Dscp, maxDscp))
+	}
+
+	if c.Limit != nil && c.Limit.Rate == 0 {
+		errs = append(errs, fmt.Errorf("limit rate must be positive"))
+	}
+	// An exhausted quota ends the rule, so nothing may follow it.
+	if c.Quota != 0 && (c.Limit != nil || c.Verdict != "") {
+		errs = append(errs, fmt.Errorf("quota cannot be combined with limit or verdict"))
+	}
+
+	for _, field := range c.Negate {
+		if !Negatable(field) {
+			errs = append(errs, fmt.Errorf("field %q cannot be negated", field))
+		}
+	}
+
+	return errors.Join(errs...)
+}
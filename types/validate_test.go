@@ -0,0 +1,191 @@
+package types
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateConfig(t *testing.T) {
+	valid := func() *Config {
+		return &Config{
+			Exporter: Exporter{Interval: Duration(10 * time.Second)},
+			NFTables: NFTables{Family: TableFamilyIPv4, TableName: "flowmon"},
+			Counters: Counters{
+				Input: []Counter{{Label: "https", Protocol: ProtocolTCP, DstPort: 443}},
+			},
+		}
+	}
+
+	if err := ValidateConfig(valid()); err != nil {
+		t.Fatalf("expected a valid config, got %v", err)
+	}
+
+	mark, markMask := uint32(0x100), uint32(0xff)
+	tests := []struct {
+		name    string
+		counter Counter
+		want    string
+	}{
+		{"missing label", Counter{Protocol: ProtocolTCP}, "label must not be empty"},
+		{"port without protocol", Counter{Label: "web", DstPort: 443}, "ports require protocol tcp, udp, udplite or sctp"},
+		{"tcp flags on udp", Counter{Label: "syn", Protocol: ProtocolUDP, TcpFlags: []TcpFlag{TcpFlagSYN}}, "tcp_flags require protocol tcp"},
+		{"tcp window without protocol", Counter{Label: "win", TcpWindow: new(uint16)}, "tcp_window requires protocol tcp"},
+		{"mark outside its mask", Counter{Label: "m", Mark: &mark, MarkMask: &markMask}, "mark 0x100 has bits outside mark_mask 0xff"},
+		{"protocol header without protocol", Counter{Label: "hdr", ProtoHeader: true}, "protocol_header requires protocol"},
+		{"wrong address family", Counter{Label: "v6", SrcAddr: netip.MustParseAddr("2001:db8::1")}, "does not match the table family"},
+		{"icmpv6 in an ip table", Counter{Label: "ping6", Protocol: ProtocolICMPv6}, "protocol icmpv6 does not match the table family"},
+		{"inverted address range", Counter{Label: "r", SrcAddrRange: AddrRange{Min: netip.MustParseAddr("10.0.0.9"), Max: netip.MustParseAddr("10.0.0.1")}}, "src_addr_range 10.0.0.9-10.0.0.1 is invalid"},
+		{"quota with verdict", Counter{Label: "q", Quota: 1 << 20, Verdict: VerdictDrop}, "quota cannot be combined with limit or verdict"},
+		{"inverted port range", Counter{Label: "r", Protocol: ProtocolTCP, DstPortRange: PortRange{Min: 20, Max: 10}}, "dst_port_range 20-10 is invalid"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid()
+			cfg.Counters.Output = []Counter{tt.counter}
+			err := ValidateConfig(cfg)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected an error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestValidateConfigJoinsErrors(t *testing.T) {
+	cfg := &Config{
+		NFTables: NFTables{Family: TableFamilyIPv4, TableName: "flowmon"},
+		Counters: Counters{Input: []Counter{{DstPort: 80}}},
+	}
+
+	err := ValidateConfig(cfg)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if lines := strings.Split(err.Error(), "\n"); len(lines) != 3 {
+		t.Errorf("expected 3 errors, got %q", lines)
+	}
+}
+
+func TestValidateLabels(t *testing.T) {
+	counters := Counters{
+		Input:  []Counter{{Label: "web"}, {Label: "dns"}, {}, {}},
+		Output: []Counter{{Label: "web"}, {Label: "ssh"}, {Label: "ssh"}},
+	}
+
+	err := counters.ValidateLabels()
+	if err == nil || !strings.Contains(err.Error(), `output label "ssh"`) {
+		t.Fatalf("expected a duplicate label error, got %v", err)
+	}
+	if strings.Contains(err.Error(), "web") {
+		t.Errorf("labels may repeat across directions, got %v", err)
+	}
+}
+
+func TestValidateConfigNFTables(t *testing.T) {
+	tooLow := int32(-5000)
+	tests := []struct {
+		name     string
+		nftables NFTables
+		want     string
+	}{
+		{"invalid table name", NFTables{Family: TableFamilyIPv4, TableName: "flow mon"}, "table_name"},
+		{"invalid chain name", NFTables{Family: TableFamilyIPv4, TableName: "flowmon", InputChain: "1nput"}, "input_chain"},
+		{"shared chain name", NFTables{Family: TableFamilyIPv4, TableName: "flowmon", InputChain: "count", OutputChain: "count"}, "more than one direction"},
+		{"priority out of range", NFTables{Family: TableFamilyIPv4, TableName: "flowmon", OutputPriority: &tooLow}, "output_priority"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Exporter: Exporter{Interval: Duration(time.Second)}, NFTables: tt.nftables}
+			err := ValidateConfig(cfg)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected an error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestValidateConfigTables(t *testing.T) {
+	cfg := &Config{
+		Exporter: Exporter{Interval: Duration(time.Second)},
+		Tables: []Table{
+			{NFTables: NFTables{Family: TableFamilyIPv4, TableName: "web"}},
+			{
+				NFTables: NFTables{Family: TableFamilyIPv4, TableName: "db"},
+				Counters: Counters{Input: []Counter{{Label: "mysql", DstPort: 3306}}},
+			},
+			{NFTables: NFTables{Family: TableFamilyIPv4}},
+		},
+	}
+
+	err := ValidateConfig(cfg)
+	for _, want := range []string{`tables[1] input counter 0 ("mysql")`, "tables[2].table_name is required"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("expected an error containing %q, got %v", want, err)
+		}
+	}
+}
+
+func TestValidateOTLP(t *testing.T) {
+	zero := Duration(0)
+	tests := []struct {
+		name string
+		otlp OTLP
+		want string
+	}{
+		{"zero timeout", OTLP{Timeout: &zero}, "timeout must be positive"},
+		{"negative retry interval", OTLP{Retry: &Retry{MaxElapsedTime: Duration(-time.Second)}}, "max_elapsed_time must not be negative"},
+		{"inverted retry intervals", OTLP{Retry: &Retry{InitialInterval: Duration(time.Minute), MaxInterval: Duration(time.Second)}}, "greater than max_interval"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.otlp.Validate()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected an error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+
+	timeout := Duration(30 * time.Second)
+	valid := OTLP{Timeout: &timeout, Retry: &Retry{InitialInterval: Duration(time.Second)}}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
+
+func TestValidateFamilyInet(t *testing.T) {
+	tests := []struct {
+		name    string
+		counter Counter
+		want    string
+	}{
+		{"protocol header", Counter{Label: "hdr", Protocol: ProtocolTCP, ProtoHeader: true}, "protocol_header requires an address to select ip or ip6"},
+		{"set", Counter{Label: "set", DstSet: "blocked"}, "dst_set requires an address to select ip or ip6"},
+		{"dscp", Counter{Label: "ef", Dscp: new(uint8)}, "dscp requires an address to select ip or ip6"},
+		{"both families", Counter{Label: "mixed", SrcAddr: netip.MustParseAddr("192.0.2.1"), DstNet: netip.MustParsePrefix("2001:db8::/32")}, "address 2001:db8:: does not match the family of the other addresses"},
+		{"icmpv6 to an ipv4 address", Counter{Label: "ping6", Protocol: ProtocolICMPv6, DstAddr: netip.MustParseAddr("192.0.2.1")}, "protocol icmpv6 does not match the table family"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.counter.ValidateFamily(TableFamilyInet)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected an error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+
+	// Addresses of either family select the header to read.
+	for _, c := range []Counter{
+		{Label: "v4", SrcAddr: netip.MustParseAddr("192.0.2.1"), Dscp: new(uint8), Fragmented: true},
+		{Label: "v6", DstNet: netip.MustParsePrefix("2001:db8::/32"), SrcSet: "local", Protocol: ProtocolICMPv6},
+		{Label: "any", Protocol: ProtocolICMP},
+	} {
+		if err := c.ValidateFamily(TableFamilyInet); err != nil {
+			t.Errorf("counter %q: expected no error, got %v", c.Label, err)
+		}
+	}
+}